@@ -74,29 +74,42 @@ func (a *ApiClient) WaitForState(expectedState string) error {
 	return err
 }
 
-func (a *ApiClient) PostCommand(command string) error {
+func (a *ApiClient) PostCommand(command string) (commandOutcome, error) {
+	var outcome commandOutcome
 	var err error
 	phony.Block(a, func() {
-		log.Printf("Requesting start ...")
+		log.Printf("Requesting %s ...", command)
 		_, e := a.callClient.
 			R().
+			SetResult(&outcome).
+			SetError(&outcome).
 			Post("/commands/" + command)
 		if e != nil {
 			err = e
 			return
 		}
 	})
-	return err
+	return outcome, err
 }
 
 func (a *ApiClient) WaitForEventSeen(eventName string) error {
+	return a.waitForEvent(eventName, func(c ReceivedEvent) bool {
+		return c.Name == eventName
+	})
+}
+
+func (a *ApiClient) WaitForEventOfCommandSeen(eventName, commandId string) error {
+	return a.waitForEvent(eventName+" of "+commandId, func(c ReceivedEvent) bool {
+		return c.Name == eventName && c.CommandId == commandId
+	})
+}
+
+func (a *ApiClient) waitForEvent(description string, matches func(c ReceivedEvent) bool) error {
 	var found bool
 	for i := 0; i < retriesForStateChange; i++ {
-		log.Printf("Waiting for event '%s' ...", eventName)
+		log.Printf("Waiting for event '%s' ...", description)
 		phony.Block(a, func() {
-			pos := slices.IndexFunc(a.receivedEvents, func(c ReceivedEvent) bool {
-				return c.Name == eventName
-			})
+			pos := slices.IndexFunc(a.receivedEvents, matches)
 			if pos >= 0 {
 				found = true
 			}
@@ -107,7 +120,7 @@ func (a *ApiClient) WaitForEventSeen(eventName string) error {
 		}
 	}
 	if !found {
-		return fmt.Errorf("Gave up waiting for event: %v", eventName)
+		return fmt.Errorf("Gave up waiting for event: %v", description)
 	}
 	return nil
 }
@@ -220,4 +233,5 @@ type ReceivedEvent struct {
 	Timestamp  time.Time              `json:"timestamp"`
 	Name       string                 `json:"name"`
 	Properties map[string]interface{} `json:"properties"`
+	CommandId  string                 `json:"command_id"`
 }
@@ -6,6 +6,7 @@ package mermaidlive
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"testing"
@@ -19,6 +20,7 @@ import (
 var opts = godog.Options{
 	Output: colors.Colored(os.Stdout),
 	Format: "pretty",
+	Tags:   "~@unit",
 }
 
 const testPort = "8081"
@@ -30,6 +32,7 @@ var sutBaseUrl string
 type clientKey struct{}
 type secondClientKey struct{}
 type serverKey struct{}
+type commandKey struct{}
 
 func aSystemInState(ctx context.Context, state string) (context.Context, error) {
 	// client
@@ -73,12 +76,39 @@ func theSystemIsFoundInState(ctx context.Context, state string) error {
 	return nil
 }
 
-func theSystemIsRequested(ctx context.Context, command string) error {
+func theSystemIsRequested(ctx context.Context, command string) (context.Context, error) {
+	client, err := getClient(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	outcome, err := client.PostCommand(command)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, commandKey{}, outcome), nil
+}
+
+func theCommandIsReportedAs(ctx context.Context, result string) error {
+	outcome, ok := ctx.Value(commandKey{}).(commandOutcome)
+	if !ok {
+		return errors.New("no command requested, check step definitions")
+	}
+	if outcome.Result != CommandResult(result) {
+		return fmt.Errorf("expected the command to be %s, but it was %s", result, outcome.Result)
+	}
+	return nil
+}
+
+func eventCarriesTheIdOfTheCommand(ctx context.Context, eventName string) error {
 	client, err := getClient(ctx)
 	if err != nil {
 		return err
 	}
-	return client.PostCommand(command)
+	outcome, ok := ctx.Value(commandKey{}).(commandOutcome)
+	if !ok {
+		return errors.New("no command requested, check step definitions")
+	}
+	return client.WaitForEventOfCommandSeen(eventName, outcome.CommandId)
 }
 
 func twoClientsHaveObserved(ctx context.Context, eventName string) error {
@@ -143,6 +173,8 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^a system in state "([^"]*)"$`, aSystemInState)
 	ctx.Step(`^some work has progressed$`, someWorkHasProgressed)
 	ctx.Step(`^the request is ignored$`, theRequestIsIgnored)
+	ctx.Step(`^the command is reported as "(\S+)"$`, theCommandIsReportedAs)
+	ctx.Step(`^"(\S+)" carries the id of the command$`, eventCarriesTheIdOfTheCommand)
 	ctx.Step(`^the system is found in state "([^"]*)"$`, theSystemIsFoundInState)
 	ctx.Step(`^the system "([^"]*)" is requested$`, theSystemIsRequested)
 	ctx.Step(`^two clients have observed "([^"]*)"$`, twoClientsHaveObserved)
@@ -198,14 +230,20 @@ func configureTestParameters() {
 func startServer() {
 	log.Println("Starting a new server")
 	eventPublisher := pubsub.New[string, Event](1)
+	config, err := LoadConfig(nil)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	config.Port = testPort
+	config.CountdownDelay = 50 * time.Millisecond
 	server := NewServerWithOptions(
-		testPort,
+		config,
 		eventPublisher,
 		GetFS(),
-		50*time.Millisecond,
+		nil,
 	)
 	sutBaseUrl = "http://localhost:" + testPort
-	go server.Run(testPort)
+	go server.Run()
 }
 
 func updateDurationIfInEnv(key string, def time.Duration) time.Duration {
@@ -2,21 +2,87 @@ package mermaidlive
 
 import (
 	"context"
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/Arceliar/phony"
 	"github.com/cskr/pubsub/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// guards that can be referenced by name in a machine definition, holding for the count of the machine,
+// so that the journal replays the same transitions
+var guards = map[string]func(count uint8) bool{
+	"":     func(_ uint8) bool { return true },
+	"idle": func(count uint8) bool { return count == 0 },
+	"busy": func(count uint8) bool { return count != 0 },
+}
+
 type AsyncFSM struct {
 	phony.Inbox
-	ctx          context.Context
-	cancel       context.CancelFunc
-	events       *pubsub.PubSub[string, Event]
-	delay        time.Duration
+	id         string
+	topic      string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	events     *pubsub.PubSub[string, Event]
+	store      StateStore
+	journal    EventJournal
+	definition *MachineDefinition
+	delay      time.Duration
+	runDelay   time.Duration // of the countdown in progress, which SetDelay does not affect
+	// the parameters of the countdown in progress, if any
+	run          RunParameters
 	currentCount uint8
 	currentState string
+	// the commands starting work, waiting for the machine to be done with the current one
+	queue      []QueuedWork
+	queueDepth int
+	// the command that led to the current state
+	commandId string
+	// the trace of that command, continued by the timed behaviors
+	commandTrace trace.SpanContext
+	// the span of the running behavior
+	behaviorContext context.Context
+}
+
+// CommandResult tells what became of a command
+type CommandResult string
+
+const (
+	CommandAccepted CommandResult = "accepted"
+	// the command is known, but not applicable in the current state
+	CommandIgnored CommandResult = "ignored"
+	// the command is unknown to the machine
+	CommandRejected CommandResult = "rejected"
+	// the command waits in the work queue, see SetWorkQueueDepth
+	CommandQueued CommandResult = "queued"
+)
+
+const maxWorkQueueDepth = 100
+
+var errQueuedWorkNotFound = errors.New("queued work not found")
+
+// QueuedWork is a command starting work, taken once the machine is done with the work before it
+type QueuedWork struct {
+	// the id of the command
+	Id         string        `json:"id"`
+	Command    string        `json:"command"`
+	Parameters RunParameters `json:"parameters,omitzero"`
+	QueuedAt   time.Time     `json:"queued_at"`
+}
+
+// NewCommandId identifies a submitted command
+func NewCommandId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
 func NewAsyncFSM(events *pubsub.PubSub[string, Event]) *AsyncFSM {
@@ -24,91 +90,477 @@ func NewAsyncFSM(events *pubsub.PubSub[string, Event]) *AsyncFSM {
 }
 
 func NewCustomAsyncFSM(events *pubsub.PubSub[string, Event], delay time.Duration) *AsyncFSM {
+	return NewAsyncFSMFromDefinition(events, DefaultMachineDefinition(), delay)
+}
+
+func NewAsyncFSMFromDefinition(events *pubsub.PubSub[string, Event], definition *MachineDefinition, delay time.Duration) *AsyncFSM {
+	return NewNamedAsyncFSM(DefaultMachineId, events, definition, delay)
+}
+
+// NewNamedAsyncFSM creates a machine publishing to its own topic, see MachineTopic
+func NewNamedAsyncFSM(id string, events *pubsub.PubSub[string, Event], definition *MachineDefinition, delay time.Duration) *AsyncFSM {
 	return &AsyncFSM{
-		ctx:          context.Background(),
-		cancel:       noOp(), /*no-op*/
-		events:       events,
-		delay:        delay,
-		currentState: "waiting",
+		id:              id,
+		topic:           MachineTopic(id),
+		ctx:             context.Background(),
+		cancel:          noOp(), /*no-op*/
+		events:          events,
+		definition:      definition,
+		delay:           delay,
+		runDelay:        delay,
+		currentState:    definition.Initial,
+		behaviorContext: context.Background(),
 	}
 }
 
 func (fsm *AsyncFSM) StartWork() {
+	fsm.Command("start")
+}
+
+func (fsm *AsyncFSM) AbortWork() {
+	fsm.Command("abort")
+}
+
+// Command executes the first transition declared for the command
+// that leaves the current state and whose guard holds
+func (fsm *AsyncFSM) Command(command string) {
 	fsm.Act(fsm, func() {
-		if fsm.currentCount != 0 {
-			fsm.events.Pub(NewEventWithReason("RequestIgnored", "cannot start: machine busy"), Topic)
-			return
-		}
-		fsm.ctx, fsm.cancel = context.WithCancel(context.Background())
-		fsm.currentState = "working"
-		fsm.events.Pub(NewSimpleEvent("WorkStarted"), Topic)
-		fsm.currentCount = 10
-		go fsm.tick()
+		fsm.tracedSync(context.Background(), "command "+command, func() {
+			fsm.commandSync("", command, RunParameters{})
+		})
 	})
-	log.Println("StartWork finished")
+	slog.Info("command dispatched", "machine", fsm.id, "command", command)
 }
 
-func (fsm *AsyncFSM) AbortWork() {
+// Submit waits for the machine to either take or ignore the command.
+// The events resulting from the command carry its id, and continue the trace of the context.
+// The parameters, checked by the caller, apply to the countdown the command starts, if any
+func (fsm *AsyncFSM) Submit(ctx context.Context, commandId, command string, params RunParameters) (CommandResult, string) {
+	var result CommandResult
+	var reason string
+	phony.Block(fsm, func() {
+		fsm.tracedSync(ctx, "command "+command, func() {
+			trace.SpanFromContext(fsm.behaviorContext).SetAttributes(attribute.String("command_id", commandId))
+			result, reason = fsm.commandSync(commandId, command, params)
+			trace.SpanFromContext(fsm.behaviorContext).SetAttributes(attribute.String("result", string(result)))
+		})
+	})
+	slog.Info("command submitted", "machine", fsm.id, "command_id", commandId, "command", command, "result", result)
+	commandsTotal.WithLabelValues(command, string(result)).Inc()
+	return result, reason
+}
+
+func (fsm *AsyncFSM) commandSync(commandId, command string, params RunParameters) (CommandResult, string) {
+	if t := fsm.applicableTransitionSync(command); t != nil {
+		fsm.commandId = commandId
+		fsm.commandTrace = trace.SpanContextFromContext(fsm.behaviorContext)
+		fsm.takeSync(t, params)
+		return CommandAccepted, ""
+	}
+	candidates := fsm.definition.transitionsFor(command)
+	reason := "unknown command: '" + command + "'"
+	if len(candidates) > 0 {
+		reason = candidates[0].ignoredReason(fsm.currentState)
+	}
+	if fsm.queueDepth > 0 && fsm.startsWorkLaterSync(candidates) {
+		if len(fsm.queue) < fsm.queueDepth {
+			fsm.enqueueSync(QueuedWork{Id: commandId, Command: command, Parameters: params, QueuedAt: time.Now()})
+			return CommandQueued, ""
+		}
+		reason = fmt.Sprintf("%s; work queue full (%d)", reason, fsm.queueDepth)
+	}
+	fsm.publishSync(NewEventWithReason("RequestIgnored", reason).WithCommandId(commandId))
+	return CommandIgnored, reason
+}
+
+// applicableTransitionSync is the first transition of the command leaving the current state whose guard holds, if any
+func (fsm *AsyncFSM) applicableTransitionSync(command string) *TransitionDefinition {
+	for _, t := range fsm.definition.transitionsFor(command) {
+		if t.From == fsm.currentState && guards[t.Guard](fsm.currentCount) {
+			return t
+		}
+	}
+	return nil
+}
+
+// startsWorkLaterSync tells whether a transition starts a countdown from an idle state the machine is not in.
+// Continuing a held countdown does not count
+func (fsm *AsyncFSM) startsWorkLaterSync(candidates []*TransitionDefinition) bool {
+	for _, t := range candidates {
+		from, _ := fsm.definition.State(t.From)
+		to, _ := fsm.definition.State(t.To)
+		if to.Countdown > 0 && from.Countdown == 0 && !from.Holds && t.From != fsm.currentState {
+			return true
+		}
+	}
+	return false
+}
+
+func (fsm *AsyncFSM) enqueueSync(work QueuedWork) {
+	fsm.queue = append(fsm.queue, work)
+	event := NewEventWithProperties("WorkQueued", map[string]any{
+		"id":       work.Id,
+		"command":  work.Command,
+		"position": len(fsm.queue),
+	}).WithCommandId(work.Id)
+	if !work.Parameters.isZero() {
+		maps.Copy(event.Properties, work.Parameters.properties())
+	}
+	fsm.publishSync(event)
+	fsm.persistSync()
+}
+
+// dequeueSync starts the next queued work, once the machine can take it
+func (fsm *AsyncFSM) dequeueSync() {
+	if len(fsm.queue) == 0 {
+		return
+	}
+	next := fsm.queue[0]
+	t := fsm.applicableTransitionSync(next.Command)
+	if t == nil {
+		return
+	}
+	fsm.queue = fsm.queue[1:]
+	fsm.publishSync(dequeuedEvent(next, "started", len(fsm.queue)))
+	fsm.commandId = next.Id
+	fsm.commandTrace = trace.SpanContextFromContext(fsm.behaviorContext)
+	fsm.takeSync(t, next.Parameters)
+}
+
+func dequeuedEvent(work QueuedWork, reason string, queued int) Event {
+	return NewEventWithProperties("WorkDequeued", map[string]any{
+		"id":      work.Id,
+		"command": work.Command,
+		"reason":  reason,
+		"queued":  queued,
+	}).WithCommandId(work.Id)
+}
+
+// SetWorkQueueDepth lets the commands starting work wait while the machine is busy, up to the depth.
+// Lowering the depth keeps the work already queued. 0 turns queueing off
+func (fsm *AsyncFSM) SetWorkQueueDepth(depth int) {
 	fsm.Act(fsm, func() {
-		if fsm.currentCount == 0 {
-			fsm.events.Pub(NewEventWithReason("RequestIgnored", "cannot abort: machine not busy"), Topic)
+		fsm.queueDepth = depth
+	})
+}
+
+// Queue lists the queued work, the next first
+func (fsm *AsyncFSM) Queue() []QueuedWork {
+	var res []QueuedWork
+	phony.Block(fsm, func() {
+		res = slices.Clone(fsm.queue)
+	})
+	if res == nil {
+		res = []QueuedWork{}
+	}
+	return res
+}
+
+// CancelQueued removes the work of the command id from the queue
+func (fsm *AsyncFSM) CancelQueued(id string) error {
+	err := errQueuedWorkNotFound
+	phony.Block(fsm, func() {
+		i := slices.IndexFunc(fsm.queue, func(work QueuedWork) bool { return work.Id == id })
+		if i < 0 {
 			return
 		}
+		work := fsm.queue[i]
+		fsm.queue = slices.Delete(fsm.queue, i, i+1)
+		fsm.publishSync(dequeuedEvent(work, "canceled", len(fsm.queue)))
+		fsm.persistSync()
+		err = nil
+	})
+	if err == nil {
+		slog.Info("queued work canceled", "machine", fsm.id, "command_id", id)
+	}
+	return err
+}
+
+// Stop cancels pending timers and detaches the state store and journal, the machine keeps its last state
+func (fsm *AsyncFSM) Stop() {
+	phony.Block(fsm, func() {
 		fsm.cancel()
-		fsm.currentState = "aborting"
-		fsm.events.Pub(NewSimpleEvent("WorkAbortRequested"), Topic)
+		fsm.store = nil
+		fsm.journal = nil
 	})
-	log.Println("AbortWork finished")
 }
 
-func (fsm *AsyncFSM) tick() {
-	fsm.Act(fsm, func() {
-		// check if aborted
-		select {
-		case <-fsm.ctx.Done():
-			go func() {
-				time.Sleep(fsm.delay)
-				fsm.abort()
-			}()
-			return
-		default:
-			// not canceled yet
+func (fsm *AsyncFSM) takeSync(t *TransitionDefinition, params RunParameters) {
+	if t.From == t.To {
+		// re-requested: the state keeps its count and timers
+		transitionsTotal.WithLabelValues(fsm.id, t.From, t.To).Inc()
+		if t.Event != "" {
+			fsm.publishSync(NewSimpleEvent(t.Event).WithCommandId(fsm.commandId))
 		}
-		fsm.events.Pub(NewEventWithParam("Tick", fsm.currentCount), Topic)
-		fsm.currentCount--
-		if fsm.currentCount == 0 {
-			go func() {
-				time.Sleep(fsm.delay)
-				fsm.done()
-			}()
-			return
+		return
+	}
+	// timers scheduled in the previous state are obsolete
+	fsm.cancel()
+	fsm.ctx, fsm.cancel = context.WithCancel(context.Background())
+	transitionsTotal.WithLabelValues(fsm.id, t.From, t.To).Inc()
+	from, _ := fsm.definition.State(fsm.currentState)
+	fsm.currentState = t.To
+	state, _ := fsm.definition.State(t.To)
+	resuming := state.Countdown > 0 && from.Holds && !fsm.run.isZero()
+	switch {
+	case resuming, state.Holds:
+		// the count and the run are held
+	case state.Countdown > 0:
+		fsm.run, fsm.runDelay = params.resolve(state.Countdown, fsm.delay)
+	default:
+		fsm.run = RunParameters{}
+	}
+	if t.Event != "" {
+		event := NewSimpleEvent(t.Event).WithCommandId(fsm.commandId)
+		if !fsm.run.isZero() {
+			// echoes the parameters of the countdown it starts, holds or continues
+			event.Properties = fsm.run.properties()
+			if resuming || state.Holds {
+				event.Properties["remaining"] = fsm.currentCount
+			}
 		}
-		go func() {
-			time.Sleep(fsm.delay)
-			fsm.tick()
-		}()
+		fsm.publishSync(event)
+	}
+	if resuming {
+		fsm.persistSync()
+		fsm.publishDiagramSync()
+		fsm.continueCountdownSync()
+		return
+	}
+	if state.Countdown > 0 {
+		fsm.currentCount = uint8(fsm.run.Ticks)
+		fsm.tickSync()
+		return
+	}
+	if !state.Holds {
+		fsm.currentCount = 0
+	}
+	fsm.persistSync()
+	fsm.publishDiagramSync()
+	fsm.scheduleAutomaticTransitionSync()
+	fsm.dequeueSync()
+}
+
+func (fsm *AsyncFSM) tickSync() {
+	state, _ := fsm.definition.State(fsm.currentState)
+	fsm.publishSync(NewEventWithParam(state.tickEvent(), fsm.currentCount).WithCommandId(fsm.commandId))
+	ticksTotal.WithLabelValues(fsm.id).Inc()
+	fsm.currentCount--
+	fsm.persistSync()
+	fsm.publishDiagramSync()
+	fsm.continueCountdownSync()
+}
+
+func (fsm *AsyncFSM) continueCountdownSync() {
+	if fsm.currentCount != 0 {
+		fsm.after(fsm.runDelay, fsm.tickSync)
+		return
+	}
+	fsm.scheduleAutomaticTransitionSync()
+}
+
+func (fsm *AsyncFSM) scheduleAutomaticTransitionSync() {
+	if next := fsm.definition.automaticTransitionFrom(fsm.currentState); next != nil {
+		fsm.after(next.delay(fsm.delay), func() {
+			fsm.takeSync(next, RunParameters{})
+		})
+	}
+}
+
+// SetDelay changes the delay of the countdowns started from now on
+func (fsm *AsyncFSM) SetDelay(delay time.Duration) {
+	fsm.Act(fsm, func() {
+		fsm.delay = delay
 	})
 }
 
-func (fsm *AsyncFSM) abort() {
+// UseStateStore makes the machine snapshot its state on each transition and tick
+func (fsm *AsyncFSM) UseStateStore(store StateStore) {
 	fsm.Act(fsm, func() {
-		fsm.currentState = "waiting"
-		fsm.currentCount = 0
-		fsm.events.Pub(NewSimpleEvent("WorkAborted"), Topic)
+		fsm.store = store
 	})
 }
 
-func (fsm *AsyncFSM) done() {
+// UseJournal makes the machine record each published event
+func (fsm *AsyncFSM) UseJournal(journal EventJournal) {
 	fsm.Act(fsm, func() {
-		fsm.currentState = "waiting"
-		fsm.currentCount = 0
-		fsm.events.Pub(NewSimpleEvent("WorkDone"), Topic)
+		fsm.journal = journal
+	})
+}
+
+// Recover restores the last snapshot from the state store or, lacking one, replays the journal,
+// and either resumes or aborts the work that was in flight
+func (fsm *AsyncFSM) Recover(policy RecoveryPolicy) {
+	fsm.Act(fsm, func() {
+		snapshot, found := fsm.lastSnapshotSync()
+		if !found || snapshot.State == fsm.definition.Initial {
+			return
+		}
+		state, known := fsm.definition.State(snapshot.State)
+		if !known {
+			slog.Warn("ignoring the snapshot: unknown state", "machine", fsm.id, "state", snapshot.State)
+			return
+		}
+		fsm.recoverSync(snapshot, state, policy)
 	})
 }
 
+func (fsm *AsyncFSM) lastSnapshotSync() (MachineSnapshot, bool) {
+	if fsm.store != nil {
+		snapshot, found, err := fsm.store.Load(fsm.id)
+		if err != nil {
+			slog.Error("could not load the snapshot", "machine", fsm.id, "error", err)
+		}
+		if found {
+			return snapshot, true
+		}
+	}
+	if fsm.journal != nil {
+		events, err := fsm.journal.Read(fsm.id, time.Time{})
+		if err != nil {
+			slog.Error("could not read the journal", "machine", fsm.id, "error", err)
+		}
+		return fsm.definition.Replay(fsm.id, events)
+	}
+	return MachineSnapshot{}, false
+}
+
+func (fsm *AsyncFSM) recoverSync(snapshot MachineSnapshot, state StateDefinition, policy RecoveryPolicy) {
+	slog.Info("recovering", "machine", fsm.id, "state", snapshot.State, "count", snapshot.Count, "policy", policy)
+	recovered := NewEventWithProperties("WorkRecovered", map[string]any{
+		"state":  snapshot.State,
+		"count":  snapshot.Count,
+		"policy": string(policy),
+	})
+	fsm.cancel()
+	fsm.ctx, fsm.cancel = context.WithCancel(context.Background())
+	fsm.run = RunParameters{}
+	if policy == RecoverByAborting {
+		fsm.currentState = fsm.definition.Initial
+		fsm.currentCount = 0
+		fsm.queue = nil
+		fsm.publishSync(recovered)
+		for i, work := range snapshot.Queue {
+			fsm.publishSync(dequeuedEvent(work, "recovered", len(snapshot.Queue)-i-1))
+		}
+		fsm.persistSync()
+		fsm.publishDiagramSync()
+		return
+	}
+	fsm.currentState = snapshot.State
+	fsm.currentCount = snapshot.Count
+	fsm.queue = snapshot.Queue
+	var params RunParameters
+	if snapshot.Run != nil {
+		params = *snapshot.Run
+	}
+	if state.Holds && snapshot.Run != nil {
+		fsm.run, fsm.runDelay = params.resolve(0, fsm.delay)
+	}
+	fsm.publishSync(recovered)
+	fsm.publishDiagramSync()
+	if state.Countdown > 0 {
+		fsm.run, fsm.runDelay = params.resolve(state.Countdown, fsm.delay)
+		fsm.continueCountdownSync()
+		return
+	}
+	fsm.scheduleAutomaticTransitionSync()
+}
+
+func (fsm *AsyncFSM) persistSync() {
+	if fsm.store == nil {
+		return
+	}
+	snapshot := MachineSnapshot{
+		Machine:   fsm.id,
+		State:     fsm.currentState,
+		Count:     fsm.currentCount,
+		Timestamp: now(),
+		Queue:     fsm.queue,
+	}
+	if !fsm.run.isZero() {
+		run := fsm.run
+		snapshot.Run = &run
+	}
+	err := fsm.store.Save(snapshot)
+	if err != nil {
+		slog.Error("could not persist the state", "machine", fsm.id, "error", err)
+	}
+}
+
+func (fsm *AsyncFSM) publishSync(event Event) {
+	event = event.OfMachine(fsm.id)
+	if fsm.journal != nil {
+		if err := fsm.journal.Append(fsm.id, event); err != nil {
+			slog.Error("could not journal the event", "machine", fsm.id, "event", event.Name, "error", err)
+		}
+	}
+	fsm.fanOutSync(event)
+}
+
+func (fsm *AsyncFSM) publishDiagramSync() {
+	// derived from the state, hence not journaled
+	fsm.fanOutSync(NewEventWithParam(MachineDiagramEvent, fsm.diagramSync()).OfMachine(fsm.id))
+}
+
+// fanOutSync hands the event to the subscribers, which continue the span of the publication
+func (fsm *AsyncFSM) fanOutSync(event Event) {
+	_, span := tracer.Start(fsm.behaviorContext, "publish "+event.Name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("machine", fsm.id),
+			attribute.Int64("event.id", int64(event.Id)),
+		),
+	)
+	defer span.End()
+	event.spanContext = span.SpanContext()
+	fsm.events.Pub(event, fsm.topic)
+}
+
+// tracedSync runs the behavior in a span, under which the events it publishes are traced
+func (fsm *AsyncFSM) tracedSync(ctx context.Context, name string, behavior func()) {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("machine", fsm.id),
+		attribute.String("state", fsm.currentState),
+	))
+	defer span.End()
+	fsm.behaviorContext = ctx
+	defer func() { fsm.behaviorContext = context.Background() }()
+	behavior()
+}
+
+func (fsm *AsyncFSM) diagramSync() string {
+	progress := ""
+	state, _ := fsm.definition.State(fsm.currentState)
+	switch {
+	case state.Countdown > 0:
+		// the count has already been decremented past the last published tick
+		progress = fmt.Sprintf("%d", fsm.currentCount+1)
+	case state.Holds && !fsm.run.isZero():
+		progress = fmt.Sprintf("%d left", fsm.currentCount)
+	}
+	return fsm.definition.RenderMermaid(fsm.currentState, progress)
+}
+
+// after runs the behavior on the actor after the delay,
+// unless the machine has left the current state in the meantime
+func (fsm *AsyncFSM) after(delay time.Duration, behavior func()) {
+	ctx := fsm.ctx
+	go func() {
+		time.Sleep(delay)
+		fsm.Act(fsm, func() {
+			if ctx.Err() != nil {
+				return
+			}
+			commandContext := trace.ContextWithSpanContext(context.Background(), fsm.commandTrace)
+			fsm.tracedSync(commandContext, "timer", behavior)
+		})
+	}()
+}
+
 // sync queries - not to be used from within actor behaviors (methods)
 func (fsm *AsyncFSM) IsWaiting() bool {
-	return fsm.getCurrentCount() == 0
+	return fsm.CurrentState() == fsm.definition.Initial
 }
 
 func (fsm *AsyncFSM) CurrentState() string {
@@ -119,6 +571,50 @@ func (fsm *AsyncFSM) CurrentState() string {
 	return res
 }
 
+func (fsm *AsyncFSM) Diagram() string {
+	var res string
+	phony.Block(fsm, func() {
+		res = fsm.diagramSync()
+	})
+	return res
+}
+
+// LastSeenState tells a new subscriber the current state and, during a countdown,
+// the last tick out of the ticks of the run
+func (fsm *AsyncFSM) LastSeenState() Event {
+	var res Event
+	phony.Block(fsm, func() {
+		res = NewEventWithParam("LastSeenState", fsm.currentState).OfMachine(fsm.id)
+		state, _ := fsm.definition.State(fsm.currentState)
+		switch {
+		case state.Countdown > 0:
+			maps.Copy(res.Properties, fsm.run.properties())
+			// the count has already been decremented past the last published tick
+			res.Properties["count"] = fsm.currentCount + 1
+		case state.Holds && !fsm.run.isZero():
+			maps.Copy(res.Properties, fsm.run.properties())
+			res.Properties["remaining"] = fsm.currentCount
+		}
+		if len(fsm.queue) > 0 {
+			res.Properties["queued"] = len(fsm.queue)
+		}
+	})
+	return res
+}
+
+func (fsm *AsyncFSM) Id() string {
+	return fsm.id
+}
+
+func (fsm *AsyncFSM) Topic() string {
+	return fsm.topic
+}
+
+// Definition is immutable after construction and can be read without blocking
+func (fsm *AsyncFSM) Definition() *MachineDefinition {
+	return fsm.definition
+}
+
 func (fsm *AsyncFSM) getCurrentCount() uint8 {
 	var currentCount uint8
 	phony.Block(fsm, func() {
@@ -0,0 +1,334 @@
+package mermaidlive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role grants access to the routes of its own and the lesser roles
+type Role string
+
+const (
+	// only valid as the role of the anonymous callers, who then have no access
+	RoleNone     Role = "none"
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+func (r Role) valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// includes tells whether the role grants the other one
+func (r Role) includes(other Role) bool {
+	return r.valid() && roleRanks[r] >= roleRanks[other]
+}
+
+func errBadRole(role Role) error {
+	return fmt.Errorf("expected %s, %s or %s: '%s'", RoleViewer, RoleOperator, RoleAdmin, role)
+}
+
+// AuthToken is a static bearer token
+type AuthToken struct {
+	Token string `json:"token"`
+	Role  Role   `json:"role"`
+}
+
+// AuthUser authenticates by basic auth. The password may be a bcrypt hash
+type AuthUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     Role   `json:"role"`
+}
+
+const minHmacSecretLength = 32
+
+// Identity is the authenticated caller
+type Identity struct {
+	// empty for the anonymous callers and the static tokens
+	Name   string
+	Role   Role
+	Method string
+}
+
+var errNoCredentials = errors.New("no credentials")
+var errUnauthorized = errors.New("unauthorized")
+var errForbidden = errors.New("forbidden")
+
+// Authenticator identifies the callers by one kind of credentials
+type Authenticator interface {
+	// Authenticate returns errNoCredentials if the request does not carry credentials it recognizes
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// authenticators tries each authenticator in turn, the callers without credentials being anonymous
+type authenticators struct {
+	authenticators []Authenticator
+	anonymous      Identity
+	// the schemes of the WWW-Authenticate header
+	challenges []string
+}
+
+// newAuthenticators configures the static tokens, the HMAC-signed tokens and the basic auth users.
+// Without any of them, anyone may do anything
+func newAuthenticators(config Config) *authenticators {
+	res := &authenticators{
+		anonymous: Identity{Role: config.AuthAnonymousRole, Method: "anonymous"},
+	}
+	if len(config.AuthTokens) > 0 {
+		res.authenticators = append(res.authenticators, staticTokens(config.AuthTokens))
+	}
+	if config.AuthHmacSecret != "" {
+		res.authenticators = append(res.authenticators, hmacTokens([]byte(config.AuthHmacSecret)))
+	}
+	if len(res.authenticators) > 0 {
+		res.challenges = append(res.challenges, `Bearer realm="mermaidlive"`)
+	}
+	if len(config.AuthUsers) > 0 {
+		res.authenticators = append(res.authenticators, basicUsers(config.AuthUsers))
+		res.challenges = append(res.challenges, `Basic realm="mermaidlive"`)
+	}
+	if len(res.authenticators) == 0 {
+		res.anonymous.Role = RoleAdmin
+	}
+	return res
+}
+
+func (a *authenticators) enabled() bool {
+	return len(a.authenticators) > 0
+}
+
+func (a *authenticators) authenticate(r *http.Request) (Identity, error) {
+	if !a.enabled() {
+		return a.anonymous, nil
+	}
+	for _, authenticator := range a.authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if !errors.Is(err, errNoCredentials) {
+			return identity, err
+		}
+	}
+	if _, ok := bearerToken(r); ok || r.Header.Get("Authorization") != "" {
+		return Identity{}, errors.New("unrecognized credentials")
+	}
+	return a.anonymous, nil
+}
+
+// bearerToken is taken from the Authorization header or, as browsers cannot set it on streams and websockets,
+// from the access_token query parameter
+func bearerToken(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token), true
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+type staticTokens []AuthToken
+
+func (tokens staticTokens) Authenticate(r *http.Request) (Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return Identity{}, errNoCredentials
+	}
+	for _, candidate := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate.Token)) == 1 {
+			return Identity{Role: candidate.Role, Method: "token"}, nil
+		}
+	}
+	// might be signed
+	return Identity{}, errNoCredentials
+}
+
+// hmacTokens are JWTs signed with HS256, naming the caller in "sub" and its role in "role"
+type hmacTokens []byte
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Role      Role   `json:"role"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// IssueToken signs a token for the subject in the role, valid for the ttl
+func IssueToken(secret []byte, subject string, role Role, ttl time.Duration) (string, error) {
+	if !role.valid() {
+		return "", errBadRole(role)
+	}
+	now := time.Now()
+	claims, _ := json.Marshal(tokenClaims{
+		Subject:   subject,
+		Role:      role,
+		ExpiresAt: now.Add(ttl).Unix(),
+		IssuedAt:  now.Unix(),
+	})
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(secret, signed)), nil
+}
+
+func sign(secret []byte, text string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(text))
+	return mac.Sum(nil)
+}
+
+func (secret hmacTokens) Authenticate(r *http.Request) (Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return Identity{}, errNoCredentials
+	}
+	parts := strings.Split(token, ".")
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("malformed token: %w", err)
+	}
+	// the algorithm is not up to the caller
+	if header.Algorithm != "HS256" {
+		return Identity{}, fmt.Errorf("unsupported token algorithm: '%s'", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(secret, parts[0]+"."+parts[1])) {
+		return Identity{}, errors.New("bad token signature")
+	}
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("malformed token: %w", err)
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return Identity{}, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return Identity{}, errors.New("token not valid yet")
+	}
+	if !claims.Role.valid() {
+		return Identity{}, fmt.Errorf("token role: %w", errBadRole(claims.Role))
+	}
+	return Identity{Name: claims.Subject, Role: claims.Role, Method: "hmac"}, nil
+}
+
+func decodeTokenPart(part string, target any) error {
+	text, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(text, target)
+}
+
+type basicUsers []AuthUser
+
+func (users basicUsers) Authenticate(r *http.Request) (Identity, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return Identity{}, errNoCredentials
+	}
+	for _, user := range users {
+		if user.Name == name && user.checkPassword(password) {
+			return Identity{Name: name, Role: user.Role, Method: "basic"}, nil
+		}
+	}
+	return Identity{}, errors.New("bad user name or password")
+}
+
+func (u AuthUser) checkPassword(password string) bool {
+	if strings.HasPrefix(u.Password, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+}
+
+type authenticationKey struct{}
+
+// authentication is the outcome of authenticating a request
+type authentication struct {
+	identity Identity
+	err      error
+}
+
+func withAuthentication(ctx context.Context, auth authentication) context.Context {
+	return context.WithValue(ctx, authenticationKey{}, auth)
+}
+
+// identityOf is the authenticated caller, if any
+func identityOf(ctx context.Context) (Identity, bool) {
+	auth, ok := ctx.Value(authenticationKey{}).(authentication)
+	return auth.identity, ok && auth.err == nil
+}
+
+// authorize tells whether the caller has the role. The callers from within, e.g. the timers, have all roles
+func authorize(ctx context.Context, role Role) error {
+	auth, ok := ctx.Value(authenticationKey{}).(authentication)
+	switch {
+	case !ok:
+		return nil
+	case auth.err != nil:
+		return fmt.Errorf("%w: %v", errUnauthorized, auth.err)
+	case auth.identity.Role.includes(role):
+		return nil
+	case auth.identity.Method == "anonymous":
+		return fmt.Errorf("%w: %s role required", errUnauthorized, role)
+	default:
+		return fmt.Errorf("%w: %s role required", errForbidden, role)
+	}
+}
+
+// authenticate identifies the caller of each request, leaving the decision to the routes
+func (s *Server) authenticate(c *gin.Context) {
+	identity, err := s.authenticators.Load().authenticate(c.Request)
+	c.Request = c.Request.WithContext(withAuthentication(c.Request.Context(), authentication{identity, err}))
+	c.Next()
+}
+
+// requireRole only lets the callers with the role through
+func (s *Server) requireRole(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := authorize(c.Request.Context(), role); err != nil {
+			s.abortUnauthorized(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *Server) abortUnauthorized(c *gin.Context, err error) {
+	status := http.StatusForbidden
+	if errors.Is(err, errUnauthorized) {
+		status = http.StatusUnauthorized
+		s.challenge(c)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"reason": err.Error()})
+}
+
+// challenge tells the client the accepted credentials
+func (s *Server) challenge(c *gin.Context) {
+	for _, challenge := range s.authenticators.Load().challenges {
+		c.Writer.Header().Add("WWW-Authenticate", challenge)
+	}
+}
@@ -1,11 +1,13 @@
 package mermaidlive
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cskr/pubsub/v2"
@@ -15,19 +17,31 @@ import (
 
 const peerUpdateDelay = 5 * time.Second
 
+// an internal event that the counters have taken in all the events published before it
+const countersFlushedEvent = "CountersFlushed"
+
 var firstPeerCountUpdated = false
 
 type Cluster struct {
 	events      *pubsub.PubSub[string, Event]
+	peersLock   sync.Mutex
 	peers       []string
 	cluster     zmqcluster.Cluster
 	counter     *percounter.ZmqMultiGcounter
 	peerLocator PeerLocator
-}
-
-func NewCluster(events *pubsub.PubSub[string, Event], clusterEventObserver *PersistentClusterObserver, cluster zmqcluster.Cluster) *Cluster {
-	counterDirectory := GetCounterDirectory()
-	log.Println("Counter directory:", counterDirectory)
+	zmqPort     string
+	// readiness
+	countersLoaded atomic.Bool
+	peersAnswered  atomic.Bool
+}
+
+func NewCluster(events *pubsub.PubSub[string, Event],
+	clusterEventObserver *PersistentClusterObserver,
+	cluster zmqcluster.Cluster,
+	peerLocator PeerLocator,
+	config Config) *Cluster {
+	counterDirectory := config.CounterDirectory
+	slog.Info("counter directory", "path", counterDirectory)
 	identity := GetCounterIdentity()
 	counterListener := NewCounterListener(events)
 	counter := percounter.NewObservableZmqMultiGcounterInCluster(
@@ -38,44 +52,66 @@ func NewCluster(events *pubsub.PubSub[string, Event], clusterEventObserver *Pers
 	)
 	counter.ShouldPersistOnSignal()
 	counter.SetClusterObserver(clusterEventObserver)
-	if err := counter.LoadAllSync(); err != nil {
-		log.Printf("failed to load all counters, continuing nonetheless: %v", err)
-	}
-
-	return &Cluster{
-		peerLocator: ChoosePeerLocator(),
+	c := &Cluster{
+		peerLocator: peerLocator,
+		zmqPort:     config.ZmqPort,
 		events:      events,
 		peers:       []string{},
 		cluster:     cluster,
 		counter:     counter,
 	}
+	c.loadCounters(counter.LoadAllSync)
+	return c
+}
+
+// loadCounters reads the persisted gcounters. Should they fail to load, the replica keeps serving but is not ready
+func (ps *Cluster) loadCounters(load func() error) {
+	if err := load(); err != nil {
+		slog.Error("failed to load all counters, the replica is not ready", "error", err)
+		return
+	}
+	ps.countersLoaded.Store(true)
+}
+
+// Peers can be read while the peers are being polled
+func (ps *Cluster) Peers() []string {
+	ps.peersLock.Lock()
+	defer ps.peersLock.Unlock()
+	return slices.Clone(ps.peers)
+}
+
+// CountersLoaded tells if the persisted gcounters have been read
+func (ps *Cluster) CountersLoaded() bool {
+	return ps.countersLoaded.Load()
+}
+
+// PeersAnswered tells if the peer locator has answered at least once
+func (ps *Cluster) PeersAnswered() bool {
+	return ps.peersAnswered.Load()
+}
+
+// CounterValue is the cluster-wide value of the gcounter
+func (ps *Cluster) CounterValue(name string) int64 {
+	return int64(ps.counter.Value(name))
 }
 
 func GetCounterIdentity() string {
 	return getPrivateReplicaId()
 }
 
-func getFlyZmqBindAddr() string {
-	zmqPort := getFlyZmqPort()
+func zmqBindAddr(zmqPort string) string {
 	return fmt.Sprintf("tcp://:%s", zmqPort)
 }
 
-func getFlyZmqPort() string {
-	if port, ok := os.LookupEnv("ZMQ_PORT"); ok {
-		return port
-	}
-	return "5000"
-}
-
 func (ps *Cluster) Start() {
 	go ps.listenToInternalEventsForever()
 
 	if ps.peerLocator == nil {
-		log.Println("not polling for peers")
+		slog.Info("not polling for peers")
 		return
 	}
 
-	log.Printf("Starting to poll for peers")
+	slog.Info("starting to poll for peers")
 
 	go ps.pollForever()
 }
@@ -101,10 +137,26 @@ func (ps *Cluster) listenToInternalEventsForever() {
 			sendInitialClusterConnectionCount(ps.events, ps.counter)
 		case VisitorLeftEvent:
 			ps.counter.Increment(ClosedConnectionsCounter)
+		case countersFlushedEvent:
+			close(event.Properties["done"].(chan struct{}))
 		}
 	}
 }
 
+// FlushSync waits for the counters to have been incremented for all the visitors that have come and gone so far,
+// so that persisting them leaves none out
+func (ps *Cluster) FlushSync(ctx context.Context) error {
+	done := make(chan struct{})
+	// ordered after the visitor events, as the internal events are taken in one after another
+	ps.events.Pub(NewEventWithProperties(countersFlushedEvent, map[string]any{"done": done}), InternalTopic)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
 func (ps *Cluster) getPeers() {
 	if ps.peerLocator == nil {
 		return
@@ -112,17 +164,21 @@ func (ps *Cluster) getPeers() {
 
 	peers, replicaCount, err := ps.peerLocator.GetPeers()
 	if err != nil {
-		log.Printf("Error getting peers: %v", err)
+		slog.Error("could not get the peers", "error", err)
 		// something might be off, better disconnect from everyone at this point
 		peers = []string{}
+	} else {
+		ps.peersAnswered.Store(true)
 	}
 
 	slices.Sort(peers)
 
 	if !slices.Equal(peers, ps.peers) || (len(ps.peers) == 0 && len(peers) != 0) {
-		log.Printf("Peers changed %v -> %v", ps.peers, peers)
+		slog.Info("peers changed", "from", ps.peers, "to", peers)
+		ps.peersLock.Lock()
 		ps.peers = peers
-		ps.counter.UpdatePeers(zmqPeers(peers))
+		ps.peersLock.Unlock()
+		ps.counter.UpdatePeers(zmqPeers(peers, ps.zmqPort))
 		ps.events.Pub(GetReplicasEvent(replicaCount), Topic, ClusterMessageTopic)
 	} else if !firstPeerCountUpdated {
 		ps.events.Pub(GetReplicasEvent(replicaCount), Topic, ClusterMessageTopic)
@@ -130,34 +186,30 @@ func (ps *Cluster) getPeers() {
 	}
 }
 
-func zmqAddressOf(peer string) string {
-	return fmt.Sprintf("tcp://[%s]:%s", peer, getFlyZmqPort())
+func zmqAddressOf(peer, zmqPort string) string {
+	return fmt.Sprintf("tcp://[%s]:%s", peer, zmqPort)
 }
 
-func zmqPeers(peers []string) []string {
+func zmqPeers(peers []string, zmqPort string) []string {
 	res := []string{}
 	for _, peer := range peers {
-		res = append(res, zmqAddressOf(peer))
+		res = append(res, zmqAddressOf(peer, zmqPort))
 	}
 	return res
 }
 
-func ChoosePeerLocator() PeerLocator {
+// ChoosePeerLocator prefers the Fly.io private network, then Traefik if its services url is configured
+func ChoosePeerLocator(traefikServicesUrl string) PeerLocator {
 	flyDiscoveryDomainName := strings.TrimSpace(getFlyPeersDomain())
 	if flyDiscoveryDomainName != "" {
 		return NewFlyPeerLocator(flyDiscoveryDomainName)
 	}
-	traefikServicesUrl := getTraefikServicesUrl()
 	if traefikServicesUrl != "" {
 		return NewTraefikPeerLocator(traefikServicesUrl)
 	}
 	return &nullPeerLocator{}
 }
 
-func getTraefikServicesUrl() string {
-	return os.Getenv("TRAEFIK_SERVICES_URL")
-}
-
 func sendInitialClusterConnectionCount(
 	events *pubsub.PubSub[string, Event],
 	counter *percounter.ZmqMultiGcounter,
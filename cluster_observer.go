@@ -2,7 +2,7 @@ package mermaidlive
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 
 	"github.com/Arceliar/phony"
 	"github.com/cskr/pubsub/v2"
@@ -38,6 +38,7 @@ func NewPersistentClusterObserver(identity string, myIP string, events *pubsub.P
 }
 
 func (o *PersistentClusterObserver) AfterMessageSent(peer string, msg []byte) {
+	zmqMessagesSentTotal.Inc()
 	o.Act(o, func() {
 		msgString := string(msg)
 		o.messagesUpToNow = append(o.messagesUpToNow,
@@ -49,11 +50,12 @@ func (o *PersistentClusterObserver) AfterMessageSent(peer string, msg []byte) {
 				peer = peerIdentity
 			}
 		}
-		log.Printf("Message sent to %s: %s", peer, msgString)
+		slog.Debug("message sent", "peer", peer, "message", msgString)
 	})
 }
 
 func (o *PersistentClusterObserver) AfterMessageReceived(peer string, msg []byte) {
+	zmqMessagesReceivedTotal.Inc()
 	o.Act(o, func() {
 		var counterMessage percounter.NetworkedGCounterState
 		err := json.Unmarshal(msg, &counterMessage)
@@ -61,13 +63,13 @@ func (o *PersistentClusterObserver) AfterMessageReceived(peer string, msg []byte
 			peer = counterMessage.SourcePeer
 			o.trackCounterIdentitySync(&counterMessage)
 		} else {
-			log.Println("error parsing gcounter network message", err)
+			slog.Warn("could not parse the gcounter network message", "peer", peer, "error", err)
 		}
 		msgString := string(msg)
 		o.messagesUpToNow = append(o.messagesUpToNow,
 			&messageEvent{SeenAt: o.identity, Src: peer, Dst: o.identity, Msg: msgString},
 		)
-		log.Printf("Message received from %s: %s", peer, msgString)
+		slog.Debug("message received", "peer", peer, "message", msgString)
 	})
 }
 
@@ -89,7 +91,7 @@ func (o *PersistentClusterObserver) processEventsSync() {
 	if len(o.messagesUpToNow) > 0 &&
 		(!o.anyUnkownPeersSync() ||
 			o.countUnkownPeersSync() >= maxEventsWithUnknownPeersBeforePublishingAllEvents) {
-		log.Println("publishing cluster messages")
+		slog.Debug("publishing cluster messages")
 		o.publishPendingEventsSync()
 	}
 }
@@ -0,0 +1,104 @@
+package mermaidlive
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/d-led/zmqcluster"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the key of the trace context added to the JSON cluster messages,
+// which the gcounters of older replicas ignore
+const traceContextKey = "trace_context"
+
+// tracedCluster propagates the trace context in the cluster messages,
+// continuing the trace of the sender on the receiving replica
+type tracedCluster struct {
+	zmqcluster.Cluster
+}
+
+func newTracedCluster(cluster zmqcluster.Cluster) zmqcluster.Cluster {
+	return &tracedCluster{cluster}
+}
+
+func (t *tracedCluster) SendMessageToPeer(peer string, message []byte) {
+	ctx, span := tracer.Start(context.Background(), "cluster send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("peer", peer)),
+	)
+	defer span.End()
+	t.Cluster.SendMessageToPeer(peer, withTraceContext(ctx, message))
+}
+
+func (t *tracedCluster) BroadcastMessage(message []byte) {
+	ctx, span := tracer.Start(context.Background(), "cluster broadcast",
+		trace.WithSpanKind(trace.SpanKindProducer),
+	)
+	defer span.End()
+	t.Cluster.BroadcastMessage(withTraceContext(ctx, message))
+}
+
+func (t *tracedCluster) AddListenerSync(listener zmqcluster.ClusterListener) {
+	t.Cluster.AddListenerSync(&tracedClusterListener{listener, t})
+}
+
+func (t *tracedCluster) AddListener(listener zmqcluster.ClusterListener) {
+	t.Cluster.AddListener(&tracedClusterListener{listener, t})
+}
+
+type tracedClusterListener struct {
+	zmqcluster.ClusterListener
+	cluster *tracedCluster
+}
+
+func (l *tracedClusterListener) OnMessage(identity []byte, message []byte) {
+	ctx := traceContextOf(message)
+	_, span := tracer.Start(ctx, "cluster receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("peer", string(identity))),
+	)
+	defer span.End()
+	l.ClusterListener.OnMessage(identity, message)
+}
+
+func (l *tracedClusterListener) OnNewPeerConnected(_ zmqcluster.Cluster, peer string) {
+	// the listener keeps sending through the tracing cluster
+	l.ClusterListener.OnNewPeerConnected(l.cluster, peer)
+}
+
+// withTraceContext adds the trace context to a JSON object message, and leaves any other message as it is
+func withTraceContext(ctx context.Context, message []byte) []byte {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return message
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return message
+	}
+	traceContext, err := json.Marshal(carrier)
+	if err != nil {
+		return message
+	}
+	fields[traceContextKey] = traceContext
+	res, err := json.Marshal(fields)
+	if err != nil {
+		return message
+	}
+	return res
+}
+
+func traceContextOf(message []byte) context.Context {
+	var envelope struct {
+		TraceContext propagation.MapCarrier `json:"trace_context"`
+	}
+	if err := json.Unmarshal(message, &envelope); err != nil || envelope.TraceContext == nil {
+		return context.Background()
+	}
+	return otel.GetTextMapPropagator().Extract(context.Background(), envelope.TraceContext)
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/carlmjohnson/versioninfo"
@@ -14,25 +17,39 @@ import (
 )
 
 var transpileOnly *bool
-var port *string
-var countdownDelayString *string
+var issueToken *string
+var configFlags *mermaidlive.ConfigFlags
 
-// limits the amount of connected clients
+// buffers the events between the publishers and each subscriber's own bounded queue
 const pubSubChannelCapacity = 1024
-const defaultCountdownDelay = 800 * time.Millisecond
+
+const tokenTtl = 24 * time.Hour
 
 func main() {
 	flag.Parse()
 
-	runMigrationsSync()
+	config, err := mermaidlive.LoadConfig(configFlags)
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	mermaidlive.ConfigureLogging(config)
+	slog.Info("configuration", "config", config)
+
+	if *issueToken != "" {
+		printToken(config, *issueToken)
+		return
+	}
+
+	runMigrationsSync(config)
 
 	if *transpileOnly {
 		mermaidlive.Refresh()
-		log.Println("exiting")
+		slog.Info("exiting")
 		return
 	}
 
-	eventPublisher := pubsub.New[string, mermaidlive.Event](pubSubChannelCapacity /* to do: unbounded mailbox*/)
+	eventPublisher := pubsub.New[string, mermaidlive.Event](pubSubChannelCapacity)
 
 	if !mermaidlive.DoEmbed {
 		mermaidlive.Refresh()
@@ -41,57 +58,80 @@ func main() {
 	}
 
 	if !versioninfo.DirtyBuild {
-		log.Println("Revision:", versioninfo.Revision)
+		slog.Info("revision", "revision", versioninfo.Revision)
 	}
 
-	countdownDelay := getCountdownDelay()
+	shutdownTracing := mermaidlive.ConfigureTracing(context.Background(), config)
 
 	server := mermaidlive.NewServerWithOptions(
-		*port,
+		config,
 		eventPublisher,
 		mermaidlive.GetFS(),
-		countdownDelay,
+		getMachineDefinition(config.MachineDefinitionFile),
 	)
-	go server.Run(*port)
+	configWatcher, err := server.WatchConfig(configFlags)
+	if err != nil {
+		slog.Error("could not watch the config file", "error", err)
+	}
+	if configWatcher != nil {
+		defer configWatcher.Close()
+	}
+	go server.Run()
 	server.WaitToDrainConnections()
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Warn("could not flush the spans", "error", err)
+	}
 	percounter.GlobalEmergencyPersistence().Init()
 	percounter.GlobalEmergencyPersistence().PersistAndExitOnSignal()
 }
 
 func init() {
 	transpileOnly = flag.Bool("transpile", false, "transpile only and exit")
-	port = flag.String("port", "8080", "port to run on")
-	if portFromEnv, ok := os.LookupEnv("PORT"); ok {
-		log.Println("Overriding the PORT via the environment variable")
-		*port = portFromEnv
+	issueToken = flag.String("issue-token", "", "print a token signed with the auth HMAC secret, valid for a day, for role:subject, and exit")
+	configFlags = mermaidlive.NewConfigFlags(flag.CommandLine)
+}
+
+func printToken(config mermaidlive.Config, roleAndSubject string) {
+	role, subject, _ := strings.Cut(roleAndSubject, ":")
+	if config.AuthHmacSecret == "" {
+		slog.Error("no auth HMAC secret configured")
+		os.Exit(1)
+	}
+	token, err := mermaidlive.IssueToken([]byte(config.AuthHmacSecret), subject, mermaidlive.Role(role), tokenTtl)
+	if err != nil {
+		slog.Error("could not issue the token", "error", err)
+		os.Exit(1)
 	}
-	countdownDelayString = flag.String("delay", "800ms", "countdown delay")
+	fmt.Println(token)
 }
 
-func getCountdownDelay() time.Duration {
-	d, err := time.ParseDuration(*countdownDelayString)
+func getMachineDefinition(machineDefinitionFile string) *mermaidlive.MachineDefinition {
+	if machineDefinitionFile == "" {
+		return mermaidlive.DefaultMachineDefinition()
+	}
+	definition, err := mermaidlive.LoadMachineDefinition(machineDefinitionFile)
 	if err != nil {
-		log.Printf("provided countdown delay ignored: '%s', using default: '%v'", *countdownDelayString, defaultCountdownDelay)
-		return defaultCountdownDelay
+		slog.Error("could not load the machine definition", "file", machineDefinitionFile, "error", err)
+		os.Exit(1)
 	}
-	log.Printf("countdown delay: %v", d)
-	return d
+	slog.Info("machine definition", "name", definition.Name, "file", machineDefinitionFile)
+	return definition
 }
 
-func runMigrationsSync() {
-	zeroActiveConnectionCount()
+func runMigrationsSync(config mermaidlive.Config) {
+	zeroActiveConnectionCount(config.CounterDirectory)
 }
 
-func zeroActiveConnectionCount() {
-	deleteFile(path.Join(mermaidlive.GetCounterDirectory(),
+func zeroActiveConnectionCount(counterDirectory string) {
+	deleteFile(path.Join(counterDirectory,
 		mermaidlive.StartedConnectionsCounter+".gcounter"))
-	deleteFile(path.Join(mermaidlive.GetCounterDirectory(),
+	deleteFile(path.Join(counterDirectory,
 		mermaidlive.ClosedConnectionsCounter+".gcounter"))
 }
 
 func deleteFile(fn string) {
-	log.Println("removing ", fn, " ... ")
-	if err := os.Remove(fn); err != nil {
-		log.Println(err)
+	slog.Info("removing", "file", fn)
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		slog.Warn("could not remove", "file", fn, "error", err)
 	}
 }
@@ -8,6 +8,7 @@ import (
 )
 
 const Topic = "events"
+const DefaultMachineId = "default"
 const InternalTopic = "internal-events"
 const ClusterMessageTopic = "cluster-events"
 const NewConnectionsCounter = "newconnections"
@@ -19,7 +20,13 @@ const VisitorsActiveEvent = "VisitorsActive"
 const ClusterMessageEvent = "ClusterMessage"
 const TotalVisitorsEvent = "TotalVisitors"
 const TotalClusterVisitorsActiveEvent = "TotalClusterVisitorsActive"
+const MachineDiagramEvent = "MachineDiagram"
+const MachineDeletedEvent = "MachineDeleted"
+const ServerShuttingDownEvent = "ServerShuttingDown"
+const ConfigReloadedEvent = "ConfigReloaded"
+const ScheduledCommandFiredEvent = "ScheduledCommandFired"
 const SourceReplicaIdKey = "Source-Replica-Id"
+const CommandIdKey = "Command-Id"
 
 type PeerLocator interface {
 	GetPeers() ([]string, int, error)
@@ -27,7 +34,6 @@ type PeerLocator interface {
 }
 
 var DoEmbed = false
-var ClusterObservabilityEnabled = false
 
 func crashOnError(err error) {
 	if err != nil {
@@ -0,0 +1,481 @@
+package mermaidlive
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/ulule/limiter/v3"
+)
+
+// Config is the configuration of a replica. Each setting is taken from, in increasing order of precedence:
+//  1. the defaults, see DefaultConfig
+//  2. the YAML or JSON config file given by -config or MML_CONFIG
+//  3. the environment variable of the setting
+//  4. the command line flag of the setting, if any
+//
+// The FLY_* variables describe the platform the replica runs on rather than configure it, and are read where needed
+type Config struct {
+	Port                        string         `json:"port"`
+	TLSCertFile                 string         `json:"tls_cert_file"`
+	TLSKeyFile                  string         `json:"tls_key_file"`
+	TLSSelfSigned               bool           `json:"tls_self_signed"`
+	CountdownDelay              time.Duration  `json:"countdown_delay"`
+	RunMaxTicks                 int            `json:"run_max_ticks"`
+	RunMinDelay                 time.Duration  `json:"run_min_delay"`
+	RunMaxDelay                 time.Duration  `json:"run_max_delay"`
+	WorkQueueDepth              int            `json:"work_queue_depth"`
+	MachineDefinitionFile       string         `json:"machine_definition"`
+	RateLimit                   string         `json:"rate_limit"`
+	CommandRateLimit            string         `json:"command_rate_limit"`
+	StreamRateLimit             string         `json:"stream_rate_limit"`
+	ClusterRateLimit            string         `json:"cluster_rate_limit"`
+	CounterDirectory            string         `json:"counter_directory"`
+	ZmqPort                     string         `json:"zmq_port"`
+	TraefikServicesUrl          string         `json:"traefik_services_url"`
+	ClusterObservabilityEnabled bool           `json:"cluster_observability_enabled"`
+	MachineRecovery             RecoveryPolicy `json:"machine_recovery"`
+	SubscriberQueueDepth        int            `json:"subscriber_queue_depth"`
+	SubscriberOverflow          OverflowPolicy `json:"subscriber_overflow"`
+	DrainTimeout                time.Duration  `json:"drain_timeout"`
+	LogLevel                    string         `json:"log_level"`
+	LogFormat                   string         `json:"log_format"`
+	TracesExporter              string         `json:"traces_exporter"`
+	AuthTokens                  []AuthToken    `json:"auth_tokens"`
+	AuthHmacSecret              string         `json:"auth_hmac_secret"`
+	AuthUsers                   []AuthUser     `json:"auth_users"`
+	AuthAnonymousRole           Role           `json:"auth_anonymous_role"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:                 "8080",
+		CountdownDelay:       800 * time.Millisecond,
+		RunMaxTicks:          100,
+		RunMinDelay:          50 * time.Millisecond,
+		RunMaxDelay:          10 * time.Second,
+		CounterDirectory:     ".",
+		ZmqPort:              "5000",
+		MachineRecovery:      RecoverByResuming,
+		SubscriberQueueDepth: 256,
+		SubscriberOverflow:   CoalesceTicks,
+		DrainTimeout:         5 * time.Second,
+		LogLevel:             "info",
+		LogFormat:            "text",
+		TracesExporter:       "none",
+		AuthAnonymousRole:    RoleViewer,
+	}
+}
+
+func (c Config) runBounds() *RunBounds {
+	return &RunBounds{MaxTicks: c.RunMaxTicks, MinDelay: c.RunMinDelay, MaxDelay: c.RunMaxDelay}
+}
+
+func (c Config) tlsEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSSelfSigned
+}
+
+// configSetting binds a setting to its environment variable and, optionally, its command line flag
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{env: "PORT", flag: "port", usage: "port to run on", set: func(c *Config, v string) error {
+		c.Port = v
+		return nil
+	}},
+	{env: "TLS_CERT_FILE", set: func(c *Config, v string) error {
+		c.TLSCertFile = v
+		return nil
+	}},
+	{env: "TLS_KEY_FILE", set: func(c *Config, v string) error {
+		c.TLSKeyFile = v
+		return nil
+	}},
+	{env: "TLS_SELF_SIGNED", set: func(c *Config, v string) error {
+		return parseBool(v, &c.TLSSelfSigned)
+	}},
+	{env: "COUNTDOWN_DELAY", flag: "delay", usage: "countdown delay", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.CountdownDelay)
+	}},
+	{env: "RUN_MAX_TICKS", set: func(c *Config, v string) error {
+		return parseInt(v, &c.RunMaxTicks)
+	}},
+	{env: "RUN_MIN_DELAY", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.RunMinDelay)
+	}},
+	{env: "RUN_MAX_DELAY", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.RunMaxDelay)
+	}},
+	{env: "WORK_QUEUE_DEPTH", set: func(c *Config, v string) error {
+		return parseInt(v, &c.WorkQueueDepth)
+	}},
+	{env: "MACHINE_DEFINITION", flag: "machine", usage: "YAML or JSON state machine definition (default: built-in countdown)", set: func(c *Config, v string) error {
+		c.MachineDefinitionFile = v
+		return nil
+	}},
+	{env: "RATE_LIMIT", set: func(c *Config, v string) error {
+		c.RateLimit = strings.TrimSpace(v)
+		return nil
+	}},
+	{env: "COMMAND_RATE_LIMIT", set: func(c *Config, v string) error {
+		c.CommandRateLimit = strings.TrimSpace(v)
+		return nil
+	}},
+	{env: "STREAM_RATE_LIMIT", set: func(c *Config, v string) error {
+		c.StreamRateLimit = strings.TrimSpace(v)
+		return nil
+	}},
+	{env: "CLUSTER_RATE_LIMIT", set: func(c *Config, v string) error {
+		c.ClusterRateLimit = strings.TrimSpace(v)
+		return nil
+	}},
+	{env: "COUNTER_DIRECTORY", set: func(c *Config, v string) error {
+		c.CounterDirectory = v
+		return nil
+	}},
+	{env: "ZMQ_PORT", set: func(c *Config, v string) error {
+		c.ZmqPort = v
+		return nil
+	}},
+	{env: "TRAEFIK_SERVICES_URL", set: func(c *Config, v string) error {
+		c.TraefikServicesUrl = v
+		return nil
+	}},
+	{env: "MML_CLUSTER_OBSERVABILITY_ENABLED", set: func(c *Config, v string) error {
+		return parseBool(v, &c.ClusterObservabilityEnabled)
+	}},
+	{env: "MACHINE_RECOVERY", set: func(c *Config, v string) error {
+		c.MachineRecovery = RecoveryPolicy(v)
+		return nil
+	}},
+	{env: "SUBSCRIBER_QUEUE_DEPTH", set: func(c *Config, v string) error {
+		return parseInt(v, &c.SubscriberQueueDepth)
+	}},
+	{env: "SUBSCRIBER_OVERFLOW", set: func(c *Config, v string) error {
+		c.SubscriberOverflow = OverflowPolicy(v)
+		return nil
+	}},
+	{env: "DRAIN_TIMEOUT", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.DrainTimeout)
+	}},
+	{env: "LOG_LEVEL", set: func(c *Config, v string) error {
+		c.LogLevel = strings.ToLower(v)
+		return nil
+	}},
+	{env: "LOG_FORMAT", set: func(c *Config, v string) error {
+		c.LogFormat = strings.ToLower(v)
+		return nil
+	}},
+	{env: "OTEL_TRACES_EXPORTER", set: func(c *Config, v string) error {
+		c.TracesExporter = strings.ToLower(v)
+		return nil
+	}},
+	// role:token,...
+	{env: "AUTH_TOKENS", set: func(c *Config, v string) error {
+		c.AuthTokens = []AuthToken{}
+		for _, entry := range splitList(v) {
+			role, token, ok := strings.Cut(entry, ":")
+			if !ok {
+				return errors.New("expected role:token")
+			}
+			c.AuthTokens = append(c.AuthTokens, AuthToken{Role: Role(role), Token: token})
+		}
+		return nil
+	}},
+	{env: "AUTH_HMAC_SECRET", set: func(c *Config, v string) error {
+		c.AuthHmacSecret = v
+		return nil
+	}},
+	// role:name:password,...
+	{env: "AUTH_USERS", set: func(c *Config, v string) error {
+		c.AuthUsers = []AuthUser{}
+		for _, entry := range splitList(v) {
+			fields := strings.SplitN(entry, ":", 3)
+			if len(fields) != 3 {
+				return errors.New("expected role:name:password")
+			}
+			c.AuthUsers = append(c.AuthUsers, AuthUser{Role: Role(fields[0]), Name: fields[1], Password: fields[2]})
+		}
+		return nil
+	}},
+	{env: "AUTH_ANONYMOUS_ROLE", set: func(c *Config, v string) error {
+		c.AuthAnonymousRole = Role(strings.ToLower(v))
+		return nil
+	}},
+}
+
+// ConfigFlags are the command line flags of the settings
+type ConfigFlags struct {
+	flags  *flag.FlagSet
+	file   *string
+	values map[string]*string
+}
+
+// NewConfigFlags defines the flags on the flag set, which is then to be parsed before loading the config
+func NewConfigFlags(flags *flag.FlagSet) *ConfigFlags {
+	res := &ConfigFlags{
+		flags:  flags,
+		file:   flags.String("config", "", "YAML or JSON config file (default: MML_CONFIG)"),
+		values: map[string]*string{},
+	}
+	defaults := DefaultConfig()
+	for _, setting := range configSettings {
+		if setting.flag == "" {
+			continue
+		}
+		res.values[setting.flag] = flags.String(setting.flag, defaults.flagDefault(setting.flag), setting.usage+" ("+setting.env+")")
+	}
+	return res
+}
+
+// set lists the values of the flags given on the command line
+func (f *ConfigFlags) set() map[string]string {
+	res := map[string]string{}
+	if f == nil {
+		return res
+	}
+	f.flags.Visit(func(fl *flag.Flag) {
+		if value, ok := f.values[fl.Name]; ok {
+			res[fl.Name] = *value
+		}
+	})
+	return res
+}
+
+func (f *ConfigFlags) configFile() string {
+	if f != nil && *f.file != "" {
+		return *f.file
+	}
+	return os.Getenv("MML_CONFIG")
+}
+
+func (c Config) flagDefault(name string) string {
+	switch name {
+	case "port":
+		return c.Port
+	case "delay":
+		return c.CountdownDelay.String()
+	default:
+		return ""
+	}
+}
+
+// LoadConfig layers the config file, the environment and the flags over the defaults, and validates the result.
+// The flags may be nil
+func LoadConfig(flags *ConfigFlags) (Config, error) {
+	config := DefaultConfig()
+	if file := flags.configFile(); file != "" {
+		if err := config.loadFile(file); err != nil {
+			return config, err
+		}
+	}
+	problems := []error{}
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(setting.env); ok {
+			if err := setting.set(&config, value); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", setting.env, err))
+			}
+		}
+	}
+	given := flags.set()
+	for _, setting := range configSettings {
+		if value, ok := given[setting.flag]; ok {
+			if err := setting.set(&config, value); err != nil {
+				problems = append(problems, fmt.Errorf("-%s: %w", setting.flag, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return config, errors.Join(problems...)
+	}
+	return config, config.Validate()
+}
+
+func (c *Config) loadFile(filename string) error {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	// JSON is a subset of YAML, and unknown keys are most likely typos
+	if err := yaml.UnmarshalWithOptions(text, c, yaml.Strict()); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// Validate reports all the invalid settings at once
+func (c Config) Validate() error {
+	problems := []error{}
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+	check(isPort(c.Port), "port: not a port number: '%s'", c.Port)
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "tls_cert_file, tls_key_file: expected both or neither")
+	check(!c.TLSSelfSigned || c.TLSCertFile == "", "tls_self_signed: not along with tls_cert_file")
+	check(isPort(c.ZmqPort), "zmq_port: not a port number: '%s'", c.ZmqPort)
+	check(c.CountdownDelay > 0, "countdown_delay: must be positive: %v", c.CountdownDelay)
+	// the count of a machine is a byte
+	check(c.RunMaxTicks >= 1 && c.RunMaxTicks <= 255, "run_max_ticks: expected 1 to 255: %d", c.RunMaxTicks)
+	check(c.RunMinDelay > 0 && c.RunMinDelay <= c.RunMaxDelay,
+		"run_min_delay, run_max_delay: expected 0 < %v <= %v", c.RunMinDelay, c.RunMaxDelay)
+	check(c.WorkQueueDepth >= 0 && c.WorkQueueDepth <= maxWorkQueueDepth,
+		"work_queue_depth: expected 0 to %d: %d", maxWorkQueueDepth, c.WorkQueueDepth)
+	for _, limit := range []struct{ key, spec string }{
+		{"rate_limit", c.RateLimit},
+		{"command_rate_limit", c.CommandRateLimit},
+		{"stream_rate_limit", c.StreamRateLimit},
+		{"cluster_rate_limit", c.ClusterRateLimit},
+	} {
+		if limit.spec != "" {
+			_, err := limiter.NewRateFromFormatted(limit.spec)
+			check(err == nil, "%s: %v", limit.key, err)
+		}
+	}
+	check(c.CounterDirectory != "", "counter_directory: must not be empty")
+	if c.TraefikServicesUrl != "" {
+		u, err := url.Parse(c.TraefikServicesUrl)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https"), "traefik_services_url: not an http(s) url")
+	}
+	check(c.MachineRecovery == RecoverByResuming || c.MachineRecovery == RecoverByAborting,
+		"machine_recovery: expected %s or %s: '%s'", RecoverByResuming, RecoverByAborting, c.MachineRecovery)
+	check(c.SubscriberQueueDepth >= 1, "subscriber_queue_depth: must be at least 1: %d", c.SubscriberQueueDepth)
+	check(c.SubscriberOverflow == DropOldest || c.SubscriberOverflow == DropAndDisconnect || c.SubscriberOverflow == CoalesceTicks,
+		"subscriber_overflow: expected %s, %s or %s: '%s'", DropOldest, DropAndDisconnect, CoalesceTicks, c.SubscriberOverflow)
+	check(c.DrainTimeout > 0, "drain_timeout: must be positive: %v", c.DrainTimeout)
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log_level: expected debug, info, warn or error: '%s'", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format: expected text or json: '%s'", c.LogFormat)
+	switch c.TracesExporter {
+	case "none", "otlp", "console", "stdout":
+	default:
+		check(false, "traces_exporter: expected none, otlp, console or stdout: '%s'", c.TracesExporter)
+	}
+	for i, token := range c.AuthTokens {
+		check(token.Role.valid(), "auth_tokens[%d]: %v", i, errBadRole(token.Role))
+		check(token.Token != "", "auth_tokens[%d]: the token must not be empty", i)
+	}
+	check(c.AuthHmacSecret == "" || len(c.AuthHmacSecret) >= minHmacSecretLength,
+		"auth_hmac_secret: must be at least %d characters long", minHmacSecretLength)
+	for i, user := range c.AuthUsers {
+		check(user.Role.valid(), "auth_users[%d]: %v", i, errBadRole(user.Role))
+		check(user.Name != "" && user.Password != "", "auth_users[%d]: the name and password must not be empty", i)
+	}
+	check(c.AuthAnonymousRole == RoleNone || c.AuthAnonymousRole.valid(),
+		"auth_anonymous_role: %v", errBadRole(c.AuthAnonymousRole))
+	return errors.Join(problems...)
+}
+
+// LogValue prints the config on boot, without the credentials that might be part of the urls
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("port", c.Port),
+		slog.String("tls_cert_file", c.TLSCertFile),
+		slog.String("tls_key_file", c.TLSKeyFile),
+		slog.Bool("tls_self_signed", c.TLSSelfSigned),
+		slog.Duration("countdown_delay", c.CountdownDelay),
+		slog.Int("run_max_ticks", c.RunMaxTicks),
+		slog.Duration("run_min_delay", c.RunMinDelay),
+		slog.Duration("run_max_delay", c.RunMaxDelay),
+		slog.Int("work_queue_depth", c.WorkQueueDepth),
+		slog.String("machine_definition", c.MachineDefinitionFile),
+		slog.String("rate_limit", c.RateLimit),
+		slog.String("command_rate_limit", c.CommandRateLimit),
+		slog.String("stream_rate_limit", c.StreamRateLimit),
+		slog.String("cluster_rate_limit", c.ClusterRateLimit),
+		slog.String("counter_directory", c.CounterDirectory),
+		slog.String("zmq_port", c.ZmqPort),
+		slog.String("traefik_services_url", redactUrl(c.TraefikServicesUrl)),
+		slog.Bool("cluster_observability_enabled", c.ClusterObservabilityEnabled),
+		slog.String("machine_recovery", string(c.MachineRecovery)),
+		slog.Int("subscriber_queue_depth", c.SubscriberQueueDepth),
+		slog.String("subscriber_overflow", string(c.SubscriberOverflow)),
+		slog.Duration("drain_timeout", c.DrainTimeout),
+		slog.String("log_level", c.LogLevel),
+		slog.String("log_format", c.LogFormat),
+		slog.String("traces_exporter", c.TracesExporter),
+		slog.Int("auth_tokens", len(c.AuthTokens)),
+		slog.String("auth_hmac_secret", redactSecret(c.AuthHmacSecret)),
+		slog.Any("auth_users", userRoles(c.AuthUsers)),
+		slog.String("auth_anonymous_role", string(c.AuthAnonymousRole)),
+	)
+}
+
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
+// userRoles lists the users without their passwords
+func userRoles(users []AuthUser) []string {
+	res := []string{}
+	for _, user := range users {
+		res = append(res, user.Name+":"+string(user.Role))
+	}
+	return res
+}
+
+func redactUrl(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
+
+func splitList(value string) []string {
+	res := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+func isPort(value string) bool {
+	port, err := strconv.Atoi(value)
+	return err == nil && port > 0 && port < 65536
+}
+
+func parseDuration(value string, target *time.Duration) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*target = d
+	return nil
+}
+
+func parseInt(value string, target *int) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*target = i
+	return nil
+}
+
+func parseBool(value string, target *bool) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*target = b
+	return nil
+}
@@ -1,7 +1,7 @@
 package mermaidlive
 
 import (
-	"log"
+	"log/slog"
 
 	"github.com/Arceliar/phony"
 	"github.com/cskr/pubsub/v2"
@@ -25,11 +25,11 @@ func (n *CounterListener) OnNewCount(ev percounter.CountEvent) {
 	n.Act(n, func() {
 		switch ev.Name {
 		case NewConnectionsCounter:
-			log.Println("New visitor count:", ev.Count)
+			slog.Info("new visitor count", "count", ev.Count)
 			n.events.Pub(NewEventWithParam(TotalVisitorsEvent, ev.Count), Topic, ClusterMessageTopic)
 
 		case StartedConnectionsCounter:
-			log.Printf("started event: %v", ev)
+			slog.Debug("started connections counted", "count", ev.Count)
 			n.startedConnections = ev.Count
 			n.events.Pub(NewEventWithParam(
 				TotalClusterVisitorsActiveEvent,
@@ -38,7 +38,7 @@ func (n *CounterListener) OnNewCount(ev percounter.CountEvent) {
 			), Topic, ClusterMessageTopic)
 
 		case ClosedConnectionsCounter:
-			log.Printf("closed event: %v", ev)
+			slog.Debug("closed connections counted", "count", ev.Count)
 			n.closedConnections = ev.Count
 			n.events.Pub(NewEventWithParam(
 				TotalClusterVisitorsActiveEvent,
@@ -48,7 +48,7 @@ func (n *CounterListener) OnNewCount(ev percounter.CountEvent) {
 
 		default:
 			// ignore the event
-			// log.Printf("New counter event: %v", ev)
+			// slog.Debug("new counter event", "event", ev)
 		}
 	})
 }
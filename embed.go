@@ -5,13 +5,13 @@ package mermaidlive
 
 import (
 	"io"
-	"log"
+	"log/slog"
 
 	"github.com/cskr/pubsub/v2"
 )
 
 func init() {
-	log.Println("using embedded resources")
+	slog.Info("using embedded resources")
 	DoEmbed = true
 }
 
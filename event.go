@@ -1,23 +1,62 @@
 package mermaidlive
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
 
 type Event struct {
+	Id         uint64                 `json:"id,omitempty"`
 	Timestamp  string                 `json:"timestamp"`
 	Name       string                 `json:"name"`
 	Properties map[string]interface{} `json:"properties"`
+	// CommandId is the id of the command the event results from, if any
+	CommandId string `json:"command_id,omitempty"`
+	// Machine is the id of the machine that published the event, if any
+	Machine string `json:"machine,omitempty"`
+	// the span of the publication, continued by the delivery to each client
+	spanContext trace.SpanContext
+}
+
+// starting at the process start time in microseconds keeps the ids increasing across restarts
+var lastEventId atomic.Uint64
+
+func init() {
+	lastEventId.Store(uint64(time.Now().UnixMicro()))
 }
 
 func NewSimpleEvent(name string) Event {
-	return Event{now(), name, map[string]any{}}
+	return Event{Id: nextEventId(), Timestamp: now(), Name: name, Properties: map[string]any{}}
 }
 
 func NewEventWithReason(name, reason string) Event {
-	return Event{now(), name, map[string]any{"reason": reason}}
+	return Event{Id: nextEventId(), Timestamp: now(), Name: name, Properties: map[string]any{"reason": reason}}
 }
 
 func NewEventWithParam(name string, p any) Event {
-	return Event{now(), name, map[string]any{"param": p}}
+	return Event{Id: nextEventId(), Timestamp: now(), Name: name, Properties: map[string]any{"param": p}}
+}
+
+func NewEventWithProperties(name string, properties map[string]any) Event {
+	return Event{Id: nextEventId(), Timestamp: now(), Name: name, Properties: properties}
+}
+
+// WithCommandId marks the event as resulting from the command
+func (e Event) WithCommandId(commandId string) Event {
+	e.CommandId = commandId
+	return e
+}
+
+// OfMachine attributes the event to the machine
+func (e Event) OfMachine(machine string) Event {
+	e.Machine = machine
+	return e
+}
+
+func nextEventId() uint64 {
+	return lastEventId.Add(1)
 }
 
 func now() string {
@@ -0,0 +1,128 @@
+package mermaidlive
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventFilter selects the events a stream client is interested in. All given criteria must hold:
+//   - include=Tick,WorkDone: only these event names
+//   - exclude=VisitorsActive,TotalVisitors: anything but these event names
+//   - property=reason or property=param:3: the property is present, or has the value
+//   - exclude_property=...: the property is absent, or has another value
+//   - machine=room-1,room-2: events of these machines, and those not published by any machine
+//
+// Each parameter may be repeated or hold comma-separated values
+type EventFilter struct {
+	include            map[string]bool
+	exclude            map[string]bool
+	properties         []propertyMatch
+	excludedProperties []propertyMatch
+	Machines           []string
+}
+
+type propertyMatch struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+func ParseEventFilter(c *gin.Context) (EventFilter, error) {
+	f := EventFilter{
+		include: setOf(queryValues(c, "include")),
+		exclude: setOf(queryValues(c, "exclude")),
+	}
+	var err error
+	if f.properties, err = parsePropertyMatches(queryValues(c, "property")); err != nil {
+		return f, err
+	}
+	if f.excludedProperties, err = parsePropertyMatches(queryValues(c, "exclude_property")); err != nil {
+		return f, err
+	}
+	f.Machines = queryValues(c, "machine")
+	for _, id := range f.Machines {
+		if !machineIdPattern.MatchString(id) {
+			return f, fmt.Errorf("bad machine id: '%s'", id)
+		}
+	}
+	return f, nil
+}
+
+func (f EventFilter) Matches(event Event) bool {
+	if len(f.include) > 0 && !f.include[event.Name] {
+		return false
+	}
+	if f.exclude[event.Name] {
+		return false
+	}
+	if len(f.Machines) > 0 && event.Machine != "" && !slices.Contains(f.Machines, event.Machine) {
+		return false
+	}
+	for _, p := range f.properties {
+		if !p.matches(event) {
+			return false
+		}
+	}
+	for _, p := range f.excludedProperties {
+		if p.matches(event) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p propertyMatch) matches(event Event) bool {
+	value, ok := event.Properties[p.key]
+	if !ok {
+		return false
+	}
+	return p.anyValue || fmt.Sprint(value) == p.value
+}
+
+// filteredFormat drops the events not matching the filter before they are written
+type filteredFormat struct {
+	eventStreamFormat
+	filter EventFilter
+}
+
+func (f filteredFormat) write(c *gin.Context, event Event) {
+	if !f.filter.Matches(event) {
+		return
+	}
+	f.eventStreamFormat.write(c, event)
+}
+
+func parsePropertyMatches(values []string) ([]propertyMatch, error) {
+	res := []propertyMatch{}
+	for _, v := range values {
+		key, value, hasValue := strings.Cut(v, ":")
+		if key == "" {
+			return nil, fmt.Errorf("bad property filter: '%s', expected name or name:value", v)
+		}
+		res = append(res, propertyMatch{key: key, value: value, anyValue: !hasValue})
+	}
+	return res, nil
+}
+
+func queryValues(c *gin.Context, key string) []string {
+	res := []string{}
+	for _, values := range c.QueryArray(key) {
+		for _, v := range strings.Split(values, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				res = append(res, v)
+			}
+		}
+	}
+	return res
+}
+
+func setOf(values []string) map[string]bool {
+	res := map[string]bool{}
+	for _, v := range values {
+		res[v] = true
+	}
+	return res
+}
@@ -12,3 +12,14 @@ Feature: Aborting Work
         When the system "abort" is requested
         Then work is canceled
         And the system is found in state "waiting"
+
+    Scenario: Aborting an aborting machine is re-requested
+        Given a system with a delay of "200ms" in state "waiting"
+        When the system "start" is requested
+        And some work has progressed
+        And the system "abort" is requested
+        And the system "abort" is requested
+        Then the command is reported as "accepted"
+        And the system is found in state "aborting"
+        And work is canceled
+        And the system is found in state "waiting"
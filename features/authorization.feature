@@ -0,0 +1,71 @@
+@unit
+Feature: Authentication and authorization
+    Background:
+        Given the auth config
+            """
+            auth_tokens:
+              - role: viewer
+                token: viewer-token
+              - role: operator
+                token: operator-token
+            auth_hmac_secret: 0123456789abcdef0123456789abcdef
+            auth_users:
+              - name: alice
+                password: wonderland
+                role: admin
+            """
+
+    Scenario Outline: The callers are identified by their credentials
+        When a request carries the credentials "<credentials>"
+        Then the caller is identified as "<name>" in the role "<role>"
+
+        Examples:
+            | credentials            | name  | role     |
+            | none                   |       | viewer   |
+            | Bearer operator-token  |       | operator |
+            | signed operator:bob    | bob   | operator |
+            | Basic alice:wonderland | alice | admin    |
+
+    Scenario Outline: Bad credentials are rejected
+        When a request carries the credentials "<credentials>"
+        Then the caller is rejected because of "<reason>"
+
+        Examples:
+            | credentials               | reason                    |
+            | Bearer guessed-token      | unrecognized credentials  |
+            | signed expired admin:bob  | token expired             |
+            | forged admin:bob          | bad token signature       |
+            | Basic alice:looking-glass | bad user name or password |
+
+    Scenario Outline: Each role grants access to its own routes and those of the lesser roles
+        When a route requiring the role "<required>" is requested with the credentials "<credentials>"
+        Then the request is answered with <status>
+
+        Examples:
+            | required | credentials            | status |
+            | viewer   | none                   | 200    |
+            | operator | none                   | 401    |
+            | operator | Bearer viewer-token    | 403    |
+            | operator | Bearer operator-token  | 200    |
+            | admin    | Bearer operator-token  | 403    |
+            | admin    | Basic alice:wonderland | 200    |
+            | viewer   | Bearer guessed-token   | 401    |
+
+    Scenario: Viewers may not send commands
+        Given a system in state "waiting"
+        When the system "start" is requested with the credentials "Bearer viewer-token"
+        Then the command is reported as "forbidden"
+        And "CommandRejected" carries the id of the command
+        And the rejection reason mentions "operator role required"
+        And the system is found in state "waiting"
+
+    Scenario: Anonymous callers are asked to authenticate before sending commands
+        Given a system in state "waiting"
+        When the system "start" is requested with the credentials "none"
+        Then the command is reported as "unauthorized"
+        And "CommandRejected" carries the id of the command
+
+    Scenario: Operators may send commands
+        Given a system in state "waiting"
+        When the system "start" is requested with the credentials "signed operator:bob"
+        Then the command is reported as "accepted"
@@ -0,0 +1,18 @@
+@unit
+Feature: Tracing the cluster messages
+    Scenario Outline: The receiving replica continues the trace of the sender
+        Given a traced cluster
+        When '{"counter": "newconnections", "value": 3}' is <sent>
+        Then '{"counter": "newconnections", "value": 3}' is received with the trace context
+        And the receiving span continues the trace of "<span>"
+
+        Examples:
+            | sent            | span              |
+            | sent to a peer  | cluster send      |
+            | broadcast       | cluster broadcast |
+
+    Scenario: The messages other than JSON objects are sent as they are
+        Given a traced cluster
+        When '["newconnections", 3]' is sent to a peer
+        Then '["newconnections", 3]' is received unchanged
+        And the receiving span does not continue the trace of "cluster send"
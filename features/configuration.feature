@@ -0,0 +1,89 @@
+@unit
+Feature: Configuration
+    Scenario: The environment overrides the config file, and the flags override both
+        Given the config file
+            """
+            port: 9000
+            countdown_delay: 1s
+            rate_limit: 10-S
+            """
+        And the environment variable "COUNTDOWN_DELAY" is "2s"
+        And the environment variable "RATE_LIMIT" is "20-S"
+        When the config is loaded with the flags "-delay 3s"
+        Then the setting "port" is "9000"
+        And the setting "countdown_delay" is "3s"
+        And the setting "rate_limit" is "20-S"
+        And the setting "subscriber_overflow" is "coalesce-ticks"
+
+    Scenario: The invalid settings are reported together
+        Given the environment variable "SUBSCRIBER_OVERFLOW" is "explode"
+        And the environment variable "LOG_FORMAT" is "xml"
+        When the config is loaded with the flags "-port 0"
+        Then the config is rejected for "subscriber_overflow, log_format, port"
+
+    Scenario: The rejection lists the accepted values
+        Given the environment variable "OTEL_TRACES_EXPORTER" is "jaeger"
+        When the config is loaded with the flags ""
+        Then the config is rejected for "traces_exporter: expected none, otlp, console or stdout: 'jaeger'"
+
+    Scenario: Unknown keys in the config file are rejected
+        Given the config file
+            """
+            prot: 9000
+            """
+        When the config is loaded with the flags ""
+        Then the config is rejected for "prot"
+
+    Scenario: Reloading applies the runtime settings, the others take effect after a restart
+        Given the config file
+            """
+            port: 9000
+            countdown_delay: 1s
+            """
+        And the config is loaded with the flags ""
+        When the config file is changed to
+            """
+            port: 9001
+            countdown_delay: 2s
+            rate_limit: 10-S
+            """
+        And the config is reloaded
+        Then "ConfigReloaded" is published with the changes to "countdown_delay, rate_limit"
+        And the setting "countdown_delay" is "2s"
+        And the setting "rate_limit" is "10-S"
+        And the setting "port" is "9000"
+
+    Scenario: The reloaded credentials are not published
+        Given the config file
+            """
+            auth_anonymous_role: viewer
+            """
+        And the config is loaded with the flags ""
+        When the config file is changed to
+            """
+            auth_anonymous_role: operator
+            auth_hmac_secret: 0123456789abcdef0123456789abcdef
+            auth_users:
+              - name: alice
+                password: wonderland
+                role: admin
+            """
+        And the config is reloaded
+        Then "ConfigReloaded" is published with the changes to "auth_anonymous_role, auth_hmac_secret, auth_users"
+
+    Scenario: An invalid config update is rejected as a whole
+        Given the config file
+            """
+            countdown_delay: 1s
+            """
+        And the config is loaded with the flags ""
+        When the config file is changed to
+            """
+            countdown_delay: 0s
+            rate_limit: 10-S
+            """
+        And the config is reloaded
+        Then the config update is rejected for "countdown_delay"
+        And no config change is published
+        And the setting "countdown_delay" is "1s"
+        And the setting "rate_limit" is ""
@@ -6,3 +6,13 @@ Feature: Edge cases
         And the system "start" is requested
         Then the request is ignored
         And work is completed
+
+    Scenario: Learning what became of a command
+        Given a system in state "waiting"
+        When the system "start" is requested
+        Then the command is reported as "accepted"
+        And "WorkStarted" carries the id of the command
+        When the system "start" is requested
+        Then the command is reported as "ignored"
+        And "RequestIgnored" carries the id of the command
+        And work is completed
@@ -0,0 +1,19 @@
+@unit
+Feature: Filtering the event stream
+    Scenario Outline: Selecting the events a client is interested in
+        Given a stream filtered by "<query>"
+        Then a "<event>" event of machine "<machine>" with "<property>" is <verdict>
+
+        Examples:
+            | query                                   | event          | machine | property                   | verdict  |
+            |                                         | VisitorsActive |         | param:1                    | streamed |
+            | exclude=VisitorsActive,TotalVisitors    | VisitorsActive |         | param:1                    | dropped  |
+            | include=Tick&include=WorkDone           | WorkDone       | default |                            | streamed |
+            | include=Tick,WorkDone                   | WorkStarted    | default |                            | dropped  |
+            | property=param:8                        | Tick           | default | param:8                    | streamed |
+            | property=param:8                        | Tick           | default | param:7                    | dropped  |
+            | property=reason                         | RequestIgnored | default | reason:machine busy        | streamed |
+            | exclude_property=reason                 | RequestIgnored | default | reason:machine busy        | dropped  |
+            | machine=room-1                          | Tick           | room-1  | param:3                    | streamed |
+            | machine=room-1                          | Tick           | default | param:3                    | dropped  |
+            | machine=room-1                          | VisitorsActive |         | param:1                    | streamed |
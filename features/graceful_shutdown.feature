@@ -0,0 +1,26 @@
+@unit
+Feature: Graceful Shutdown
+    Scenario: The commands are refused once the server shuts down
+        Given a system in state "waiting"
+        When the server shuts down
+        And the command "start" is submitted to the server
+        Then the command is reported as "refused"
+        And the rejection reason mentions "server shutting down"
+        And the metrics count at least 1 of 'mermaidlive_commands_total{command="start",outcome="refused"}'
+        And the system is found in state "waiting"
+
+    Scenario: The commands sent over HTTP are refused for another replica to take them
+        Given a system in state "waiting"
+        When the server shuts down
+        And "POST /commands/start" is requested
+        Then the request is answered with 503
+        And the reason given mentions "server shutting down"
+
+    Scenario: The streams of a machine are told to reconnect once the server shuts down
+        Given a server
+        And the machine "room-1" is created
+        When an SSE client connects to "/machines/room-1/events/sse"
+        And the SSE event "ConnectedToMachine" is received
+        And the server shuts down
+        Then the SSE event "ServerShuttingDown" is received
+        And the SSE stream ends
@@ -0,0 +1,19 @@
+@unit
+Feature: Health and readiness
+    Scenario: A replica set up is ready
+        Given a server
+        When "GET /readyz" is requested
+        Then the request is answered with 200
+        And the readiness check "counters" has passed
+
+    Scenario: A replica whose counters failed to load is not ready
+        Given a server whose counters fail to load
+        When "GET /readyz" is requested
+        Then the request is answered with 503
+        And the readiness check "counters" has failed
+        And the readiness check "routes" has passed
+
+    Scenario: A replica is alive while not ready
+        Given a server whose counters fail to load
+        When "GET /healthz" is requested
+        Then the request is answered with 200
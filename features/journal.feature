@@ -0,0 +1,19 @@
+@unit
+Feature: Event journal
+    Scenario: The oldest events fall off as the journal is rotated
+        Given a journal of 3 files of at most 1 bytes
+        When 5 events are journaled
+        Then the journal reads the events "3,4,5"
+
+    Scenario: The journal is appended to until rotated
+        Given a journal of 2 files of at most 100000 bytes
+        When 5 events are journaled
+        And 2 events are journaled
+        Then the journal reads the events "1,2,3,4,5,1,2"
+
+    Scenario: A deleted journal leaves no files
+        Given a journal of 3 files of at most 1 bytes
+        When 5 events are journaled
+        And the journal is deleted
+        Then no journal file is left
+        And the journal reads the events ""
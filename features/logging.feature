@@ -0,0 +1,42 @@
+@unit
+Feature: Logging
+    Scenario Outline: The requests are logged at the level of their outcome
+        Given a server
+        And the logs are written as "json" at level "debug"
+        When "GET <route>" is requested
+        Then the request is answered with <status>
+        And the request "GET <route>" is logged at level "<level>"
+
+        Examples:
+            | route             | status | level |
+            | /healthz          | 200    | INFO  |
+            | /machines/unknown | 404    | WARN  |
+
+    Scenario: A failing request is logged as an error
+        Given a server whose counters fail to load
+        And the logs are written as "json" at level "info"
+        When "GET /readyz" is requested
+        Then the request is answered with 503
+        And the request "GET /readyz" is logged at level "ERROR"
+
+    Scenario: The requests below the configured level are not logged
+        Given a server
+        And the logs are written as "json" at level "warn"
+        When "GET /healthz" is requested
+        And "GET /machines/unknown" is requested
+        Then the request "GET /healthz" is not logged
+        And the request "GET /machines/unknown" is logged at level "WARN"
+
+    Scenario: The commands are logged with their machine and id
+        Given a server
+        And the machine "room-1" is created
+        And the logs are written as "json" at level "info"
+        When "POST /machines/room-1/commands/start" is requested
+        Then the request is answered with 200
+        And the request "POST /machines/room-1/commands/start" is logged with the machine "room-1" and the id of the command
+
+    Scenario: The records are written as text by default
+        Given a server
+        And the logs are written as "text" at level "info"
+        When "GET /healthz" is requested
+        Then the request "GET /healthz" is logged as text
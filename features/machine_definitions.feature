@@ -0,0 +1,92 @@
+@unit
+Feature: Declarative machine definitions
+    Scenario: Running a machine loaded from a definition file
+        Given a system loaded from "machines/countdown.yaml" in state "waiting"
+        When the system "start" is requested
+        Then some work has progressed
+        And work is completed
+        And the system is found in state "waiting"
+
+    Scenario: Aborting a machine loaded from a definition file
+        Given a system loaded from "machines/countdown.yaml" in state "waiting"
+        When the system "start" is requested
+        And some work has progressed
+        When the system "abort" is requested
+        Then work is canceled
+        And the system is found in state "waiting"
+
+    Scenario: Pausing and resuming a machine loaded from a definition file
+        Given a system loaded from "machines/countdown.yaml" in state "waiting"
+        When the system "start" is requested
+        And some work has progressed
+        And the system "pause" is requested
+        And the work is paused
+        Then the system is found in state "paused"
+        When the system "resume" is requested
+        Then the ticks continue from the paused count before the work is completed
+
+    Scenario: The guard of a transition decides which one the command takes
+        Given the machine definition
+            """
+            initial: waiting
+            states:
+              - name: waiting
+              - name: skipped
+              - name: finished
+            transitions:
+              - from: waiting
+                to: skipped
+                command: finish
+                guard: busy
+              - from: waiting
+                to: finished
+                command: finish
+                guard: idle
+                event: Finished
+            """
+        And a system of that definition in state "waiting"
+        When the system "finish" is requested
+        Then the command is reported as "accepted"
+        And the system is found in state "finished"
+
+    Scenario: A command whose guards do not hold is ignored
+        Given the machine definition
+            """
+            initial: waiting
+            states:
+              - name: waiting
+              - name: finished
+            transitions:
+              - from: waiting
+                to: finished
+                command: finish
+                guard: busy
+                ignored_reason: "cannot finish: nothing to do"
+            """
+        And a system of that definition in state "waiting"
+        When the system "finish" is requested
+        Then the command is reported as "ignored"
+        And the rejection reason mentions "cannot finish: nothing to do"
+        And the system is found in state "waiting"
+
+    Scenario Outline: Invalid definitions are rejected
+        Given the machine definition
+            """
+            initial: waiting
+            states:
+              - name: waiting
+              - name: finished
+            transitions:
+              - from: waiting
+                to: finished
+                <field>
+            """
+        Then the machine definition is rejected for "<reason>"
+
+        Examples:
+            | field                   | reason                            |
+            | command: "start now"    | command names must be identifiers |
+            | command: "start\|abort" | command names must be identifiers |
+            | event: "Work Started"   | event names must be identifiers   |
+            | guard: never            | unknown guard: 'never'            |
+            | gaurd: idle             | unknown field                     |
@@ -0,0 +1,50 @@
+@unit
+Feature: Machine diagram
+    Scenario: The waiting machine is rendered
+        Given a system in state "waiting"
+        When the diagram is requested
+        Then the diagram is
+            """
+            stateDiagram-v2
+              [*] --> waiting
+              waiting --> working : start
+              working --> aborting : abort
+              paused --> aborting : abort
+              aborting --> aborting : abort
+              working --> paused : pause
+              paused --> working : resume
+              working --> waiting
+              aborting --> waiting
+              classDef inProgress font-style:italic, stroke-dasharray: 5 5, stroke-width:3px;
+              class waiting inProgress
+            """
+
+    Scenario: The working machine shows the count
+        Given a system with a delay of "1s" in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5}'
+        And some work has progressed
+        And the diagram is requested
+        Then the diagram highlights "working"
+        And the diagram notes "5" on "working"
+
+    Scenario: The paused machine shows the ticks left
+        Given a system with a delay of "1s" in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5}'
+        And some work has progressed
+        And the system "pause" is requested
+        And the work is paused
+        And the diagram is requested
+        Then the diagram highlights "paused"
+        And the diagram notes "4 left" on "paused"
+
+    Scenario Outline: The progress is only noted on a known state
+        When the default machine is rendered in state "<state>" with the progress "<progress>"
+        Then the diagram highlights <highlighted>
+        And the diagram has no note
+
+        Examples:
+            | state   | progress | highlighted |
+            | waiting |          | "waiting"   |
+            | paused  |          | "paused"    |
+            | nowhere | 3        | no state    |
+            |         | 3        | no state    |
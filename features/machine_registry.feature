@@ -0,0 +1,62 @@
+@unit
+Feature: Machine registry
+    Background:
+        Given a server
+
+    Scenario: Machines are created, listed and deleted
+        When the machine "room-1" is created
+        Then the machines "default, room-1" are listed
+        When the machine "room-1" is deleted
+        Then the machines "default" are listed
+
+    Scenario Outline: The machine ids are checked
+        When "POST /machines" is requested with '{"id": "<id>"}'
+        Then the request is answered with <status>
+
+        Examples:
+            | id                                                                | status |
+            | r                                                                 | 201    |
+            | Room_1-a                                                          | 201    |
+            | 1234567890123456789012345678901234567890123456789012345678901234  | 201    |
+            | 12345678901234567890123456789012345678901234567890123456789012345 | 400    |
+            | -room                                                             | 400    |
+            | _room                                                             | 400    |
+            | room 1                                                            | 400    |
+            | room/1                                                            | 400    |
+            |                                                                   | 400    |
+
+    Scenario: A machine cannot be created twice
+        When the machine "room-1" is created
+        And "POST /machines" is requested with '{"id": "room-1"}'
+        Then the request is answered with 409
+        And the reason given mentions "already exists"
+
+    Scenario: The number of machines is limited
+        When 99 machines are created
+        And "POST /machines" is requested with '{"id": "one-too-many"}'
+        Then the request is answered with 400
+        And the reason given mentions "no more than 100 machines"
+
+    Scenario: The default machine cannot be deleted
+        When "DELETE /machines/default" is requested
+        Then the request is answered with 400
+        And the reason given mentions "cannot be deleted"
+        And the machines "default" are listed
+
+    Scenario Outline: Unknown machines are not found
+        When "<route>" is requested
+        Then the request is answered with 404
+        And the reason given mentions "machine not found"
+
+        Examples:
+            | route                                 |
+            | GET /machines/nowhere/state           |
+            | GET /machines/nowhere/diagram         |
+            | POST /machines/nowhere/commands/start |
+            | DELETE /machines/nowhere              |
+
+    Scenario: A deleted machine is not found
+        When the machine "room-1" is created
+        And the machine "room-1" is deleted
+        And "GET /machines/room-1/state" is requested
+        Then the request is answered with 404
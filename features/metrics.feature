@@ -0,0 +1,23 @@
+@unit
+Feature: Exposing metrics
+    Scenario: Counting commands, transitions and ticks
+        Given a system in state "waiting"
+        When the system "start" is requested
+        Then work is completed
+        And the metrics count at least 1 of 'mermaidlive_commands_total{command="start",outcome="accepted"}'
+        And the metrics count at least 1 of 'mermaidlive_transitions_total{from="waiting",machine="default",to="working"}'
+        And the metrics count at least 10 of 'mermaidlive_ticks_total{machine="default"}'
+
+    Scenario: Sampling the gauges
+        Given a server
+        When the machine "room-1" is created
+        Then the metrics count at least 2 of 'mermaidlive_machines'
+        And the metrics count at least 0 of 'mermaidlive_gcounter_value{counter="newconnections"}'
+
+    Scenario: The series of a deleted machine are deleted with it
+        Given a server
+        And the machine "room-1" is created
+        When "POST /machines/room-1/commands/start" is requested
+        And the metrics count at least 1 of 'mermaidlive_transitions_total{from="waiting",machine="room-1",to="working"}'
+        And the machine "room-1" is deleted
+        Then the metrics do not list 'machine="room-1"'
@@ -0,0 +1,67 @@
+@unit
+Feature: Pausing Work
+    Scenario: A paused machine keeps its count
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms", "label": "paused"}'
+        And some work has progressed
+        And the system "pause" is requested
+        Then the command is reported as "accepted"
+        And the work is paused
+        And no tick is published within "250ms"
+        And the system is found in state "paused"
+        And the paused count is kept
+        And the last seen state is "ticks: 5, label: paused"
+
+    Scenario: A resumed machine continues the countdown
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "60ms"}'
+        And some work has progressed
+        And the system "pause" is requested
+        And the work is paused
+        And the system "resume" is requested
+        Then the command is reported as "accepted"
+        And "WorkResumed" echoes the parameters "ticks: 5, delay: 60ms"
+        And the ticks continue from the paused count before the work is completed
+        And the system is found in state "waiting"
+
+    Scenario: Aborting a paused machine
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And some work has progressed
+        And the system "pause" is requested
+        And the work is paused
+        And the system "abort" is requested
+        Then work is canceled
+        And the system is found in state "waiting"
+
+    Scenario Outline: Pausing and resuming only apply to the matching states
+        Given a system in state "waiting"
+        When the system "<command>" is requested
+        Then the request is ignored
+        And the command is reported as "ignored"
+        And the rejection reason mentions "<reason>"
+        And the system is found in state "waiting"
+
+        Examples:
+            | command | reason                            |
+            | pause   | cannot pause: machine not working |
+            | resume  | cannot resume: machine not paused |
+
+    Scenario: Resuming a working machine is ignored
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And some work has progressed
+        And the system "resume" is requested
+        Then the request is ignored
+        And the rejection reason mentions "cannot resume: machine not paused"
+        And the system is found in state "working"
+
+    Scenario: A paused machine is restarted from its journal
+        Given a journaled system in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And some work has progressed
+        And the system "pause" is requested
+        And the work is paused
+        And the system is restarted from its journal
+        Then the system is found in state "paused"
+        And the paused count is kept
@@ -0,0 +1,44 @@
+@unit
+Feature: Rate limiting
+    Background:
+        Given the rate limits
+            """
+            command_rate_limit: 2-M
+            stream_rate_limit: 2-M
+            cluster_rate_limit: 2-M
+            rate_limit: 2-M
+            """
+
+    Scenario: The commands beyond the limit of the caller are refused
+        Given a system in state "waiting"
+        When "alice" requests the system "abort" 3 times
+        Then the command is reported as "rate-limited"
+        And "RateLimited" carries the id of the command
+
+    Scenario: Each caller has a limit of each command
+        Given a system in state "waiting"
+        When "alice" requests the system "abort" 2 times
+        And "alice" requests the system "start" 1 time
+        Then the command is reported as "accepted"
+        When "bob" requests the system "abort" 1 time
+        Then the command is reported as "accepted"
+
+    Scenario Outline: The routes are limited by class
+        When "alice" requests "<route>" 3 times
+        Then the request is answered with 429
+        And the response header "X-RateLimit-Limit" is "2"
+        And the response header "X-RateLimit-Remaining" is "0"
+
+        Examples:
+            | route           |
+            | /events         |
+            | /cluster/events |
+            | /machine/state  |
+
+    Scenario: The classes count separately
+        When "alice" requests "/events" 2 times
+        And "alice" requests "/machine/state" 2 times
+        Then the request is answered with 200
+        And the response header "X-RateLimit-Remaining" is "0"
+        When "bob" requests "/events" 1 time
+        Then the request is answered with 200
@@ -0,0 +1,74 @@
+@unit
+Feature: Recovering work after a restart
+    Scenario: Resuming interrupted work
+        Given a system interrupted in state "working" at 3 recovered by "resume"
+        Then work is recovered
+        And some work has progressed
+        And work is completed
+        And the system is found in state "waiting"
+
+    Scenario: Aborting interrupted work
+        Given a system interrupted in state "working" at 3 recovered by "abort"
+        Then work is recovered
+        And the system is found in state "waiting"
+
+    Scenario: Resuming interrupted work keeps the queued work
+        Given a system interrupted in state "working" at 3 with "start" queued recovered by "resume"
+        Then work is recovered
+        And 1 command is queued
+        And the queued command is dequeued as "started"
+
+    Scenario: Aborting interrupted work drops the queued work
+        Given a system interrupted in state "working" at 3 with "start" queued recovered by "abort"
+        Then work is recovered
+        And the queued command is dequeued as "recovered"
+        And no command is queued
+        And the system is found in state "waiting"
+
+    Scenario: Rebuilding the state from the journal
+        Given a journaled system in state "waiting"
+        When the system "start" is requested
+        And some work has progressed
+        And the system is restarted from its journal
+        Then work is recovered
+        And work is completed
+        And the system is found in state "waiting"
+
+    Scenario: Rebuilding the queued work from the journal
+        Given a journaled system with a work queue of 2 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And the system "start" is requested with the parameters '{"ticks": 2, "delay": "60ms", "label": "queued"}'
+        And the command is queued
+        And the system is restarted from its journal
+        Then work is recovered
+        And 1 command is queued
+        And the queued command is dequeued as "started"
+        And "WorkStarted" echoes the parameters "ticks: 2, delay: 60ms, label: queued"
+
+    Scenario: The canceled queued work is not rebuilt from the journal
+        Given a journaled system with a work queue of 2 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And the system "start" is requested
+        And the command is queued
+        And the queued command is canceled
+        And the queued command is dequeued as "canceled"
+        And the system is restarted from its journal
+        Then work is recovered
+        And no command is queued
+
+    Scenario: A re-created machine does not inherit the history
+        Given a server journaling the machines
+        And the machine "extra" is created
+        When "POST /machines/extra/commands/start" is requested
+        Then the history of "extra" lists "WorkStarted"
+        When the machine "extra" is deleted
+        And the machine "extra" is created
+        Then the history of "extra" does not list "WorkStarted"
+        And "GET /machines/extra/state" is requested
+        And the request is answered with 200
+
+    Scenario: The machines are re-created after a restart
+        Given a server journaling the machines
+        And the machine "room-1" is created
+        When the server is restarted
+        Then the machines "default, room-1" are listed
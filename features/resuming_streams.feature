@@ -0,0 +1,49 @@
+@unit
+Feature: Resuming the event streams
+    Scenario: The events after the last seen one are replayed
+        Given a replay buffer of 5 events
+        When 3 ticks are published
+        And the replay is resumed after tick 1
+        Then the ticks "2,3" are replayed completely
+
+    Scenario: Nothing is replayed after the last event
+        Given a replay buffer of 5 events
+        When 3 ticks are published
+        And the replay is resumed after the last event
+        Then the ticks "" are replayed completely
+
+    Scenario: Resuming past the buffer replays what is left
+        Given a replay buffer of 3 events
+        When 5 ticks are published
+        And the replay is resumed after tick 1
+        Then the ticks "3,4,5" are replayed incompletely
+
+    Scenario Outline: Resuming after an unknown event cannot be complete
+        Given a replay buffer of 3 events
+        When 2 ticks are published
+        And the replay is resumed after <id>
+        Then the ticks "<replayed>" are replayed incompletely
+
+        Examples:
+            | id                           | replayed |
+            | an id from before the buffer | 1,2      |
+            | an id unknown to the replica |          |
+
+    Scenario: A stream resumed within the buffer replays the missed events
+        Given a system in state "waiting"
+        When the system "start" is requested
+        And work is completed
+        And "WorkDone" has been buffered
+        And the stream is resumed after the event "WorkStarted"
+        Then the stream replays "Tick, WorkDone"
+        And the stream does not replay "WorkStarted, ReplayIncomplete"
+
+    Scenario: A stream resumed after an unknown event is told the replay is incomplete
+        Given a system in state "waiting"
+        When the stream is resumed after 1
+        Then the stream replays "ReplayIncomplete"
+
+    Scenario: A bad last event id is ignored
+        Given a system in state "waiting"
+        When the stream is resumed after not-an-id
+        Then the stream does not replay "ReplayIncomplete"
@@ -0,0 +1,34 @@
+@unit
+Feature: Run parameters
+    Scenario: A run counts down the requested ticks at the requested delay
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 3, "delay": "60ms", "label": "short"}'
+        Then the command is reported as "accepted"
+        And "WorkStarted" echoes the parameters "ticks: 3, delay: 60ms, label: short"
+        And the ticks "3, 2, 1" are published before the work is completed
+
+    Scenario: The defaults apply without parameters
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters ''
+        Then the command is reported as "accepted"
+        And "WorkStarted" echoes the parameters "ticks: 10, delay: 10ms"
+
+    Scenario: A new subscriber sees the progress of the run
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "1s", "label": "slow"}'
+        Then the last seen state is "param: working, count: 5, ticks: 5, label: slow"
+
+    Scenario Outline: Parameters out of bounds are rejected
+        Given a system in state "waiting"
+        When the system "start" is requested with the parameters '<parameters>'
+        Then the command is reported as "rejected"
+        And the rejection reason mentions "<reason>"
+        And the system is found in state "waiting"
+
+        Examples:
+            | parameters                                                                       | reason                              |
+            | {"ticks": 101}                                                                   | ticks: expected 1 to 100            |
+            | {"delay": "1ms"}                                                                 | delay: expected 50ms to 10s         |
+            | {"delay": "soon", "ticks": -1}                                                   | ticks: expected 1 to 100: -1; delay |
+            | {"label": "a label far longer than sixty-four characters, which is the maximum"} | label: at most 64                   |
+            | {"tick": 3}                                                                      | unknown field                       |
@@ -0,0 +1,65 @@
+@unit
+Feature: Scheduled commands
+    Scenario: A command scheduled after a delay fires once as a regular command
+        Given a scheduling system in state "waiting"
+        When "start" is scheduled after "50ms"
+        Then the schedule fires with the result "accepted"
+        And some work has progressed
+        And no schedule is pending
+
+    Scenario: A recurring command fires at each run
+        Given a scheduling system in state "waiting"
+        When "abort" is scheduled by cron "@every 1s"
+        Then the schedule fires with the result "ignored"
+        And the schedule fires with the result "ignored"
+        And 1 schedule is pending
+
+    Scenario: A canceled schedule does not fire
+        Given a scheduling system in state "waiting"
+        When "start" is scheduled after "100ms"
+        And the schedule is canceled
+        Then the schedule does not fire within "300ms"
+        And no schedule is pending
+
+    Scenario: The schedules survive a restart
+        Given a scheduling system in state "waiting"
+        When "start" is scheduled at "23:59"
+        And the scheduler is restarted
+        Then the schedule is still pending
+
+    Scenario: The schedules of a deleted machine are canceled
+        Given a scheduling system in state "waiting"
+        And the machine "extra" is created
+        When "start" is scheduled for "extra" after "100ms"
+        And the machine "extra" is deleted
+        Then no schedule is pending
+        And the schedule does not fire within "300ms"
+
+    Scenario: A re-created machine does not inherit the schedules
+        Given a scheduling system in state "waiting"
+        And the machine "extra" is created
+        When "abort" is scheduled for "extra" by cron "@every 1s"
+        And the machine "extra" is deleted
+        And the machine "extra" is created
+        Then no schedule is pending
+
+    Scenario: A recurring schedule whose machine is gone is dropped
+        Given a scheduling system in state "waiting"
+        And the machine "extra" is created
+        When "abort" is scheduled for "extra" by cron "@every 1s"
+        And the machine "extra" is deleted leaving its schedules
+        Then the schedule does not fire within "1500ms"
+        And no schedule is pending
+
+    Scenario Outline: Invalid schedules are rejected
+        Given a scheduling system in state "waiting"
+        When "<command>" is scheduled <when> "<value>"
+        Then the schedule is rejected for "<reason>"
+
+        Examples:
+            | command | when    | value                | reason                    |
+            | fly     | after   | 1s                   | unknown command           |
+            | start   | after   | -1s                  | expected a positive       |
+            | start   | at      | 2000-01-01T00:00:00Z | in the past               |
+            | start   | at      | tomorrow             | expected RFC3339          |
+            | start   | by cron | every now and then   | cron                      |
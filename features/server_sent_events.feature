@@ -0,0 +1,38 @@
+@unit
+Feature: Server-Sent Events
+    Scenario: The stream tells the client how soon to reconnect, and keeps the connection alive
+        Given a system in state "waiting"
+        And the server sends heartbeats every "50ms"
+        When an SSE client connects to "/events/sse"
+        Then the stream starts with a retry of 5000ms
+        And the SSE event "StartedListening" is received
+        And it is sent without an id
+        And a heartbeat is received
+
+    Scenario: The events are sent by their names, with their ids
+        Given a system in state "waiting"
+        When an SSE client connects to "/events/sse"
+        And the SSE event "ConnectedToReplica" is received
+        And the system "start" is requested
+        Then the SSE event "WorkStarted" is received
+        And it is sent with an id
+        And the SSE event "Tick" is received
+        And it is sent with an id
+
+    Scenario: The stream of a machine ends once the machine is deleted
+        Given a server
+        And the machine "room-1" is created
+        When an SSE client connects to "/machines/room-1/events/sse"
+        And the SSE event "ConnectedToMachine" is received
+        And the machine "room-1" is deleted
+        Then the SSE event "MachineDeleted" is received
+        And the SSE stream ends
+
+    Scenario: The clients are told to reconnect elsewhere once the server shuts down
+        Given a system in state "waiting"
+        When an SSE client connects to "/events/sse"
+        And the SSE event "ConnectedToReplica" is received
+        And the server shuts down
+        Then the SSE event "ServerShuttingDown" is received
+        And it is sent without an id
+        And the SSE stream ends
@@ -0,0 +1,13 @@
+@unit
+Feature: Protecting the publishers from slow consumers
+    Scenario Outline: Shedding the events of a stalled subscriber
+        Given a subscriber with a queue of 3 events overflowing by "<policy>"
+        When 5 ticks are published while the subscriber stalls
+        Then the subscriber receives the ticks "<received>"
+        And the lagging subscriber is announced
+
+        Examples:
+            | policy         | received     |
+            | drop-oldest    | 3,2,1        |
+            | coalesce-ticks | 2,1          |
+            | disconnect     | disconnected |
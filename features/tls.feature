@@ -0,0 +1,41 @@
+@unit
+Feature: TLS
+    Scenario: A development certificate is created once and reused
+        Given a directory for the certificates
+        When the server is started with a self-signed certificate
+        Then the server presents a certificate for "localhost"
+        And the certificate may not sign other certificates
+        And HTTP/2 is negotiated
+        When the server is started with a self-signed certificate
+        Then the same certificate is presented
+
+    Scenario Outline: An expired or expiring development certificate is replaced
+        Given a directory for the certificates
+        And a development certificate valid for "<validity>" in the directory
+        When the server is started with a self-signed certificate
+        Then the server presents a certificate for "localhost"
+        And the certificate is valid for at least "720h"
+
+        Examples:
+            | validity |
+            | -1m      |
+            | 1h       |
+
+    Scenario: The certificate is reloaded when its files change
+        Given a certificate for "first.example" in the directory
+        And the server is started with the certificate
+        Then the server presents a certificate for "first.example"
+        When the certificate is replaced by one for "second.example"
+        Then the server presents a certificate for "second.example"
+
+    Scenario: An unusable certificate is not reloaded
+        Given a certificate for "first.example" in the directory
+        And the server is started with the certificate
+        When the certificate file is overwritten with "not a certificate"
+        Then the server still presents a certificate for "first.example"
+
+    Scenario: The certificate files are no longer watched once the server has stopped
+        Given a certificate for "first.example" in the directory
+        And the server is started with the certificate
+        When the server is stopped
+        Then the certificate files are no longer watched
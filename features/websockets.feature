@@ -0,0 +1,51 @@
+@unit
+Feature: Websockets
+    Scenario: The result of a command is sent before the events it leads to
+        Given a system in state "waiting"
+        When a websocket client answering the pings connects to "/ws"
+        And the websocket event "ConnectedToReplica" is received
+        And the websocket client sends the command "start" as "1"
+        Then the result "accepted" of "1" is received before "WorkStarted"
+        And the websocket event "Tick" is received
+
+    Scenario: The commands of a machine are taken over its websocket
+        Given a server
+        And the machine "room-1" is created
+        When a websocket client answering the pings connects to "/machines/room-1/ws"
+        And the websocket event "ConnectedToMachine" is received
+        And the websocket client sends the command "start" as "first"
+        And the result "accepted" of "first" is received before "WorkStarted"
+        And the websocket client sends the command "start" as "second"
+        Then the result "ignored" of "second" is received
+
+    Scenario Outline: The messages not understood are answered with an error
+        Given a system in state "waiting"
+        When a websocket client answering the pings connects to "/ws"
+        And the websocket event "ConnectedToReplica" is received
+        And the websocket client sends '<message>'
+        Then the websocket error mentioning "<reason>" is received
+
+        Examples:
+            | message          | reason                              |
+            | not json         | malformed message                   |
+            | {"type": "ping"} | unsupported message type: 'ping'    |
+
+    Scenario: A client answering the pings is kept connected
+        Given a system in state "waiting"
+        And the server sends heartbeats every "20ms"
+        When a websocket client answering the pings connects to "/ws"
+        Then the websocket stays open for "200ms"
+
+    Scenario: A client not answering the pings is disconnected
+        Given a system in state "waiting"
+        And the server sends heartbeats every "20ms"
+        When a websocket client not answering the pings connects to "/ws"
+        Then the websocket is closed for not answering the pings
+
+    Scenario: The clients are told to reconnect elsewhere once the server shuts down
+        Given a system in state "waiting"
+        When a websocket client answering the pings connects to "/ws"
+        And the websocket event "ConnectedToReplica" is received
+        And the server shuts down
+        Then the websocket event "ServerShuttingDown" is received
+        And the websocket is closed as going away
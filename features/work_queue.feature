@@ -0,0 +1,68 @@
+@unit
+Feature: Work Queue
+    Scenario: Work started while busy is queued and started next
+        Given a system with a work queue of 2 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 3, "delay": "60ms", "label": "first"}'
+        And the system "start" is requested with the parameters '{"ticks": 2, "delay": "60ms", "label": "second"}'
+        Then the command is queued
+        And "WorkQueued" echoes the parameters "position: 1, command: start, label: second"
+        And 1 command is queued
+        And "GET /machine/queue" is requested
+        And the queue of "default" is listed with 1 command
+        And the queued command is dequeued as "started"
+        And "WorkStarted" carries the id of the command
+        And the ticks "2, 1" are published before the work is completed
+        And no command is queued
+        And the system is found in state "waiting"
+
+    Scenario: A full queue ignores the work
+        Given a system with a work queue of 1 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And the system "start" is requested
+        And the command is queued
+        And the system "start" is requested
+        Then the command is reported as "ignored"
+        And the rejection reason mentions "cannot start: machine busy; work queue full (1)"
+        And 1 command is queued
+
+    Scenario: Without a queue, work started while busy is ignored
+        Given a system with a work queue of 0 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And the system "start" is requested
+        Then the command is reported as "ignored"
+        And no command is queued
+
+    Scenario: Queued work can be canceled
+        Given a system with a work queue of 2 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 3, "delay": "60ms"}'
+        And the system "start" is requested
+        And the command is queued
+        And the queued command is canceled
+        Then the queued command is dequeued as "canceled"
+        And no command is queued
+        And an unknown queued command cannot be canceled
+        And work is completed
+        And the system is found in state "waiting"
+
+    Scenario: Aborting the current work starts the queued one
+        Given a system with a work queue of 2 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And the system "start" is requested
+        And the command is queued
+        And the system "abort" is requested
+        Then work is canceled
+        And the queued command is dequeued as "started"
+        And "WorkStarted" carries the id of the command
+        And the system is found in state "working"
+
+    Scenario: Only the commands starting work are queued
+        Given a system with a work queue of 2 in state "waiting"
+        When the system "start" is requested with the parameters '{"ticks": 5, "delay": "100ms"}'
+        And the system "resume" is requested
+        Then the command is reported as "ignored"
+        And no command is queued
+
+    Scenario: The queue depth is bounded
+        Given the environment variable "WORK_QUEUE_DEPTH" is "101"
+        When the config is loaded with the flags ""
+        Then the config is rejected for "work_queue_depth"
@@ -0,0 +1,74 @@
+package mermaidlive
+
+import (
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// editors tend to write a file in several steps
+const fileSettleDelay = 100 * time.Millisecond
+
+// watchDirectories calls changed with each change to the files in the directories until the watcher is closed
+func watchDirectories(directories []string, changed func(fsnotify.Event)) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start listening for events.
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				changed(event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("could not watch the files", "directories", directories, "error", err)
+			}
+		}
+	}()
+
+	for _, directory := range directories {
+		if err := watcher.Add(directory); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
+
+// watchFiles calls changed once the files have settled after a change
+func watchFiles(files []string, changed func()) (*fsnotify.Watcher, error) {
+	watched, directories := []string{}, []string{}
+	for _, file := range files {
+		file = filepath.Clean(file)
+		watched = append(watched, file)
+		if directory := filepath.Dir(file); !slices.Contains(directories, directory) {
+			directories = append(directories, directory)
+		}
+	}
+	var mutex sync.Mutex
+	var pending *time.Timer
+	return watchDirectories(directories, func(event fsnotify.Event) {
+		// saving may replace a file rather than write it
+		if !slices.Contains(watched, filepath.Clean(event.Name)) || !event.Has(fsnotify.Write|fsnotify.Create) {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if pending != nil {
+			pending.Stop()
+		}
+		pending = time.AfterFunc(fileSettleDelay, changed)
+	})
+}
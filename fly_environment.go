@@ -19,13 +19,6 @@ func getFlyPeersDomain() string {
 	return ""
 }
 
-func GetCounterDirectory() string {
-	if counterDirectory, ok := os.LookupEnv("COUNTER_DIRECTORY"); ok {
-		return counterDirectory
-	}
-	return "."
-}
-
 func GetReplicasEvent(count int) Event {
 	return NewEventWithParam("ReplicasActive",
 		fmt.Sprintf("%d (you are on '%s')", count, getPublicReplicaId()))
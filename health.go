@@ -0,0 +1,63 @@
+package mermaidlive
+
+import (
+	"net/http"
+
+	"github.com/carlmjohnson/versioninfo"
+	"github.com/gin-gonic/gin"
+)
+
+// readinessChecks lists the conditions for a replica to be routed to
+func (s *Server) readinessChecks() map[string]bool {
+	return map[string]bool{
+		"routes":       s.routesReady.Load(),
+		"counters":     s.peerSource.CountersLoaded(),
+		"peers":        s.peerSource.PeersAnswered(),
+		"not_draining": !s.isDraining(),
+	}
+}
+
+func (s *Server) isReady() bool {
+	for _, ok := range s.readinessChecks() {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) setupHealthRoutes() {
+	// the process is alive as long as it answers
+	s.server.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// load balancers should only route to replicas that are ready
+	s.server.GET("/readyz", func(c *gin.Context) {
+		checks := s.readinessChecks()
+		status := http.StatusOK
+		for _, ok := range checks {
+			if !ok {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		c.JSON(status, gin.H{"ready": status == http.StatusOK, "checks": checks})
+	})
+
+	s.server.GET("/status", s.requireRole(RoleViewer), func(c *gin.Context) {
+		machines := map[string]string{}
+		for _, id := range s.machines.List() {
+			if fsm, ok := s.machines.Get(id); ok {
+				machines[id] = fsm.CurrentState()
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"revision": versioninfo.Revision,
+			"replica":  getPublicReplicaId(),
+			"region":   getFlyRegion(),
+			"peers":    s.peerSource.Peers(),
+			"machines": machines,
+			"ready":    s.isReady(),
+		})
+	})
+}
@@ -0,0 +1,299 @@
+package mermaidlive
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const journalSuffix = ".journal.jsonl"
+const defaultJournalMaxBytes = 10 * 1024 * 1024
+const defaultJournalMaxFiles = 5
+
+// EventJournal is an append-only record of the events published by each machine
+type EventJournal interface {
+	Append(machine string, event Event) error
+	// Read returns the journaled events of the machine published after since, oldest first
+	Read(machine string, since time.Time) ([]Event, error)
+	// Delete removes the journal of the machine, not to be replayed into a machine re-created with its id
+	Delete(machine string) error
+}
+
+// FileEventJournal writes one JSON event per line, rotating the file once it exceeds maxBytes:
+// <machine>.journal.jsonl is the current file, <machine>.journal.1.jsonl the previous one, etc.
+// The current files stay open for appending until rotated, see Close
+type FileEventJournal struct {
+	sync.Mutex
+	directory string
+	maxBytes  int64
+	maxFiles  int
+	current   map[string]*journalFile
+}
+
+type journalFile struct {
+	*os.File
+	size int64
+}
+
+func NewFileEventJournal(directory string) *FileEventJournal {
+	return NewCustomFileEventJournal(directory, defaultJournalMaxBytes, defaultJournalMaxFiles)
+}
+
+func NewCustomFileEventJournal(directory string, maxBytes int64, maxFiles int) *FileEventJournal {
+	return &FileEventJournal{
+		directory: directory,
+		maxBytes:  maxBytes,
+		maxFiles:  maxFiles,
+		current:   map[string]*journalFile{},
+	}
+}
+
+func (j *FileEventJournal) Append(machine string, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.Lock()
+	defer j.Unlock()
+
+	f, err := j.currentFile(machine)
+	if err != nil {
+		return err
+	}
+	if f.size > 0 && f.size+int64(len(line)) > j.maxBytes {
+		if err := j.rotate(machine); err != nil {
+			return err
+		}
+		if f, err = j.currentFile(machine); err != nil {
+			return err
+		}
+	}
+	n, err := f.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// currentFile opens the current file of the machine for appending, unless already open
+func (j *FileEventJournal) currentFile(machine string) (*journalFile, error) {
+	if f, ok := j.current[machine]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(j.filename(machine, 0), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	res := &journalFile{File: f, size: info.Size()}
+	j.current[machine] = res
+	return res, nil
+}
+
+func (j *FileEventJournal) closeCurrentFile(machine string) error {
+	f, ok := j.current[machine]
+	if !ok {
+		return nil
+	}
+	delete(j.current, machine)
+	return f.Close()
+}
+
+func (j *FileEventJournal) Delete(machine string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	err := j.closeCurrentFile(machine)
+	for generation := 0; generation < j.maxFiles; generation++ {
+		if removed := os.Remove(j.filename(machine, generation)); removed != nil && !errors.Is(removed, os.ErrNotExist) {
+			err = errors.Join(err, removed)
+		}
+	}
+	return err
+}
+
+// Close closes the current files, to be reopened by the next Append
+func (j *FileEventJournal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+
+	var err error
+	for machine := range j.current {
+		err = errors.Join(err, j.closeCurrentFile(machine))
+	}
+	return err
+}
+
+func (j *FileEventJournal) Read(machine string, since time.Time) ([]Event, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	res := []Event{}
+	for generation := j.maxFiles - 1; generation >= 0; generation-- {
+		events, err := readJournalFile(j.filename(machine, generation), since)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, events...)
+	}
+	return res, nil
+}
+
+func (j *FileEventJournal) rotate(machine string) error {
+	if err := j.closeCurrentFile(machine); err != nil {
+		return err
+	}
+	// the oldest generation falls off
+	for generation := j.maxFiles - 1; generation > 0; generation-- {
+		err := os.Rename(j.filename(machine, generation-1), j.filename(machine, generation))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *FileEventJournal) filename(machine string, generation int) string {
+	if generation == 0 {
+		return filepath.Join(j.directory, machine+journalSuffix)
+	}
+	return filepath.Join(j.directory, fmt.Sprintf("%s.journal.%d.jsonl", machine, generation))
+}
+
+func readJournalFile(filename string, since time.Time) ([]Event, error) {
+	res := []Event{}
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// the rendered diagrams are not journaled, the lines are small
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// a torn last line after a crash should not prevent reading the rest
+			continue
+		}
+		if !since.IsZero() {
+			if t, err := time.Parse(time.RFC3339Nano, event.Timestamp); err == nil && !t.After(since) {
+				continue
+			}
+		}
+		res = append(res, event)
+	}
+	return res, scanner.Err()
+}
+
+// Replay folds the journaled events of a machine into the snapshot they lead to
+func (d *MachineDefinition) Replay(machine string, events []Event) (MachineSnapshot, bool) {
+	snapshot := MachineSnapshot{Machine: machine, State: d.Initial}
+	replayed := false
+	for _, event := range events {
+		if event.Name == "WorkRecovered" {
+			state, _ := event.Properties["state"].(string)
+			if _, ok := d.State(state); !ok {
+				continue
+			}
+			snapshot.State, snapshot.Count = state, countOf(event.Properties["count"])
+			if event.Properties["policy"] == string(RecoverByAborting) {
+				snapshot.State, snapshot.Count, snapshot.Run, snapshot.Queue = d.Initial, 0, nil, nil
+			}
+			snapshot.Timestamp, replayed = event.Timestamp, true
+			continue
+		}
+		if event.Name == "WorkQueued" || event.Name == "WorkDequeued" {
+			snapshot.Queue = replayQueue(snapshot.Queue, event)
+			snapshot.Timestamp, replayed = event.Timestamp, true
+			continue
+		}
+		if state, _ := d.State(snapshot.State); state.Countdown > 0 && event.Name == state.tickEvent() {
+			count := countOf(event.Properties["param"])
+			if count > 0 {
+				snapshot.Count = count - 1
+			}
+			snapshot.Timestamp, replayed = event.Timestamp, true
+			continue
+		}
+		if t := d.transitionForEvent(snapshot.State, snapshot.Count, event.Name); t != nil {
+			from, _ := d.State(snapshot.State)
+			target, _ := d.State(t.To)
+			snapshot.State = t.To
+			switch {
+			case t.From == t.To, target.Holds, target.Countdown > 0 && from.Holds && snapshot.Run != nil:
+				// the count is kept, held, or continued
+			case target.Countdown > 0:
+				// the first tick follows right away
+				snapshot.Count, snapshot.Run = target.Countdown, nil
+				if run, ok := runParametersOf(event.Properties); ok {
+					snapshot.Count, snapshot.Run = uint8(run.Ticks), &run
+				}
+			default:
+				snapshot.Count, snapshot.Run = 0, nil
+			}
+			snapshot.Timestamp, replayed = event.Timestamp, true
+		}
+	}
+	return snapshot, replayed
+}
+
+// replayQueue adds the queued work, or removes the dequeued one
+func replayQueue(queue []QueuedWork, event Event) []QueuedWork {
+	id, _ := event.Properties["id"].(string)
+	if event.Name == "WorkDequeued" {
+		return slices.DeleteFunc(queue, func(work QueuedWork) bool { return work.Id == id })
+	}
+	command, _ := event.Properties["command"].(string)
+	// each parameter is optional in a queued command
+	delay, _ := event.Properties["delay"].(string)
+	label, _ := event.Properties["label"].(string)
+	params := RunParameters{Ticks: int(countOf(event.Properties["ticks"])), Delay: delay, Label: label}
+	queuedAt, _ := time.Parse(time.RFC3339Nano, event.Timestamp)
+	return append(queue, QueuedWork{Id: id, Command: command, Parameters: params, QueuedAt: queuedAt})
+}
+
+// transitionForEvent prefers the transitions leaving the given state whose guard holds
+func (d *MachineDefinition) transitionForEvent(from string, count uint8, event string) *TransitionDefinition {
+	var res *TransitionDefinition
+	for i := range d.Transitions {
+		t := &d.Transitions[i]
+		if t.Event != event || event == "" {
+			continue
+		}
+		if t.From == from && guards[t.Guard](count) {
+			return t
+		}
+		if res == nil {
+			res = t
+		}
+	}
+	return res
+}
+
+// numbers read back from JSON are float64
+func countOf(v any) uint8 {
+	switch n := v.(type) {
+	case float64:
+		return uint8(n)
+	case uint8:
+		return n
+	case int:
+		return uint8(n)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,146 @@
+package mermaidlive
+
+import (
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/Arceliar/phony"
+	"github.com/cskr/pubsub/v2"
+	"github.com/fsnotify/fsnotify"
+)
+
+// the settings that take effect without a restart.
+// The countdown in progress keeps its delay, the ones started afterwards take the new one
+var reloadableSettings = []string{"rate_limit", "command_rate_limit", "stream_rate_limit", "cluster_rate_limit", "countdown_delay",
+	"run_max_ticks", "run_min_delay", "run_max_delay", "work_queue_depth", "cluster_observability_enabled", "log_level",
+	"auth_tokens", "auth_hmac_secret", "auth_users", "auth_anonymous_role"}
+
+// LiveConfig is the configuration of a running replica.
+// The reloadable settings are updated on each reload, announced by a ConfigReloaded event,
+// while the changes to the others only take effect after a restart
+type LiveConfig struct {
+	phony.Inbox
+	events   *pubsub.PubSub[string, Event]
+	current  Config
+	appliers []func(Config)
+}
+
+func NewLiveConfig(config Config, events *pubsub.PubSub[string, Event]) *LiveConfig {
+	return &LiveConfig{
+		events:  events,
+		current: config,
+	}
+}
+
+// Current is the config in effect
+func (l *LiveConfig) Current() Config {
+	var res Config
+	phony.Block(l, func() {
+		res = l.current
+	})
+	return res
+}
+
+// OnReload registers a function that applies the reloaded settings
+func (l *LiveConfig) OnReload(apply func(Config)) {
+	phony.Block(l, func() {
+		l.appliers = append(l.appliers, apply)
+	})
+}
+
+// Reload loads the config again, see LoadConfig. An invalid config is rejected as a whole
+func (l *LiveConfig) Reload(flags *ConfigFlags) error {
+	loaded, err := LoadConfig(flags)
+	if err != nil {
+		slog.Error("rejected the config update, keeping the current config", "error", err)
+		return err
+	}
+	phony.Block(l, func() {
+		l.reloadSync(loaded)
+	})
+	return nil
+}
+
+func (l *LiveConfig) reloadSync(loaded Config) {
+	values := settingValues(loaded)
+	changed := map[string]any{}
+	restartRequired := []string{}
+	for _, key := range changedSettings(l.current, loaded) {
+		if slices.Contains(reloadableSettings, key) {
+			changed[key] = values[key]
+		} else {
+			restartRequired = append(restartRequired, key)
+		}
+	}
+	if len(restartRequired) > 0 {
+		slog.Warn("the changed settings take effect after a restart", "settings", restartRequired)
+	}
+	if len(changed) == 0 {
+		slog.Debug("no reloadable setting changed")
+		return
+	}
+	l.current.RateLimit = loaded.RateLimit
+	l.current.CommandRateLimit = loaded.CommandRateLimit
+	l.current.StreamRateLimit = loaded.StreamRateLimit
+	l.current.ClusterRateLimit = loaded.ClusterRateLimit
+	l.current.CountdownDelay = loaded.CountdownDelay
+	l.current.RunMaxTicks = loaded.RunMaxTicks
+	l.current.RunMinDelay = loaded.RunMinDelay
+	l.current.RunMaxDelay = loaded.RunMaxDelay
+	l.current.WorkQueueDepth = loaded.WorkQueueDepth
+	l.current.ClusterObservabilityEnabled = loaded.ClusterObservabilityEnabled
+	l.current.LogLevel = loaded.LogLevel
+	l.current.AuthTokens = loaded.AuthTokens
+	l.current.AuthHmacSecret = loaded.AuthHmacSecret
+	l.current.AuthUsers = loaded.AuthUsers
+	l.current.AuthAnonymousRole = loaded.AuthAnonymousRole
+	for _, apply := range l.appliers {
+		apply(l.current)
+	}
+	slog.Info("config reloaded", "changed", changed)
+	// the event is public, and the settings include the credentials, hence only their names
+	l.events.Pub(NewEventWithProperties(ConfigReloadedEvent, map[string]any{
+		"replica": getPublicReplicaId(),
+		"changed": slices.Sorted(maps.Keys(changed)),
+	}), Topic, ClusterMessageTopic)
+}
+
+// Watch reloads the config whenever its file changes. Without a config file, there is nothing to watch
+func (l *LiveConfig) Watch(flags *ConfigFlags) (*fsnotify.Watcher, error) {
+	file := flags.configFile()
+	if file == "" {
+		return nil, nil
+	}
+	watcher, err := watchFiles([]string{file}, func() {
+		slog.Info("modified", "file", file)
+		l.Reload(flags)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("watching the config file", "file", file)
+	return watcher, nil
+}
+
+// changedSettings lists the keys of the settings that differ
+func changedSettings(current, next Config) []string {
+	res := []string{}
+	a, b := reflect.ValueOf(current), reflect.ValueOf(next)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			res = append(res, a.Type().Field(i).Tag.Get("json"))
+		}
+	}
+	return res
+}
+
+// settingValues prints the settings as they are logged
+func settingValues(config Config) map[string]string {
+	res := map[string]string{}
+	for _, attr := range config.LogValue().Group() {
+		res[attr.Key] = attr.Value.String()
+	}
+	return res
+}
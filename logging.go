@@ -0,0 +1,82 @@
+package mermaidlive
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the level can be changed at runtime, see LiveConfig
+var logLevel = new(slog.LevelVar)
+
+// ConfigureLogging makes a log/slog logger the default one, which the log package and gin also write through.
+// Each record carries the replica and region, the others add the machine, command_id or peer where known
+func ConfigureLogging(config Config) {
+	configureLogging(config, os.Stderr)
+}
+
+func configureLogging(config Config, w io.Writer) {
+	setLogLevel(config.LogLevel)
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if config.LogFormat == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	logger := slog.New(handler).With("replica", getPublicReplicaId(), "region", getFlyRegion())
+	slog.SetDefault(logger)
+	// gin debug output, such as the routes, is only of interest when debugging
+	gin.DefaultWriter = slog.NewLogLogger(logger.Handler(), slog.LevelDebug).Writer()
+	gin.DefaultErrorWriter = slog.NewLogLogger(logger.Handler(), slog.LevelError).Writer()
+}
+
+func setLogLevel(value string) {
+	var level slog.Level
+	// validated with the config
+	level.UnmarshalText([]byte(value))
+	logLevel.Set(level)
+}
+
+// requestLogger replaces the gin logger, logging each request once it is done
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client", c.ClientIP()),
+		}
+		if fsm, ok := c.Get(machineKey{}); ok {
+			attrs = append(attrs, slog.String("machine", fsm.(*AsyncFSM).Id()))
+		}
+		if identity, ok := identityOf(c.Request.Context()); ok && identity.Name != "" {
+			attrs = append(attrs, slog.String("identity", identity.Name))
+		}
+		if commandId := c.Writer.Header().Get(CommandIdKey); commandId != "" {
+			attrs = append(attrs, slog.String("command_id", commandId))
+		}
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", span.TraceID().String()))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
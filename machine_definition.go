@@ -0,0 +1,229 @@
+package mermaidlive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+const DefaultTickEvent = "Tick"
+
+// the names of the states, commands and events end up in the Mermaid diagram, the command routes and the UI
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// MachineDefinition declaratively describes a state machine run by AsyncFSM
+type MachineDefinition struct {
+	Name        string                 `json:"name"`
+	Initial     string                 `json:"initial"`
+	States      []StateDefinition      `json:"states"`
+	Transitions []TransitionDefinition `json:"transitions"`
+}
+
+type StateDefinition struct {
+	Name string `json:"name"`
+	// if non-zero, the state counts down from this value, publishing TickEvent on each step,
+	// and takes its automatic transition once the countdown is over
+	Countdown uint8  `json:"countdown,omitempty"`
+	TickEvent string `json:"tick_event,omitempty"`
+	// if true, the state holds the count of the countdown it is entered from,
+	// which a transition back to a countdown then continues rather than starts over
+	Holds bool `json:"holds,omitempty"`
+}
+
+type TransitionDefinition struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// transitions without a command are taken automatically:
+	// after the countdown of the source state, or after a delay otherwise
+	Command string `json:"command,omitempty"`
+	// one of the guards known to AsyncFSM, e.g. "idle" or "busy"
+	Guard string `json:"guard,omitempty"`
+	// delay before an automatic transition is taken, defaults to the machine delay
+	After string `json:"after,omitempty"`
+	// published when the transition is taken
+	Event string `json:"event,omitempty"`
+	// published as the RequestIgnored reason if the command cannot be executed
+	IgnoredReason string `json:"ignored_reason,omitempty"`
+}
+
+func DefaultMachineDefinition() *MachineDefinition {
+	return &MachineDefinition{
+		Name:    "countdown",
+		Initial: "waiting",
+		States: []StateDefinition{
+			{Name: "waiting"},
+			{Name: "working", Countdown: 10},
+			{Name: "paused", Holds: true},
+			{Name: "aborting"},
+		},
+		Transitions: []TransitionDefinition{
+			{From: "waiting", To: "working", Command: "start", Event: "WorkStarted", IgnoredReason: "cannot start: machine busy"},
+			{From: "working", To: "aborting", Command: "abort", Event: "WorkAbortRequested", IgnoredReason: "cannot abort: machine not busy"},
+			{From: "paused", To: "aborting", Command: "abort", Event: "WorkAbortRequested", IgnoredReason: "cannot abort: machine not busy"},
+			// re-requested while aborting
+			{From: "aborting", To: "aborting", Command: "abort", Event: "WorkAbortRequested", IgnoredReason: "cannot abort: machine not busy"},
+			{From: "working", To: "paused", Command: "pause", Event: "WorkPaused", IgnoredReason: "cannot pause: machine not working"},
+			{From: "paused", To: "working", Command: "resume", Event: "WorkResumed", IgnoredReason: "cannot resume: machine not paused"},
+			{From: "working", To: "waiting", Event: "WorkDone"},
+			{From: "aborting", To: "waiting", Event: "WorkAborted"},
+		},
+	}
+}
+
+// LoadMachineDefinition reads a YAML or JSON machine definition
+func LoadMachineDefinition(filename string) (*MachineDefinition, error) {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMachineDefinition(text)
+}
+
+func ParseMachineDefinition(text []byte) (*MachineDefinition, error) {
+	definition := &MachineDefinition{}
+	// JSON is a subset of YAML. Unknown keys are likely typos, and would be silently ignored otherwise
+	if err := yaml.UnmarshalWithOptions(text, definition, yaml.Strict()); err != nil {
+		return nil, err
+	}
+	if err := definition.Validate(); err != nil {
+		return nil, err
+	}
+	return definition, nil
+}
+
+func (d *MachineDefinition) Validate() error {
+	if len(d.States) == 0 {
+		return errors.New("no states defined")
+	}
+	seen := map[string]bool{}
+	for _, state := range d.States {
+		if state.Name == "" {
+			return errors.New("state without a name")
+		}
+		if !identifierPattern.MatchString(state.Name) {
+			return fmt.Errorf("state names must be identifiers: '%s'", state.Name)
+		}
+		if state.TickEvent != "" && !identifierPattern.MatchString(state.TickEvent) {
+			return fmt.Errorf("event names must be identifiers: '%s'", state.TickEvent)
+		}
+		if seen[state.Name] {
+			return fmt.Errorf("duplicate state: '%s'", state.Name)
+		}
+		if state.Holds && state.Countdown > 0 {
+			return fmt.Errorf("a state either counts down or holds a countdown: '%s'", state.Name)
+		}
+		seen[state.Name] = true
+	}
+	if !seen[d.Initial] {
+		return fmt.Errorf("unknown initial state: '%s'", d.Initial)
+	}
+	automatic := map[string]bool{}
+	for _, t := range d.Transitions {
+		if !seen[t.From] {
+			return fmt.Errorf("transition from an unknown state: '%s'", t.From)
+		}
+		if !seen[t.To] {
+			return fmt.Errorf("transition to an unknown state: '%s'", t.To)
+		}
+		if t.Command != "" && !identifierPattern.MatchString(t.Command) {
+			return fmt.Errorf("command names must be identifiers: '%s'", t.Command)
+		}
+		if t.Event != "" && !identifierPattern.MatchString(t.Event) {
+			return fmt.Errorf("event names must be identifiers: '%s'", t.Event)
+		}
+		if _, ok := guards[t.Guard]; !ok {
+			return fmt.Errorf("unknown guard: '%s'", t.Guard)
+		}
+		if t.After != "" {
+			if _, err := time.ParseDuration(t.After); err != nil {
+				return fmt.Errorf("bad delay of the transition %s -> %s: %v", t.From, t.To, err)
+			}
+		}
+		if t.Command == "" {
+			if automatic[t.From] {
+				return fmt.Errorf("more than one automatic transition from '%s'", t.From)
+			}
+			automatic[t.From] = true
+		}
+	}
+	return nil
+}
+
+func (d *MachineDefinition) State(name string) (StateDefinition, bool) {
+	for _, state := range d.States {
+		if state.Name == name {
+			return state, true
+		}
+	}
+	return StateDefinition{}, false
+}
+
+func (d *MachineDefinition) HasCommand(command string) bool {
+	return command != "" && len(d.transitionsFor(command)) > 0
+}
+
+func (d *MachineDefinition) Commands() []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, t := range d.Transitions {
+		if t.Command != "" && !seen[t.Command] {
+			seen[t.Command] = true
+			res = append(res, t.Command)
+		}
+	}
+	return res
+}
+
+func (d *MachineDefinition) transitionsFor(command string) []*TransitionDefinition {
+	res := []*TransitionDefinition{}
+	for i := range d.Transitions {
+		if d.Transitions[i].Command == command {
+			res = append(res, &d.Transitions[i])
+		}
+	}
+	return res
+}
+
+func (d *MachineDefinition) automaticTransitionFrom(state string) *TransitionDefinition {
+	for i := range d.Transitions {
+		if d.Transitions[i].From == state && d.Transitions[i].Command == "" {
+			return &d.Transitions[i]
+		}
+	}
+	return nil
+}
+
+// isTickEvent tells if the event counts down one of the states
+func (d *MachineDefinition) isTickEvent(name string) bool {
+	for _, state := range d.States {
+		if state.Countdown > 0 && state.tickEvent() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s StateDefinition) tickEvent() string {
+	if s.TickEvent == "" {
+		return DefaultTickEvent
+	}
+	return s.TickEvent
+}
+
+func (t *TransitionDefinition) delay(defaultDelay time.Duration) time.Duration {
+	if d, err := time.ParseDuration(t.After); err == nil {
+		return d
+	}
+	return defaultDelay
+}
+
+func (t *TransitionDefinition) ignoredReason(state string) string {
+	if t.IgnoredReason != "" {
+		return t.IgnoredReason
+	}
+	return fmt.Sprintf("cannot %s in state '%s'", t.Command, state)
+}
@@ -0,0 +1,215 @@
+package mermaidlive
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/cskr/pubsub/v2"
+)
+
+const maxMachines = 100
+
+var machineIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+var errMachineExists = errors.New("machine already exists")
+var errMachineNotFound = errors.New("machine not found")
+var errTooManyMachines = fmt.Errorf("no more than %d machines supported", maxMachines)
+var errDefaultMachine = errors.New("the default machine cannot be deleted")
+
+// MachineTopic is the pubsub topic of a machine instance.
+// The default machine publishes to Topic for compatibility with existing clients
+func MachineTopic(id string) string {
+	if id == DefaultMachineId {
+		return Topic
+	}
+	return Topic + "/" + id
+}
+
+// MachinePersistence configures how machines survive restarts, each part is optional
+type MachinePersistence struct {
+	Store   StateStore
+	Journal EventJournal
+	Policy  RecoveryPolicy
+}
+
+// MachineRegistry hosts the named machine instances, each running on its own actor
+type MachineRegistry struct {
+	phony.Inbox
+	events      *pubsub.PubSub[string, Event]
+	definition  *MachineDefinition
+	delay       time.Duration
+	queueDepth  int
+	persistence MachinePersistence
+	machines    map[string]*AsyncFSM
+	replays     map[string]*ReplayBuffer
+}
+
+// NewMachineRegistry re-creates the machines found in the store
+// and recovers their state according to the policy
+func NewMachineRegistry(events *pubsub.PubSub[string, Event],
+	definition *MachineDefinition,
+	delay time.Duration,
+	persistence MachinePersistence) *MachineRegistry {
+	r := &MachineRegistry{
+		events:      events,
+		definition:  definition,
+		delay:       delay,
+		persistence: persistence,
+		machines:    map[string]*AsyncFSM{},
+		replays:     map[string]*ReplayBuffer{},
+	}
+	r.addSync(DefaultMachineId)
+	if store := persistence.Store; store != nil {
+		persisted, err := store.List()
+		if err != nil {
+			slog.Error("could not list the persisted machines", "error", err)
+		}
+		for _, id := range persisted {
+			if _, ok := r.machines[id]; ok || !machineIdPattern.MatchString(id) || len(r.machines) >= maxMachines {
+				continue
+			}
+			r.addSync(id)
+		}
+	}
+	for _, fsm := range r.machines {
+		fsm.Recover(persistence.Policy)
+	}
+	return r
+}
+
+func (r *MachineRegistry) addSync(id string) *AsyncFSM {
+	fsm := r.newMachine(id)
+	r.machines[id] = fsm
+	r.replays[id] = NewReplayBuffer(r.events, fsm.Topic(), defaultReplayBufferCapacity)
+	return fsm
+}
+
+func (r *MachineRegistry) newMachine(id string) *AsyncFSM {
+	fsm := NewNamedAsyncFSM(id, r.events, r.definition, r.delay)
+	fsm.SetWorkQueueDepth(r.queueDepth)
+	if r.persistence.Store != nil {
+		fsm.UseStateStore(r.persistence.Store)
+	}
+	if r.persistence.Journal != nil {
+		fsm.UseJournal(r.persistence.Journal)
+	}
+	return fsm
+}
+
+func (r *MachineRegistry) Create(id string) (*AsyncFSM, error) {
+	if !machineIdPattern.MatchString(id) {
+		return nil, fmt.Errorf("bad machine id: '%s'", id)
+	}
+	var fsm *AsyncFSM
+	var err error
+	phony.Block(r, func() {
+		if _, ok := r.machines[id]; ok {
+			err = errMachineExists
+			return
+		}
+		if len(r.machines) >= maxMachines {
+			err = errTooManyMachines
+			return
+		}
+		fsm = r.addSync(id)
+	})
+	if fsm != nil {
+		// so that the machine is re-created after a restart
+		fsm.Act(fsm, fsm.persistSync)
+	}
+	return fsm, err
+}
+
+func (r *MachineRegistry) Delete(id string) error {
+	if id == DefaultMachineId {
+		return errDefaultMachine
+	}
+	var fsm *AsyncFSM
+	var replay *ReplayBuffer
+	phony.Block(r, func() {
+		fsm, replay = r.machines[id], r.replays[id]
+		delete(r.machines, id)
+		delete(r.replays, id)
+	})
+	if fsm == nil {
+		return errMachineNotFound
+	}
+	replay.Close()
+	fsm.Stop()
+	deleteMachineMetrics(id)
+	if r.persistence.Store != nil {
+		if err := r.persistence.Store.Delete(id); err != nil {
+			slog.Error("could not delete the snapshot", "machine", id, "error", err)
+		}
+	}
+	if r.persistence.Journal != nil {
+		if err := r.persistence.Journal.Delete(id); err != nil {
+			slog.Error("could not delete the journal", "machine", id, "error", err)
+		}
+	}
+	// let the subscribers of the machine know there is nothing more to come
+	r.events.Pub(NewEventWithParam(MachineDeletedEvent, id).OfMachine(id), fsm.Topic())
+	return nil
+}
+
+// SetDelay changes the delay of the countdowns started from now on, in each machine
+func (r *MachineRegistry) SetDelay(delay time.Duration) {
+	phony.Block(r, func() {
+		r.delay = delay
+		for _, fsm := range r.machines {
+			fsm.SetDelay(delay)
+		}
+	})
+}
+
+// SetWorkQueueDepth changes the depth of the work queue of each machine, see AsyncFSM.SetWorkQueueDepth
+func (r *MachineRegistry) SetWorkQueueDepth(depth int) {
+	phony.Block(r, func() {
+		r.queueDepth = depth
+		for _, fsm := range r.machines {
+			fsm.SetWorkQueueDepth(depth)
+		}
+	})
+}
+
+func (r *MachineRegistry) Get(id string) (*AsyncFSM, bool) {
+	var fsm *AsyncFSM
+	phony.Block(r, func() {
+		fsm = r.machines[id]
+	})
+	return fsm, fsm != nil
+}
+
+func (r *MachineRegistry) ReplayBuffer(id string) (*ReplayBuffer, bool) {
+	var replay *ReplayBuffer
+	phony.Block(r, func() {
+		replay = r.replays[id]
+	})
+	return replay, replay != nil
+}
+
+func (r *MachineRegistry) Default() *AsyncFSM {
+	fsm, _ := r.Get(DefaultMachineId)
+	return fsm
+}
+
+// Journal is set on construction and can be read without blocking
+func (r *MachineRegistry) Journal() EventJournal {
+	return r.persistence.Journal
+}
+
+func (r *MachineRegistry) List() []string {
+	res := []string{}
+	phony.Block(r, func() {
+		for id := range r.machines {
+			res = append(res, id)
+		}
+	})
+	slices.Sort(res)
+	return res
+}
@@ -0,0 +1,32 @@
+package mermaidlive
+
+import (
+	"fmt"
+	"strings"
+)
+
+const activeStateClass = "inProgress"
+
+// RenderMermaid renders the machine as a Mermaid state diagram,
+// highlighting the active state and optionally annotating it with the progress
+func (d *MachineDefinition) RenderMermaid(activeState, progress string) string {
+	var b strings.Builder
+	b.WriteString("stateDiagram-v2\n")
+	fmt.Fprintf(&b, "  [*] --> %s\n", d.Initial)
+	for _, t := range d.Transitions {
+		if t.Command != "" {
+			// the UI turns edge labels into clickable commands
+			fmt.Fprintf(&b, "  %s --> %s : %s\n", t.From, t.To, t.Command)
+		} else {
+			fmt.Fprintf(&b, "  %s --> %s\n", t.From, t.To)
+		}
+	}
+	fmt.Fprintf(&b, "  classDef %s font-style:italic, stroke-dasharray: 5 5, stroke-width:3px;\n", activeStateClass)
+	if _, ok := d.State(activeState); ok {
+		fmt.Fprintf(&b, "  class %s %s\n", activeState, activeStateClass)
+		if strings.TrimSpace(progress) != "" {
+			fmt.Fprintf(&b, "  note right of %s\n    %s\n  end note\n", activeState, progress)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,117 @@
+package mermaidlive
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// process-wide counters, incremented where it happens, like the event ids
+var (
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mermaidlive_commands_total",
+		Help: "Commands submitted, by command and outcome",
+	}, []string{"command", "outcome"})
+	// the series of a machine are deleted with the machine
+	transitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mermaidlive_transitions_total",
+		Help: "State machine transitions taken",
+	}, []string{"machine", "from", "to"})
+	ticksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mermaidlive_ticks_total",
+		Help: "Countdown ticks published",
+	}, []string{"machine"})
+	droppedEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mermaidlive_subscriber_dropped_events_total",
+		Help: "Events dropped for lagging subscribers, by overflow policy",
+	}, []string{"policy"})
+	laggedSubscribersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mermaidlive_subscriber_lag_episodes_total",
+		Help: "Times a subscriber has started lagging, by overflow policy",
+	}, []string{"policy"})
+	rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mermaidlive_rate_limited_requests_total",
+		Help: "Requests beyond the rate limit of their class",
+	}, []string{"class"})
+	zmqMessagesSentTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mermaidlive_zmq_messages_sent_total",
+		Help: "Cluster messages sent to peers",
+	})
+	zmqMessagesReceivedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mermaidlive_zmq_messages_received_total",
+		Help: "Cluster messages received from peers",
+	})
+)
+
+var allCounters = []prometheus.Collector{
+	commandsTotal,
+	transitionsTotal,
+	ticksTotal,
+	droppedEventsTotal,
+	laggedSubscribersTotal,
+	rateLimitedTotal,
+	zmqMessagesSentTotal,
+	zmqMessagesReceivedTotal,
+}
+
+// deleteMachineMetrics forgets the series of a deleted machine, as the machine ids are chosen by the clients
+func deleteMachineMetrics(machine string) {
+	transitionsTotal.DeletePartialMatch(prometheus.Labels{"machine": machine})
+	ticksTotal.DeleteLabelValues(machine)
+}
+
+// newMetricsRegistry gathers the process-wide counters and the gauges of the server, sampled on each scrape
+func newMetricsRegistry(s *Server) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(allCounters...)
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mermaidlive_active_streams",
+			Help: "Connected event stream clients",
+		}, func() float64 {
+			streams, _, _ := subscriptionQueueStats()
+			return float64(streams)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mermaidlive_subscriber_queued_events",
+			Help: "Events queued for all stream clients",
+		}, func() float64 {
+			_, queued, _ := subscriptionQueueStats()
+			return float64(queued)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mermaidlive_subscriber_queued_events_max",
+			Help: "Events queued for the most lagging stream client",
+		}, func() float64 {
+			_, _, longest := subscriptionQueueStats()
+			return float64(longest)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mermaidlive_machines",
+			Help: "Hosted machine instances",
+		}, func() float64 {
+			return float64(len(s.machines.List()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mermaidlive_cluster_peers",
+			Help: "Cluster peers currently known",
+		}, func() float64 {
+			return float64(len(s.peerSource.Peers()))
+		}),
+	)
+	for _, name := range []string{NewConnectionsCounter, StartedConnectionsCounter, ClosedConnectionsCounter} {
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "mermaidlive_gcounter_value",
+			Help:        "Cluster-wide gcounter values",
+			ConstLabels: prometheus.Labels{"counter": name},
+		}, func() float64 {
+			return float64(s.peerSource.CounterValue(name))
+		}))
+	}
+	return registry
+}
+
+// serveMetrics exposes the registry of the server in the Prometheus text format
+func (s *Server) serveMetrics() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(newMetricsRegistry(s), promhttp.HandlerOpts{}))
+}
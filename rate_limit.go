@@ -0,0 +1,172 @@
+package mermaidlive
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+const RateLimitedEvent = "RateLimited"
+
+// rateLimitClass groups the routes sharing a limit, each class counting separately
+type rateLimitClass string
+
+const (
+	// the command posts and websocket messages, per caller and command
+	commandRateLimit rateLimitClass = "commands"
+	// the event stream and websocket connections
+	streamRateLimit rateLimitClass = "streams"
+	// the /cluster/* routes
+	clusterRateLimit rateLimitClass = "cluster"
+	// the other routes
+	generalRateLimit rateLimitClass = "general"
+)
+
+type rateLimiter struct {
+	spec string
+	// nil while the rate is not limited
+	limiter *limiter.Limiter
+}
+
+// rateLimiters are replaced as a whole on each config reload
+type rateLimiters map[rateLimitClass]*rateLimiter
+
+func rateLimitSpecs(config Config) map[rateLimitClass]string {
+	return map[rateLimitClass]string{
+		commandRateLimit: config.CommandRateLimit,
+		streamRateLimit:  config.StreamRateLimit,
+		clusterRateLimit: config.ClusterRateLimit,
+		generalRateLimit: config.RateLimit,
+	}
+}
+
+// newRateLimiters keeps counting with the previous limiters whose rates have not changed
+func newRateLimiters(config Config, previous *rateLimiters) *rateLimiters {
+	res := rateLimiters{}
+	for class, spec := range rateLimitSpecs(config) {
+		if previous != nil {
+			if current, ok := (*previous)[class]; ok && current.spec == spec {
+				res[class] = current
+				continue
+			}
+		}
+		res[class] = newRateLimiter(class, spec)
+	}
+	return &res
+}
+
+func newRateLimiter(class rateLimitClass, limiterSpec string) *rateLimiter {
+	res := &rateLimiter{spec: limiterSpec}
+	if limiterSpec == "" {
+		slog.Info("no rate limiting configured", "class", class)
+		return res
+	}
+	rate, err := limiter.NewRateFromFormatted(limiterSpec)
+	if err != nil {
+		// validated with the config
+		slog.Error("bad rate limit", "class", class, "value", limiterSpec, "error", err)
+		return res
+	}
+	slog.Info("rate limiting", "class", class, "rate", limiterSpec)
+	res.limiter = limiter.New(memory.NewStore(), rate)
+	return res
+}
+
+// take counts a request of the key against the limit of the class, if there is one
+func (r *rateLimiters) take(ctx context.Context, class rateLimitClass, key string) (*limiter.Context, bool) {
+	rateLimiter := (*r)[class]
+	if rateLimiter == nil || rateLimiter.limiter == nil {
+		return nil, false
+	}
+	limit, err := rateLimiter.limiter.Get(ctx, key)
+	if err != nil {
+		// rather serve than fail on a counting error
+		slog.Warn("could not count the request against the rate limit", "class", class, "error", err)
+		return nil, false
+	}
+	return &limit, true
+}
+
+// rateLimitClassOf classifies a request by its route
+func rateLimitClassOf(c *gin.Context) rateLimitClass {
+	route := c.FullPath()
+	switch {
+	case strings.HasSuffix(route, "/commands/:command"):
+		return commandRateLimit
+	case strings.HasPrefix(route, "/cluster/"):
+		return clusterRateLimit
+	case strings.HasSuffix(route, "/events"), strings.HasSuffix(route, "/events/sse"), strings.HasSuffix(route, "/ws"):
+		return streamRateLimit
+	default:
+		return generalRateLimit
+	}
+}
+
+type rateLimitKey struct{}
+
+// callerKey identifies the caller to the rate limits by its authenticated name, if any, or else by its address
+func callerKey(c *gin.Context) string {
+	if identity, ok := identityOf(c.Request.Context()); ok && identity.Name != "" {
+		return "identity:" + identity.Name
+	}
+	return "address:" + c.ClientIP()
+}
+
+// limitRate answers 429 to the requests beyond the limit of their class.
+// The commands are only counted on submission, whichever transport they come from
+func (s *Server) limitRate(c *gin.Context) {
+	key := callerKey(c)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), rateLimitKey{}, key))
+	class := rateLimitClassOf(c)
+	if class == commandRateLimit {
+		c.Next()
+		return
+	}
+	limit, ok := s.rateLimiters.Load().take(c.Request.Context(), class, key)
+	if !ok {
+		c.Next()
+		return
+	}
+	writeRateLimitHeaders(c, limit)
+	if limit.Reached {
+		rateLimitedTotal.WithLabelValues(string(class)).Inc()
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"reason": rateLimitReason(class, limit)})
+		return
+	}
+	c.Next()
+}
+
+// takeCommand counts the command against the limit of the caller, known for the commands coming in over HTTP
+func (s *Server) takeCommand(ctx context.Context, fsm *AsyncFSM, command string) (*limiter.Context, bool) {
+	key, ok := ctx.Value(rateLimitKey{}).(string)
+	if !ok {
+		return nil, false
+	}
+	return s.rateLimiters.Load().take(ctx, commandRateLimit, key+"/"+fsm.Id()+"/"+knownCommandOrUnknown(fsm, command))
+}
+
+func writeRateLimitHeaders(c *gin.Context, limit *limiter.Context) {
+	c.Header("X-RateLimit-Limit", strconv.FormatInt(limit.Limit, 10))
+	c.Header("X-RateLimit-Remaining", strconv.FormatInt(limit.Remaining, 10))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(limit.Reset, 10))
+	if limit.Reached {
+		c.Header("Retry-After", strconv.FormatInt(retryAfter(limit), 10))
+	}
+}
+
+// retryAfter is the number of seconds until the limit is reset
+func retryAfter(limit *limiter.Context) int64 {
+	return max(1, limit.Reset-time.Now().Unix())
+}
+
+func rateLimitReason(class rateLimitClass, limit *limiter.Context) string {
+	return fmt.Sprintf("rate limit of the %s reached, retry in %ds", class, retryAfter(limit))
+}
@@ -0,0 +1,70 @@
+package mermaidlive
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/cskr/pubsub/v2"
+)
+
+const defaultReplayBufferCapacity = 256
+
+// ReplayBuffer keeps the latest events of a topic for clients resuming their stream
+type ReplayBuffer struct {
+	phony.Inbox
+	events   *pubsub.PubSub[string, Event]
+	topic    string
+	capacity int
+	buffer   []Event
+	// the id of the latest event not buffered, initially the latest one before the buffer
+	lastEvicted  uint64
+	subscription chan Event
+}
+
+func NewReplayBuffer(events *pubsub.PubSub[string, Event], topic string, capacity int) *ReplayBuffer {
+	b := &ReplayBuffer{
+		events:       events,
+		topic:        topic,
+		capacity:     capacity,
+		buffer:       []Event{},
+		lastEvicted:  lastEventId.Load(),
+		subscription: events.Sub(topic),
+	}
+	go b.listen()
+	return b
+}
+
+func (b *ReplayBuffer) listen() {
+	for event := range b.subscription {
+		// the current diagram is sent on connecting anyway
+		if event.Name == MachineDiagramEvent {
+			continue
+		}
+		b.Act(b, func() {
+			b.buffer = append(b.buffer, event)
+			if len(b.buffer) > b.capacity {
+				b.lastEvicted = b.buffer[0].Id
+				b.buffer = b.buffer[1:]
+			}
+		})
+	}
+}
+
+// Since returns the buffered events newer than the given id
+// and whether these are all the events the client has missed.
+// They might not be if the id is older than the buffer, or unknown to the replica
+func (b *ReplayBuffer) Since(id uint64) ([]Event, bool) {
+	res := []Event{}
+	complete := true
+	phony.Block(b, func() {
+		complete = id >= b.lastEvicted && id <= lastEventId.Load()
+		for _, event := range b.buffer {
+			if event.Id > id {
+				res = append(res, event)
+			}
+		}
+	})
+	return res, complete
+}
+
+func (b *ReplayBuffer) Close() {
+	b.events.Unsub(b.subscription, b.topic)
+}
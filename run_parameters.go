@@ -0,0 +1,92 @@
+package mermaidlive
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const maxRunLabelLength = 64
+
+// RunParameters tailor the countdown a command starts, the zero values standing for the defaults
+// of the state and the machine
+type RunParameters struct {
+	Ticks int `json:"ticks,omitempty"`
+	// e.g. 250ms
+	Delay string `json:"delay,omitempty"`
+	// free-form, e.g. to tell the runs apart
+	Label string `json:"label,omitempty"`
+}
+
+// RunBounds are the parameters a caller may choose from, see Config
+type RunBounds struct {
+	MaxTicks int
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+func (p RunParameters) isZero() bool {
+	return p == RunParameters{}
+}
+
+// validate reports all the parameters out of bounds at once
+func (p RunParameters) validate(bounds RunBounds) error {
+	problems := []string{}
+	if p.Ticks < 0 || p.Ticks > bounds.MaxTicks {
+		problems = append(problems, fmt.Sprintf("ticks: expected 1 to %d: %d", bounds.MaxTicks, p.Ticks))
+	}
+	if p.Delay != "" {
+		delay, err := time.ParseDuration(p.Delay)
+		if err != nil || delay < bounds.MinDelay || delay > bounds.MaxDelay {
+			problems = append(problems, fmt.Sprintf("delay: expected %v to %v: '%s'", bounds.MinDelay, bounds.MaxDelay, p.Delay))
+		}
+	}
+	if len(p.Label) > maxRunLabelLength {
+		problems = append(problems, fmt.Sprintf("label: at most %d characters long", maxRunLabelLength))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	// on one line, as the reason of the rejected command
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// resolve fills in the defaults, returning the parameters of the run as it goes and its delay
+func (p RunParameters) resolve(countdown uint8, defaultDelay time.Duration) (RunParameters, time.Duration) {
+	if p.Ticks <= 0 || p.Ticks > 255 {
+		p.Ticks = int(countdown)
+	}
+	delay, err := time.ParseDuration(p.Delay)
+	if err != nil || delay <= 0 {
+		delay = defaultDelay
+	}
+	p.Delay = delay.String()
+	return p, delay
+}
+
+// properties echo the parameters given, or those of the run once resolved, in the events
+func (p RunParameters) properties() map[string]any {
+	res := map[string]any{}
+	if p.Ticks != 0 {
+		res["ticks"] = p.Ticks
+	}
+	if p.Delay != "" {
+		res["delay"] = p.Delay
+	}
+	if p.Label != "" {
+		res["label"] = p.Label
+	}
+	return res
+}
+
+// runParametersOf reads the parameters back from the properties of an event
+func runParametersOf(properties map[string]any) (RunParameters, bool) {
+	ticks := countOf(properties["ticks"])
+	if ticks == 0 {
+		return RunParameters{}, false
+	}
+	delay, _ := properties["delay"].(string)
+	label, _ := properties["label"].(string)
+	return RunParameters{Ticks: int(ticks), Delay: delay, Label: label}, true
+}
@@ -0,0 +1,330 @@
+package mermaidlive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/robfig/cron/v3"
+)
+
+const schedulesFile = "schedules.json"
+const maxSchedules = 100
+
+var errScheduleNotFound = errors.New("schedule not found")
+var errTooManySchedules = fmt.Errorf("no more than %d schedules supported", maxSchedules)
+
+// the standard cron expressions with an optional leading seconds field, and descriptors such as @hourly or @every 90s
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// ScheduleRequest asks for a command to be sent to a machine later, exactly one of At, After and Cron telling when
+type ScheduleRequest struct {
+	// the default machine, if empty
+	Machine string `json:"machine"`
+	Command string `json:"command"`
+	// of the run the command starts, optional
+	Parameters RunParameters `json:"parameters,omitzero"`
+	// RFC3339, or the next time of day such as 14:00, in local time
+	At string `json:"at,omitempty"`
+	// e.g. 30s
+	After string `json:"after,omitempty"`
+	// recurring
+	Cron string `json:"cron,omitempty"`
+}
+
+// Schedule is a command pending until its next run
+type Schedule struct {
+	Id         string        `json:"id"`
+	Machine    string        `json:"machine"`
+	Command    string        `json:"command"`
+	Parameters RunParameters `json:"parameters,omitzero"`
+	// empty for the schedules that run once
+	Cron    string    `json:"cron,omitempty"`
+	NextRun time.Time `json:"next_run"`
+	// the name of the authenticated caller, if any
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// nextRun is the first time the request asks for, after now
+func (r ScheduleRequest) nextRun(now time.Time) (time.Time, error) {
+	given := 0
+	for _, when := range []string{r.At, r.After, r.Cron} {
+		if when != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return time.Time{}, errors.New("expected exactly one of at, after and cron")
+	}
+	switch {
+	case r.At != "":
+		return nextAt(r.At, now)
+	case r.After != "":
+		after, err := time.ParseDuration(r.After)
+		if err != nil || after <= 0 {
+			return time.Time{}, fmt.Errorf("after: expected a positive duration: '%s'", r.After)
+		}
+		return now.Add(after), nil
+	default:
+		schedule, err := cronParser.Parse(r.Cron)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cron: %w", err)
+		}
+		return schedule.Next(now), nil
+	}
+}
+
+func nextAt(at string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		if !t.After(now) {
+			return time.Time{}, fmt.Errorf("at: in the past: '%s'", at)
+		}
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04", at, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("at: expected RFC3339 or a time of day such as 14:00: '%s'", at)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// Scheduler sends the scheduled commands when they are due, keeping the pending ones in a store
+type Scheduler struct {
+	phony.Inbox
+	store     *FileScheduleStore
+	fire      func(Schedule) bool
+	schedules map[string]Schedule
+	timers    map[string]*time.Timer
+}
+
+// NewScheduler resumes the persisted schedules. The ones that fell due while the replica was down are fired right away,
+// the recurring ones only at their next run. Should fire report a schedule as no longer firing, it is dropped
+func NewScheduler(store *FileScheduleStore, fire func(Schedule) bool) *Scheduler {
+	s := &Scheduler{
+		store:     store,
+		fire:      fire,
+		schedules: map[string]Schedule{},
+		timers:    map[string]*time.Timer{},
+	}
+	persisted, err := store.Load()
+	if err != nil {
+		slog.Error("could not load the schedules", "error", err)
+	}
+	now := time.Now()
+	phony.Block(s, func() {
+		for _, schedule := range persisted {
+			if schedule.Cron != "" && schedule.NextRun.Before(now) {
+				if next, err := (ScheduleRequest{Cron: schedule.Cron}).nextRun(now); err == nil {
+					slog.Warn("skipping the missed runs of the schedule", "schedule", schedule.Id, "next_run", next)
+					schedule.NextRun = next
+				}
+			}
+			s.addSync(schedule)
+		}
+	})
+	return s
+}
+
+// Add schedules the command of the request. The machine and the command are up to the caller to check
+func (s *Scheduler) Add(request ScheduleRequest, createdBy string) (Schedule, error) {
+	now := time.Now()
+	next, err := request.nextRun(now)
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule := Schedule{
+		Id:         NewCommandId(),
+		Machine:    request.Machine,
+		Command:    request.Command,
+		Parameters: request.Parameters,
+		Cron:       request.Cron,
+		NextRun:    next,
+		CreatedBy:  createdBy,
+		CreatedAt:  now,
+	}
+	phony.Block(s, func() {
+		if len(s.schedules) >= maxSchedules {
+			err = errTooManySchedules
+			return
+		}
+		s.addSync(schedule)
+		s.persistSync()
+	})
+	if err != nil {
+		return Schedule{}, err
+	}
+	slog.Info("command scheduled", "schedule", schedule.Id, "machine", schedule.Machine, "command", schedule.Command, "next_run", schedule.NextRun)
+	return schedule, nil
+}
+
+// List returns the pending schedules, the next due first
+func (s *Scheduler) List() []Schedule {
+	res := []Schedule{}
+	phony.Block(s, func() {
+		for _, schedule := range s.schedules {
+			res = append(res, schedule)
+		}
+	})
+	slices.SortFunc(res, func(a, b Schedule) int {
+		return a.NextRun.Compare(b.NextRun)
+	})
+	return res
+}
+
+func (s *Scheduler) Cancel(id string) error {
+	var err error
+	phony.Block(s, func() {
+		if _, ok := s.schedules[id]; !ok {
+			err = errScheduleNotFound
+			return
+		}
+		s.removeSync(id)
+		s.persistSync()
+	})
+	if err == nil {
+		slog.Info("schedule canceled", "schedule", id)
+	}
+	return err
+}
+
+// CancelMachine cancels the schedules of the machine, returning how many there were
+func (s *Scheduler) CancelMachine(machine string) int {
+	canceled := 0
+	phony.Block(s, func() {
+		for id, schedule := range s.schedules {
+			if schedule.Machine == machine {
+				s.removeSync(id)
+				canceled++
+			}
+		}
+		if canceled > 0 {
+			s.persistSync()
+		}
+	})
+	if canceled > 0 {
+		slog.Info("schedules of the machine canceled", "machine", machine, "count", canceled)
+	}
+	return canceled
+}
+
+// Stop cancels the timers, keeping the schedules in the store
+func (s *Scheduler) Stop() {
+	phony.Block(s, func() {
+		for id, timer := range s.timers {
+			timer.Stop()
+			delete(s.timers, id)
+		}
+	})
+}
+
+func (s *Scheduler) addSync(schedule Schedule) {
+	s.schedules[schedule.Id] = schedule
+	s.timers[schedule.Id] = time.AfterFunc(time.Until(schedule.NextRun), func() {
+		var due Schedule
+		var ok bool
+		phony.Block(s, func() {
+			due, ok = s.takeDueSync(schedule.Id)
+		})
+		// on the timer's goroutine, as the command waits for the machine
+		if ok && !s.fire(due) {
+			s.drop(due)
+		}
+	})
+}
+
+// drop removes a schedule that cannot fire anymore, including its next run if recurring
+func (s *Scheduler) drop(schedule Schedule) {
+	phony.Block(s, func() {
+		if _, ok := s.schedules[schedule.Id]; ok {
+			s.removeSync(schedule.Id)
+			s.persistSync()
+		}
+	})
+	slog.Warn("schedule dropped", "schedule", schedule.Id, "machine", schedule.Machine)
+}
+
+func (s *Scheduler) removeSync(id string) {
+	if timer, ok := s.timers[id]; ok {
+		timer.Stop()
+	}
+	delete(s.timers, id)
+	delete(s.schedules, id)
+}
+
+// takeDueSync removes the schedule once due or, if it recurs, sets it up for its next run
+func (s *Scheduler) takeDueSync(id string) (Schedule, bool) {
+	due, ok := s.schedules[id]
+	if !ok {
+		// canceled in the meantime
+		return due, false
+	}
+	s.removeSync(id)
+	if due.Cron != "" {
+		next := due
+		var err error
+		if next.NextRun, err = (ScheduleRequest{Cron: due.Cron}).nextRun(time.Now()); err == nil {
+			s.addSync(next)
+		} else {
+			slog.Error("could not reschedule", "schedule", id, "error", err)
+		}
+	}
+	s.persistSync()
+	return due, true
+}
+
+func (s *Scheduler) persistSync() {
+	schedules := []Schedule{}
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, schedule)
+	}
+	if err := s.store.Save(schedules); err != nil {
+		slog.Error("could not persist the schedules", "error", err)
+	}
+}
+
+// FileScheduleStore keeps the pending schedules in one JSON file, e.g. next to the gcounter files
+type FileScheduleStore struct {
+	filename string
+}
+
+func NewFileScheduleStore(directory string) *FileScheduleStore {
+	return &FileScheduleStore{
+		filename: filepath.Join(directory, schedulesFile),
+	}
+}
+
+func (s *FileScheduleStore) Save(schedules []Schedule) error {
+	text, err := json.Marshal(schedules)
+	if err != nil {
+		return err
+	}
+	// write & rename to not leave a torn file behind
+	tmp := s.filename + ".tmp"
+	if err := os.WriteFile(tmp, text, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+func (s *FileScheduleStore) Load() ([]Schedule, error) {
+	var schedules []Schedule
+	text, err := os.ReadFile(s.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return schedules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return schedules, json.Unmarshal(text, &schedules)
+}
@@ -1,97 +1,163 @@
 package mermaidlive
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/carlmjohnson/versioninfo"
 	"github.com/cskr/pubsub/v2"
 	"github.com/d-led/zmqcluster"
+	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
 	"github.com/ulule/limiter/v3"
-	gm "github.com/ulule/limiter/v3/drivers/middleware/gin"
-	"github.com/ulule/limiter/v3/drivers/store/memory"
 )
 
 type Server struct {
-	port                 string
-	server               *gin.Engine
-	events               *pubsub.PubSub[string, Event]
-	fsm                  *AsyncFSM
-	visitorTracker       *VisitorTracker
-	peerSource           *Cluster
-	uiFilesystem         http.FileSystem
-	serverContext        context.Context
-	activeConnections    sync.WaitGroup
-	clusterEventObserver *PersistentClusterObserver
-}
-
-func NewServerWithOptions(port string,
+	// the config at boot, see liveConfig for the settings that may have been reloaded since
+	config                      Config
+	liveConfig                  *LiveConfig
+	server                      *gin.Engine
+	httpServer                  *http.Server
+	certificateWatcher          *fsnotify.Watcher
+	events                      *pubsub.PubSub[string, Event]
+	machines                    *MachineRegistry
+	schedules                   *Scheduler
+	visitorTracker              *VisitorTracker
+	peerSource                  *Cluster
+	uiFilesystem                http.FileSystem
+	serverContext               context.Context
+	heartbeatInterval           time.Duration
+	activeConnections           sync.WaitGroup
+	clusterEventObserver        *PersistentClusterObserver
+	routesReady                 atomic.Bool
+	rateLimiters                atomic.Pointer[rateLimiters]
+	runBounds                   atomic.Pointer[RunBounds]
+	authenticators              atomic.Pointer[authenticators]
+	clusterObservabilityEnabled atomic.Bool
+}
+
+func NewServerWithOptions(config Config,
 	events *pubsub.PubSub[string, Event],
 	fs http.FileSystem,
-	delay time.Duration) *Server {
-	myIp := ChoosePeerLocator().GetMyIP()
+	definition *MachineDefinition) *Server {
+	if definition == nil {
+		definition = DefaultMachineDefinition()
+	}
+	peerLocator := ChoosePeerLocator(config.TraefikServicesUrl)
+	myIp := peerLocator.GetMyIP()
 	clusterEventObserver := NewPersistentClusterObserver(
 		GetCounterIdentity(),
 		myIp,
 		events,
 	)
-	cluster := zmqcluster.NewZmqCluster(GetCounterIdentity(), getFlyZmqBindAddr())
-	log.Printf("My IP: %s", myIp)
-	cluster.SetMyIP(ChoosePeerLocator().GetMyIP())
-	peerSource := NewCluster(events, clusterEventObserver, cluster)
-	visitorTracker := NewVisitorTracker(events)
+	cluster := newTracedCluster(zmqcluster.NewZmqCluster(GetCounterIdentity(), zmqBindAddr(config.ZmqPort)))
+	slog.Info("my IP", "ip", myIp)
+	cluster.SetMyIP(myIp)
+	peerSource := NewCluster(events, clusterEventObserver, cluster, peerLocator, config)
+	machines := NewMachineRegistry(events, definition, config.CountdownDelay, MachinePersistence{
+		Store:   NewFileStateStore(config.CounterDirectory),
+		Journal: NewFileEventJournal(config.CounterDirectory),
+		Policy:  config.MachineRecovery,
+	})
+	server := newServer(shutdownOnSignal(), config, events, fs, machines, peerSource)
+	server.clusterEventObserver = clusterEventObserver
+	return server
+}
+
+// newServer serves the machines of the registry, and shuts down once the server context is done
+func newServer(serverContext context.Context,
+	config Config,
+	events *pubsub.PubSub[string, Event],
+	fs http.FileSystem,
+	machines *MachineRegistry,
+	peerSource *Cluster) *Server {
 	server := &Server{
-		port:                 port,
-		server:               configureGin(),
-		events:               events,
-		fsm:                  NewCustomAsyncFSM(events, delay),
-		visitorTracker:       visitorTracker,
-		peerSource:           peerSource,
-		uiFilesystem:         fs,
-		clusterEventObserver: clusterEventObserver,
+		config:         config,
+		liveConfig:     NewLiveConfig(config, events),
+		server:         configureGin(),
+		events:         events,
+		machines:       machines,
+		visitorTracker: NewVisitorTracker(events),
+		peerSource:     peerSource,
+		uiFilesystem:   fs,
+		serverContext:  serverContext,
+		// of the event streams and websockets, see sseFormat
+		heartbeatInterval: sseHeartbeatInterval,
 	}
+	server.httpServer = &http.Server{Handler: server.server}
+	server.server.Use(server.authenticate)
 	server.configureRateLimiting()
+	server.applyConfig(config)
+	server.liveConfig.OnReload(server.applyConfig)
 	server.setupRoutes()
-	server.setupSignalHandler()
+	// the schedules missed while down fire right away, so only once the server is set up
+	server.schedules = NewScheduler(NewFileScheduleStore(config.CounterDirectory), server.fireSchedule)
 	return server
 }
 
-func (s *Server) Run(port string) {
-	log.Printf("Server running at :%v", port)
+func (s *Server) Run() {
+	slog.Info("server running", "port", s.config.Port)
 	if myIp := getFlyPrivateIP(); myIp != "" {
-		log.Printf("Private IP: %v", myIp)
+		slog.Info("private IP", "ip", myIp)
 	}
-	log.Printf("Visit the UI at %s", s.getUIUrl())
+	slog.Info("visit the UI at " + s.getUIUrl())
 	s.peerSource.Start()
-	log.Println(s.server.Run(":" + port))
+	s.httpServer.Addr = ":" + s.config.Port
+	if err := s.listenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server stopped", "error", err)
+	}
 }
 
-func (s *Server) configureRateLimiting() {
-	limiterSpec := strings.TrimSpace(os.Getenv("RATE_LIMIT"))
-	if limiterSpec == "" {
-		log.Printf("No rate limiting configured")
-		return
+func (s *Server) listenAndServe() error {
+	if !s.config.tlsEnabled() {
+		return s.httpServer.ListenAndServe()
 	}
-	rate, err := limiter.NewRateFromFormatted(limiterSpec)
-	if err != nil {
-		log.Printf("bad rate limit '%s': %v", limiterSpec, err)
-		return
+	if err := s.configureTLS(); err != nil {
+		return fmt.Errorf("could not configure TLS: %w", err)
 	}
-	store := memory.NewStore()
-	log.Printf("RATE_LIMIT: %s", limiterSpec)
-	middleware := gm.NewMiddleware(limiter.New(store, rate))
+	// the certificate is taken from the TLS config
+	return s.httpServer.ListenAndServeTLS("", "")
+}
+
+// WatchConfig applies the changes to the config file as they are made, see LiveConfig
+func (s *Server) WatchConfig(flags *ConfigFlags) (*fsnotify.Watcher, error) {
+	return s.liveConfig.Watch(flags)
+}
+
+// applyConfig takes the reloadable settings into use
+func (s *Server) applyConfig(config Config) {
+	s.rateLimiters.Store(newRateLimiters(config, s.rateLimiters.Load()))
+	s.machines.SetDelay(config.CountdownDelay)
+	s.machines.SetWorkQueueDepth(config.WorkQueueDepth)
+	s.runBounds.Store(config.runBounds())
+	setLogLevel(config.LogLevel)
+	authenticators := newAuthenticators(config)
+	s.authenticators.Store(authenticators)
+	slog.Info("authentication", "enabled", authenticators.enabled(), "anonymous_role", authenticators.anonymous.Role)
+	if s.clusterObservabilityEnabled.Swap(config.ClusterObservabilityEnabled) != config.ClusterObservabilityEnabled {
+		slog.Info("cluster observability routes", "enabled", config.ClusterObservabilityEnabled)
+	}
+}
+
+// configureRateLimiting limits the rate of the requests of each caller, see rateLimitClass
+func (s *Server) configureRateLimiting() {
 	s.server.ForwardedByClientIP = true
-	s.server.Use(middleware)
+	s.server.Use(s.limitRate)
 }
 
 func (s *Server) setupRoutes() {
@@ -100,133 +166,585 @@ func (s *Server) setupRoutes() {
 	})
 	s.server.StaticFS("/ui/", s.uiFilesystem)
 
-	s.server.GET("/machine/state", func(ctx *gin.Context) {
-		ctx.String(http.StatusOK, s.fsm.CurrentState())
+	s.setupHealthRoutes()
+	s.server.GET("/metrics", s.serveMetrics())
+
+	viewer := s.requireRole(RoleViewer)
+
+	s.server.GET("/machine/state", viewer, func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, s.machines.Default().CurrentState())
+	})
+
+	s.server.GET("/machine/diagram", viewer, func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, s.machines.Default().Diagram())
+	})
+
+	s.server.GET("/machine/definition", viewer, func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.machines.Default().Definition())
+	})
+
+	s.server.GET("/machine/history", viewer, func(ctx *gin.Context) {
+		s.getHistory(ctx, s.machines.Default())
+	})
+
+	s.server.GET("/machine/queue", viewer, func(ctx *gin.Context) {
+		getQueue(ctx, s.machines.Default())
+	})
+
+	s.server.DELETE("/machine/queue/:command_id", s.requireRole(RoleOperator), func(ctx *gin.Context) {
+		cancelQueued(ctx, s.machines.Default())
 	})
 
 	s.server.POST("/commands/:command", func(ctx *gin.Context) {
-		command := ctx.Param("command")
-		sourceReplicaId := strings.Join(ctx.Request.Header[http.CanonicalHeaderKey(SourceReplicaIdKey)], "")
-		log.Println("command called:", command)
-		myReplicaId := getPublicReplicaId()
-		if sourceReplicaId != myReplicaId {
-			log.Printf("Command and Event Stream Replica ID mismatch: %s != %s", sourceReplicaId, myReplicaId)
+		s.postCommand(ctx, s.machines.Default())
+	})
+
+	s.server.GET("/events", viewer, func(c *gin.Context) {
+		s.streamEvents(c, ndjsonFormat{}, s.machines.Default(),
+			NewEventWithParam("Revision", versioninfo.Revision),
+		)
+	})
+
+	s.server.GET("/events/sse", viewer, func(c *gin.Context) {
+		s.streamEvents(c, sseFormat{}, s.machines.Default(),
+			NewEventWithParam("Revision", versioninfo.Revision),
+		)
+	})
+
+	s.server.GET("/ws", viewer, func(c *gin.Context) {
+		s.serveWebsocket(c, s.machines.Default(),
+			NewEventWithParam("Revision", versioninfo.Revision),
+		)
+	})
+
+	s.setupMachineRoutes()
+	s.setupScheduleRoutes()
+	s.setupClusterObservabilityRoutes()
+	s.routesReady.Store(true)
+}
+
+func (s *Server) setupScheduleRoutes() {
+	schedulesGroup := s.server.Group("schedules", s.requireRole(RoleViewer))
+
+	schedulesGroup.GET("", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"schedules": s.schedules.List()})
+	})
+
+	schedulesGroup.POST("", s.requireRole(RoleOperator), func(ctx *gin.Context) {
+		var request ScheduleRequest
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"reason": err.Error()})
+			return
+		}
+		schedule, err := s.createSchedule(ctx.Request.Context(), request)
+		switch {
+		case errors.Is(err, errMachineNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"machine": request.Machine, "reason": err.Error()})
+		case err != nil:
+			ctx.JSON(http.StatusBadRequest, gin.H{"reason": err.Error()})
+		default:
+			ctx.JSON(http.StatusCreated, schedule)
 		}
-		ctx.Header(SourceReplicaIdKey, myReplicaId)
-		switch command {
-		case "start":
-			s.fsm.StartWork()
-			// to do: consider using HTTP 201 Created
-			ctx.JSON(http.StatusOK, gin.H{})
+	})
+
+	schedulesGroup.DELETE("/:id", s.requireRole(RoleOperator), func(ctx *gin.Context) {
+		id := ctx.Param("id")
+		if err := s.schedules.Cancel(id); err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"id": id, "reason": err.Error()})
 			return
-		case "abort":
-			s.fsm.AbortWork()
-			ctx.JSON(http.StatusOK, gin.H{})
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+}
+
+// createSchedule schedules a command known to an existing machine, on behalf of the caller
+func (s *Server) createSchedule(ctx context.Context, request ScheduleRequest) (Schedule, error) {
+	if request.Machine == "" {
+		request.Machine = DefaultMachineId
+	}
+	fsm, ok := s.machines.Get(request.Machine)
+	if !ok {
+		return Schedule{}, errMachineNotFound
+	}
+	if !fsm.Definition().HasCommand(request.Command) {
+		return Schedule{}, fmt.Errorf("unknown command: '%s'", request.Command)
+	}
+	if err := s.checkRunParameters(request.Parameters); err != nil {
+		return Schedule{}, fmt.Errorf("bad parameters: %w", err)
+	}
+	identity, _ := identityOf(ctx)
+	return s.schedules.Add(request, identity.Name)
+}
+
+// fireSchedule submits the scheduled command as any other, though on behalf of the server,
+// and announces the outcome with a ScheduledCommandFired event. The schedules of a deleted machine cannot fire
+func (s *Server) fireSchedule(schedule Schedule) bool {
+	fsm, ok := s.machines.Get(schedule.Machine)
+	if !ok {
+		slog.Warn("not firing the schedule of a deleted machine", "schedule", schedule.Id, "machine", schedule.Machine)
+		return false
+	}
+	outcome := s.submitCommand(context.Background(), fsm, schedule.Command, schedule.Parameters)
+	slog.Info("schedule fired", "schedule", schedule.Id, "machine", fsm.Id(), "command_id", outcome.CommandId, "result", outcome.Result)
+	properties := map[string]any{
+		"schedule_id": schedule.Id,
+		"command":     schedule.Command,
+		"result":      outcome.Result,
+	}
+	if outcome.Reason != "" {
+		properties["reason"] = outcome.Reason
+	}
+	s.events.Pub(NewEventWithProperties(ScheduledCommandFiredEvent, properties).WithCommandId(outcome.CommandId).OfMachine(fsm.Id()), fsm.Topic())
+	return true
+}
+
+// deleteMachine deletes the machine along with its schedules, not to be inherited by a machine re-created with its id
+func (s *Server) deleteMachine(id string) error {
+	if err := s.machines.Delete(id); err != nil {
+		return err
+	}
+	s.schedules.CancelMachine(id)
+	slog.Info("machine deleted", "machine", id)
+	return nil
+}
+
+func (s *Server) setupMachineRoutes() {
+	machinesGroup := s.server.Group("machines", s.requireRole(RoleViewer))
+
+	machinesGroup.GET("", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"machines": s.machines.List()})
+	})
+
+	machinesGroup.POST("", s.requireRole(RoleOperator), func(ctx *gin.Context) {
+		var request struct {
+			Id string `json:"id"`
+		}
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"reason": err.Error()})
 			return
+		}
+		fsm, err := s.machines.Create(request.Id)
+		switch {
+		case errors.Is(err, errMachineExists):
+			ctx.JSON(http.StatusConflict, gin.H{"id": request.Id, "reason": err.Error()})
+		case err != nil:
+			ctx.JSON(http.StatusBadRequest, gin.H{"id": request.Id, "reason": err.Error()})
 		default:
-			msg := "unknown command: '" + command + "'"
-			s.fsm.events.Pub(NewEventWithReason("CommandRejected", msg), Topic)
-			ctx.JSON(http.StatusBadRequest, gin.H{
-				"result":  "rejected",
-				"command": command,
-				"reason":  msg,
-			})
-			return
+			slog.Info("machine created", "machine", fsm.Id())
+			ctx.JSON(http.StatusCreated, gin.H{"id": fsm.Id(), "state": fsm.CurrentState()})
 		}
 	})
 
-	s.server.GET("/events", func(c *gin.Context) {
-		c.Header("Connection", "Keep-Alive")
-		c.Header("Keep-Alive", "timeout=10, max=1000")
-		s.visitorTracker.Joined()
-		s.activeConnections.Add(1)
-		defer s.visitorTracker.Left()
-		defer s.activeConnections.Done()
-
-		ctx := c.Request.Context()
-		closeNotify := c.Writer.CloseNotify()
-
-		myEvents := s.events.Sub(Topic)
-		defer s.events.Unsub(myEvents, Topic)
-
-		streamOneEvent(c, NewSimpleEvent("StartedListening"))
-		streamOneEvent(c, NewEventWithParam("ConnectedToRegion", getFlyRegion()))
-		streamOneEvent(c, NewEventWithParam("Revision", versioninfo.Revision))
-		streamOneEvent(c, NewEventWithParam("LastSeenState", s.fsm.CurrentState()))
-		streamOneEvent(c, GetReplicasEvent(1))
-		streamOneEvent(c, NewEventWithParam("ConnectedToReplica", getPublicReplicaId()))
-
-		// callback returns false on end of processing
-		c.Stream(func(w io.Writer) bool {
-			select {
-			case <-s.serverContext.Done():
-				log.Printf("closing the connection: server shutting down")
-				return false
-
-			case <-ctx.Done():
-				log.Printf("client disconnected")
-				return false
-
-			case <-closeNotify:
-				log.Printf("client closed the connection")
-				return false
-
-			case event := <-myEvents:
-				streamOneEvent(c, event)
-
-				return true
-			}
-		})
+	machinesGroup.DELETE("/:id", s.requireRole(RoleOperator), func(ctx *gin.Context) {
+		id := ctx.Param("id")
+		err := s.deleteMachine(id)
+		switch {
+		case errors.Is(err, errMachineNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"id": id, "reason": err.Error()})
+		case err != nil:
+			ctx.JSON(http.StatusBadRequest, gin.H{"id": id, "reason": err.Error()})
+		default:
+			ctx.Status(http.StatusNoContent)
+		}
+	})
+
+	machineGroup := machinesGroup.Group("/:id", s.requireMachine)
+
+	machineGroup.GET("/state", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, machineOf(ctx).CurrentState())
 	})
 
-	if ClusterObservabilityEnabled {
-		s.setupClusterObservabilityRoutes()
+	machineGroup.GET("/diagram", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, machineOf(ctx).Diagram())
+	})
+
+	machineGroup.GET("/definition", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, machineOf(ctx).Definition())
+	})
+
+	machineGroup.GET("/history", func(ctx *gin.Context) {
+		s.getHistory(ctx, machineOf(ctx))
+	})
+
+	machineGroup.GET("/queue", func(ctx *gin.Context) {
+		getQueue(ctx, machineOf(ctx))
+	})
+
+	machineGroup.DELETE("/queue/:command_id", s.requireRole(RoleOperator), func(ctx *gin.Context) {
+		cancelQueued(ctx, machineOf(ctx))
+	})
+
+	machineGroup.POST("/commands/:command", func(ctx *gin.Context) {
+		s.postCommand(ctx, machineOf(ctx))
+	})
+
+	machineGroup.GET("/events", func(c *gin.Context) {
+		s.streamEvents(c, ndjsonFormat{}, machineOf(c))
+	})
+
+	machineGroup.GET("/events/sse", func(c *gin.Context) {
+		s.streamEvents(c, sseFormat{}, machineOf(c))
+	})
+
+	machineGroup.GET("/ws", func(c *gin.Context) {
+		s.serveWebsocket(c, machineOf(c))
+	})
+}
+
+type machineKey struct{}
+
+// requireMachine resolves the :id route parameter to a running machine
+func (s *Server) requireMachine(ctx *gin.Context) {
+	id := ctx.Param("id")
+	fsm, ok := s.machines.Get(id)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"id": id, "reason": errMachineNotFound.Error()})
+		return
 	}
+	ctx.Set(machineKey{}, fsm)
+	ctx.Next()
 }
 
-func (s *Server) setupClusterObservabilityRoutes() {
-	clusterGroup := s.server.Group("cluster")
-	// httpie> http -S http://localhost:8080/cluster/events
-	clusterGroup.GET("/events", func(c *gin.Context) {
-		c.Header("Connection", "Keep-Alive")
-		c.Header("Keep-Alive", "timeout=10, max=1000")
+func machineOf(ctx *gin.Context) *AsyncFSM {
+	return ctx.MustGet(machineKey{}).(*AsyncFSM)
+}
 
-		ctx := c.Request.Context()
-		closeNotify := c.Writer.CloseNotify()
+func (s *Server) postCommand(ctx *gin.Context, fsm *AsyncFSM) {
+	command := ctx.Param("command")
+	sourceReplicaId := strings.Join(ctx.Request.Header[http.CanonicalHeaderKey(SourceReplicaIdKey)], "")
+	slog.Info("command called", "machine", fsm.Id(), "command", command)
+	myReplicaId := getPublicReplicaId()
+	if sourceReplicaId != myReplicaId {
+		slog.Info("command and event stream replica id mismatch", "machine", fsm.Id(), "source_replica", sourceReplicaId)
+	}
+	ctx.Header(SourceReplicaIdKey, myReplicaId)
+	params, err := runParametersFrom(ctx)
+	if err != nil {
+		outcome := commandOutcome{CommandId: NewCommandId(), Result: CommandRejected, Command: command, Reason: "bad parameters: " + err.Error()}
+		ctx.Header(CommandIdKey, outcome.CommandId)
+		ctx.JSON(http.StatusBadRequest, outcome)
+		return
+	}
+	outcome := s.submitCommand(ctx.Request.Context(), fsm, command, params)
+	ctx.Header(CommandIdKey, outcome.CommandId)
+	if outcome.rateLimit != nil {
+		writeRateLimitHeaders(ctx, outcome.rateLimit)
+	}
+	switch outcome.Result {
+	case CommandUnauthorized:
+		s.challenge(ctx)
+		ctx.JSON(http.StatusUnauthorized, outcome)
+	case CommandForbidden:
+		ctx.JSON(http.StatusForbidden, outcome)
+	case CommandRateLimited:
+		ctx.JSON(http.StatusTooManyRequests, outcome)
+	case CommandRefused:
+		ctx.JSON(http.StatusServiceUnavailable, outcome)
+	case CommandRejected:
+		ctx.JSON(http.StatusBadRequest, outcome)
+	case CommandIgnored:
+		ctx.JSON(http.StatusConflict, outcome)
+	case CommandQueued:
+		ctx.JSON(http.StatusAccepted, outcome)
+	default:
+		ctx.JSON(http.StatusOK, outcome)
+	}
+}
 
-		myEvents := s.events.Sub(ClusterMessageTopic)
-		defer s.events.Unsub(myEvents, ClusterMessageTopic)
+const (
+	// the server is shutting down, the client should retry on another replica
+	CommandRefused CommandResult = "refused"
+	// the caller could not be authenticated
+	CommandUnauthorized CommandResult = "unauthorized"
+	// the caller lacks the role to send commands
+	CommandForbidden CommandResult = "forbidden"
+	// the caller has sent the command too often, and may retry later
+	CommandRateLimited CommandResult = "rate-limited"
+)
 
-		streamOneEvent(c, NewSimpleEvent("StartedListening"))
-		streamOneEvent(c, NewEventWithParam("ConnectedToRegion", getFlyRegion()))
-		streamOneEvent(c, GetReplicasEvent(1))
-		streamOneEvent(c, NewEventWithParam("ConnectedToReplica", getPublicReplicaId()))
+// commandOutcome tells the client what became of a submitted command
+type commandOutcome struct {
+	CommandId string        `json:"command_id"`
+	Result    CommandResult `json:"result"`
+	Command   string        `json:"command"`
+	Reason    string        `json:"reason,omitempty"`
+	// the limit the command was counted against, if any
+	rateLimit *limiter.Context
+}
 
-		// callback returns false on end of processing
-		c.Stream(func(w io.Writer) bool {
-			select {
-			case <-s.serverContext.Done():
-				log.Printf("closing the connection: server shutting down")
-				return false
+// runParametersFrom reads the optional JSON body of a command, rejecting the unknown fields as likely typos
+func runParametersFrom(ctx *gin.Context) (RunParameters, error) {
+	var params RunParameters
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil || len(bytes.TrimSpace(body)) == 0 {
+		return params, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	return params, decoder.Decode(&params)
+}
 
-			case <-ctx.Done():
-				log.Printf("client disconnected")
-				return false
+// submitCommand hands a known command over to the machine, whichever transport it came from,
+// and waits for the machine to take or ignore it
+func (s *Server) submitCommand(ctx context.Context, fsm *AsyncFSM, command string, params RunParameters) commandOutcome {
+	commandId := NewCommandId()
+	if s.isDraining() {
+		commandsTotal.WithLabelValues(knownCommandOrUnknown(fsm, command), string(CommandRefused)).Inc()
+		return commandOutcome{CommandId: commandId, Result: CommandRefused, Command: command, Reason: "server shutting down"}
+	}
+	if err := authorize(ctx, RoleOperator); err != nil {
+		result := CommandForbidden
+		if errors.Is(err, errUnauthorized) {
+			result = CommandUnauthorized
+		}
+		s.events.Pub(NewEventWithReason("CommandRejected", err.Error()).WithCommandId(commandId).OfMachine(fsm.Id()), fsm.Topic())
+		commandsTotal.WithLabelValues(knownCommandOrUnknown(fsm, command), string(result)).Inc()
+		return commandOutcome{CommandId: commandId, Result: result, Command: command, Reason: err.Error()}
+	}
+	limit, counted := s.takeCommand(ctx, fsm, command)
+	if counted && limit.Reached {
+		reason := rateLimitReason(commandRateLimit, limit)
+		s.events.Pub(NewEventWithProperties(RateLimitedEvent, map[string]any{
+			"reason":      reason,
+			"command":     command,
+			"retry_after": retryAfter(limit),
+		}).WithCommandId(commandId).OfMachine(fsm.Id()), fsm.Topic())
+		rateLimitedTotal.WithLabelValues(string(commandRateLimit)).Inc()
+		commandsTotal.WithLabelValues(knownCommandOrUnknown(fsm, command), string(CommandRateLimited)).Inc()
+		return commandOutcome{CommandId: commandId, Result: CommandRateLimited, Command: command, Reason: reason, rateLimit: limit}
+	}
+	outcome := s.dispatchCommand(ctx, commandId, fsm, command, params)
+	outcome.rateLimit = limit
+	return outcome
+}
 
-			case <-closeNotify:
-				log.Printf("client closed the connection")
-				return false
+// dispatchCommand hands the command over to the machine, unless it is unknown to it or its parameters are out of bounds
+func (s *Server) dispatchCommand(ctx context.Context, commandId string, fsm *AsyncFSM, command string, params RunParameters) commandOutcome {
+	if !fsm.Definition().HasCommand(command) {
+		msg := "unknown command: '" + command + "'"
+		s.events.Pub(NewEventWithReason("CommandRejected", msg).WithCommandId(commandId).OfMachine(fsm.Id()), fsm.Topic())
+		// arbitrary names would make for arbitrarily many series
+		commandsTotal.WithLabelValues("unknown", string(CommandRejected)).Inc()
+		return commandOutcome{CommandId: commandId, Result: CommandRejected, Command: command, Reason: msg}
+	}
+	if err := s.checkRunParameters(params); err != nil {
+		msg := "bad parameters: " + err.Error()
+		s.events.Pub(NewEventWithReason("CommandRejected", msg).WithCommandId(commandId).OfMachine(fsm.Id()), fsm.Topic())
+		commandsTotal.WithLabelValues(command, string(CommandRejected)).Inc()
+		return commandOutcome{CommandId: commandId, Result: CommandRejected, Command: command, Reason: msg}
+	}
+	result, reason := fsm.Submit(ctx, commandId, command, params)
+	return commandOutcome{CommandId: commandId, Result: result, Command: command, Reason: reason}
+}
 
-			case event := <-myEvents:
-				streamOneEvent(c, event)
+// checkRunParameters holds the parameters, if any, against the bounds of the config
+func (s *Server) checkRunParameters(params RunParameters) error {
+	if params.isZero() {
+		return nil
+	}
+	return params.validate(*s.runBounds.Load())
+}
 
-				return true
+// arbitrary names would make for arbitrarily many series
+func knownCommandOrUnknown(fsm *AsyncFSM, command string) string {
+	if fsm.Definition().HasCommand(command) {
+		return command
+	}
+	return "unknown"
+}
+
+// getQueue lists the work queued on the machine, next first
+func getQueue(ctx *gin.Context, fsm *AsyncFSM) {
+	ctx.JSON(http.StatusOK, gin.H{"machine": fsm.Id(), "queue": fsm.Queue()})
+}
+
+// cancelQueued removes the queued work of the command id
+func cancelQueued(ctx *gin.Context, fsm *AsyncFSM) {
+	id := ctx.Param("command_id")
+	if err := fsm.CancelQueued(id); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"command_id": id, "reason": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// getHistory lists the journaled events of the machine, optionally since an RFC3339 timestamp
+func (s *Server) getHistory(ctx *gin.Context, fsm *AsyncFSM) {
+	journal := s.machines.Journal()
+	if journal == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"reason": "no journal configured"})
+		return
+	}
+	var since time.Time
+	if sinceParam := ctx.Query("since"); sinceParam != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, sinceParam); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"reason": "since: " + err.Error()})
+			return
+		}
+	}
+	events, err := journal.Read(fsm.Id(), since)
+	if err != nil {
+		slog.Error("could not read the journal", "machine", fsm.Id(), "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"reason": "could not read the journal"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"machine": fsm.Id(), "events": events})
+}
+
+// streamEvents streams the events of the machine, or of the machines selected by the filter
+func (s *Server) streamEvents(c *gin.Context, format eventStreamFormat, fsm *AsyncFSM, initialEvents ...Event) {
+	filter, ok := eventFilterOf(c)
+	if !ok {
+		return
+	}
+	fsms := []*AsyncFSM{fsm}
+	if len(filter.Machines) > 0 {
+		fsms = []*AsyncFSM{}
+		for _, id := range filter.Machines {
+			selected, ok := s.machines.Get(id)
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"reason": errMachineNotFound.Error(), "machine": id})
+				return
 			}
-		})
+			fsms = append(fsms, selected)
+		}
+	}
+	s.streamMachineEvents(c, filteredFormat{format, filter}, fsms, initialEvents...)
+}
+
+// eventFilterOf responds with an error to bad filter parameters
+func eventFilterOf(c *gin.Context) (EventFilter, bool) {
+	filter, err := ParseEventFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"reason": err.Error()})
+		return filter, false
+	}
+	return filter, true
+}
+
+func (s *Server) streamMachineEvents(c *gin.Context, format eventStreamFormat, fsms []*AsyncFSM, initialEvents ...Event) {
+	format.begin(c)
+	s.visitorTracker.Joined()
+	s.activeConnections.Add(1)
+	defer s.visitorTracker.Left()
+	defer s.activeConnections.Done()
+
+	topics := []string{}
+	for _, fsm := range fsms {
+		topics = append(topics, fsm.Topic())
+	}
+	subscription := s.subscribe(c, topics...)
+	defer subscription.Close()
+
+	replayed := s.greetMachineSubscriber(c, format, fsms, initialEvents...)
+	s.pumpEvents(c, format, subscription.Events(), replayed, len(fsms))
+}
+
+// greetMachineSubscriber describes the machines to a new subscriber and replays the events it has missed,
+// returning their ids so that they are not streamed twice
+func (s *Server) greetMachineSubscriber(c *gin.Context, format eventStreamFormat, fsms []*AsyncFSM, initialEvents ...Event) map[uint64]bool {
+	writeLocalEvent(c, format, NewSimpleEvent("StartedListening"))
+	writeLocalEvent(c, format, NewEventWithParam("ConnectedToRegion", getFlyRegion()))
+	for _, event := range initialEvents {
+		writeLocalEvent(c, format, event)
+	}
+	for _, fsm := range fsms {
+		writeLocalEvent(c, format, NewEventWithParam("ConnectedToMachine", fsm.Id()).OfMachine(fsm.Id()))
+		writeLocalEvent(c, format, fsm.LastSeenState())
+		writeLocalEvent(c, format, NewEventWithParam(MachineDiagramEvent, fsm.Diagram()).OfMachine(fsm.Id()))
+	}
+	writeLocalEvent(c, format, GetReplicasEvent(1))
+	writeLocalEvent(c, format, NewEventWithParam("ConnectedToReplica", getPublicReplicaId()))
+	replayed := map[uint64]bool{}
+	for _, fsm := range fsms {
+		maps.Copy(replayed, s.replayMissedEvents(c, format, fsm))
+	}
+	return replayed
+}
+
+// replayMissedEvents streams the buffered events after the one the client has last seen,
+// returning their ids so that they are not streamed twice
+func (s *Server) replayMissedEvents(c *gin.Context, format eventStreamFormat, fsm *AsyncFSM) map[uint64]bool {
+	replayed := map[uint64]bool{}
+	lastEventId, ok := lastEventIdOf(c)
+	if !ok {
+		return replayed
+	}
+	replay, ok := s.machines.ReplayBuffer(fsm.Id())
+	if !ok {
+		return replayed
+	}
+	missed, complete := replay.Since(lastEventId)
+	if !complete {
+		writeLocalEvent(c, format, NewEventWithParam("ReplayIncomplete", lastEventId))
+	}
+	for _, event := range missed {
+		format.write(c, event)
+		replayed[event.Id] = true
+	}
+	slog.Info("replayed events", "count", len(missed), "after", lastEventId)
+	return replayed
+}
+
+// lastEventIdOf reads the id to resume from the Last-Event-ID header or the lastEventId query parameter
+func lastEventIdOf(c *gin.Context) (uint64, bool) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("lastEventId")
+	}
+	if value == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		slog.Warn("ignoring a bad last event id", "value", value)
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) setupClusterObservabilityRoutes() {
+	clusterGroup := s.server.Group("cluster", s.requireClusterObservability, s.requireRole(RoleAdmin))
+	// httpie> http -S http://localhost:8080/cluster/events
+	clusterGroup.GET("/events", func(c *gin.Context) {
+		s.streamClusterEvents(c, ndjsonFormat{})
 	})
+	clusterGroup.GET("/events/sse", func(c *gin.Context) {
+		s.streamClusterEvents(c, sseFormat{})
+	})
+}
+
+// requireClusterObservability hides the cluster routes while they are not enabled
+func (s *Server) requireClusterObservability(ctx *gin.Context) {
+	if !s.clusterObservabilityEnabled.Load() {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.Next()
 }
 
-func (s *Server) setupSignalHandler() {
+func (s *Server) streamClusterEvents(c *gin.Context, format eventStreamFormat) {
+	filter, ok := eventFilterOf(c)
+	if !ok {
+		return
+	}
+	format = filteredFormat{format, filter}
+	format.begin(c)
+
+	subscription := s.subscribe(c, ClusterMessageTopic)
+	defer subscription.Close()
+
+	writeLocalEvent(c, format, NewSimpleEvent("StartedListening"))
+	writeLocalEvent(c, format, NewEventWithParam("ConnectedToRegion", getFlyRegion()))
+	writeLocalEvent(c, format, GetReplicasEvent(1))
+	writeLocalEvent(c, format, NewEventWithParam("ConnectedToReplica", getPublicReplicaId()))
+
+	s.pumpEvents(c, format, subscription.Events(), map[uint64]bool{}, 0)
+}
+
+// shutdownOnSignal returns the server context, done once a signal to stop has been received
+func shutdownOnSignal() context.Context {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals,
 		syscall.SIGHUP,
@@ -235,21 +753,34 @@ func (s *Server) setupSignalHandler() {
 		syscall.SIGQUIT,
 	)
 	serverContext, triggerShutdown := context.WithCancel(context.Background())
-	s.serverContext = serverContext
 	go func() {
 		sig := <-signals
-		log.Printf("Received signal: %v, gracefully shutting down the server", sig)
+		slog.Info("gracefully shutting down the server", "signal", sig)
 		triggerShutdown()
 	}()
+	return serverContext
 }
 
+// WaitToDrainConnections shuts the server down once a signal has been received:
+// the streams are told and closed, no new commands are taken nor schedules fired, the HTTP server stops accepting connections,
+// and the visitor counters take in the last of the closed connections.
+// Whatever has not completed by the drain deadline is cut off
 func (s *Server) WaitToDrainConnections() {
 	// wait for global context to be cancelled
 	<-s.serverContext.Done()
-	// now wait for all connections to stop
-	log.Println("Waiting to close all connections...")
+	// the schedules due from now on are left to the next start
+	s.schedules.Stop()
+	slog.Info("waiting to close all connections", "deadline", s.config.DrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.DrainTimeout)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		slog.Warn("did not close all connections on time, forcing exit", "error", err)
+		s.httpServer.Close()
+	}
+	s.closeCertificateWatcher()
 
-	// but with a safe timeout
+	// the websockets have been hijacked from the HTTP server
 	done := make(chan bool, 1)
 	go func() {
 		s.activeConnections.Wait()
@@ -257,33 +788,38 @@ func (s *Server) WaitToDrainConnections() {
 	}()
 	select {
 	case <-done:
-		log.Println("All connections drained safely")
-	case <-time.After(time.Second):
-		log.Println("Did not close all connections on time. Forcing exit...")
+		slog.Info("all connections drained safely")
+	case <-ctx.Done():
+		slog.Warn("did not close all streams on time, forcing exit")
 	}
 
-	// allow counters to propagate (opportunistically)
-	time.Sleep(100 * time.Millisecond)
+	if err := s.peerSource.FlushSync(ctx); err != nil {
+		slog.Warn("could not flush the counters", "error", err)
+	}
 }
 
-func (s *Server) getUIUrl() string {
-	baseUrl := "http://localhost"
-	return fmt.Sprintf("%v:%v/ui", baseUrl, s.port)
+func (s *Server) isDraining() bool {
+	return s.serverContext.Err() != nil
 }
 
-func configureGin() *gin.Engine {
-	return gin.Default()
+// shuttingDownEvent tells a client to reconnect, and be routed to another replica
+func shuttingDownEvent() Event {
+	return NewEventWithProperties(ServerShuttingDownEvent, map[string]any{
+		"replica": getPublicReplicaId(),
+		"reason":  "server shutting down",
+	})
 }
 
-func streamOneEvent(c *gin.Context, event any) {
-	c.JSON(http.StatusOK, event)
-	c.String(http.StatusOK, "\n")
-	c.Writer.(http.Flusher).Flush()
+func (s *Server) getUIUrl() string {
+	baseUrl := "http://localhost"
+	if s.config.tlsEnabled() {
+		baseUrl = "https://localhost"
+	}
+	return fmt.Sprintf("%v:%v/ui", baseUrl, s.config.Port)
 }
 
-func init() {
-	if os.Getenv("MML_CLUSTER_OBSERVABILITY_ENABLED") == "true" {
-		log.Println("Cluster observability routes enabled")
-		ClusterObservabilityEnabled = true
-	}
+func configureGin() *gin.Engine {
+	engine := gin.New()
+	engine.Use(traceRequests(), requestLogger(), gin.Recovery())
+	return engine
 }
@@ -0,0 +1,103 @@
+package mermaidlive
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const machineSnapshotSuffix = ".machine.json"
+
+type RecoveryPolicy string
+
+const (
+	// continue the work in flight where it stopped
+	RecoverByResuming RecoveryPolicy = "resume"
+	// return to the initial state, explicitly abandoning the work in flight
+	RecoverByAborting RecoveryPolicy = "abort"
+)
+
+type MachineSnapshot struct {
+	Machine   string `json:"machine"`
+	State     string `json:"state"`
+	Count     uint8  `json:"count"`
+	Timestamp string `json:"timestamp"`
+	// the parameters of the countdown in progress, if any
+	Run *RunParameters `json:"run,omitempty"`
+	// the work waiting for the machine, if any
+	Queue []QueuedWork `json:"queue,omitempty"`
+}
+
+// StateStore persists the last known state of each machine
+type StateStore interface {
+	Save(snapshot MachineSnapshot) error
+	// Load reports false if there is no snapshot of the machine
+	Load(machine string) (MachineSnapshot, bool, error)
+	Delete(machine string) error
+	List() ([]string, error)
+}
+
+// FileStateStore keeps one JSON file per machine, e.g. next to the gcounter files
+type FileStateStore struct {
+	directory string
+}
+
+func NewFileStateStore(directory string) *FileStateStore {
+	return &FileStateStore{
+		directory: directory,
+	}
+}
+
+func (s *FileStateStore) Save(snapshot MachineSnapshot) error {
+	text, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	// write & rename to not leave a torn snapshot behind
+	tmp := s.filename(snapshot.Machine) + ".tmp"
+	if err := os.WriteFile(tmp, text, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename(snapshot.Machine))
+}
+
+func (s *FileStateStore) Load(machine string) (MachineSnapshot, bool, error) {
+	var snapshot MachineSnapshot
+	text, err := os.ReadFile(s.filename(machine))
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, false, nil
+	}
+	if err != nil {
+		return snapshot, false, err
+	}
+	if err := json.Unmarshal(text, &snapshot); err != nil {
+		return snapshot, false, err
+	}
+	return snapshot, true, nil
+}
+
+func (s *FileStateStore) Delete(machine string) error {
+	err := os.Remove(s.filename(machine))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStateStore) List() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.directory, "*"+machineSnapshotSuffix))
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, f := range files {
+		res = append(res, strings.TrimSuffix(filepath.Base(f), machineSnapshotSuffix))
+	}
+	return res, nil
+}
+
+func (s *FileStateStore) filename(machine string) string {
+	return filepath.Join(s.directory, machine+machineSnapshotSuffix)
+}
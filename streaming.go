@@ -0,0 +1,152 @@
+package mermaidlive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sseRetryMillis = 5000
+const sseHeartbeatInterval = 15 * time.Second
+
+// eventStreamFormat writes events onto a long-lived response
+type eventStreamFormat interface {
+	begin(c *gin.Context)
+	write(c *gin.Context, event Event)
+	heartbeat(c *gin.Context)
+}
+
+// ndjsonFormat streams one JSON event per line
+type ndjsonFormat struct{}
+
+func (ndjsonFormat) begin(c *gin.Context) {
+	c.Header("Connection", "Keep-Alive")
+	c.Header("Keep-Alive", "timeout=10, max=1000")
+}
+
+func (ndjsonFormat) write(c *gin.Context, event Event) {
+	streamOneEvent(c, event)
+}
+
+func (ndjsonFormat) heartbeat(_ *gin.Context) {}
+
+// sseFormat streams Server-Sent Events: https://html.spec.whatwg.org/multipage/server-sent-events.html
+type sseFormat struct{}
+
+func (sseFormat) begin(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// disable response buffering in proxies such as nginx
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", sseRetryMillis)
+	c.Writer.Flush()
+}
+
+func (sseFormat) write(c *gin.Context, event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("could not serialize the event", "event", event.Name, "error", err)
+		return
+	}
+	var b strings.Builder
+	if event.Id != 0 {
+		fmt.Fprintf(&b, "id: %d\n", event.Id)
+	}
+	// names are identifiers, but a line break would end the field
+	fmt.Fprintf(&b, "event: %s\n", strings.ReplaceAll(event.Name, "\n", " "))
+	// JSON does not contain raw line breaks, hence a single data line
+	fmt.Fprintf(&b, "data: %s\n\n", data)
+	io.WriteString(c.Writer, b.String())
+	c.Writer.Flush()
+}
+
+func (sseFormat) heartbeat(c *gin.Context) {
+	io.WriteString(c.Writer, ": heartbeat\n\n")
+	c.Writer.Flush()
+}
+
+// writeLocalEvent writes an event only meant for this connection,
+// without an id, so that it does not move the point the client would resume from
+func writeLocalEvent(c *gin.Context, format eventStreamFormat, event Event) {
+	event.Id = 0
+	format.write(c, event)
+}
+
+// subscribe queues the events of the topics for the client, see Subscription
+func (s *Server) subscribe(c *gin.Context, topics ...string) *Subscription {
+	return Subscribe(s.events,
+		c.ClientIP()+" "+c.Request.URL.Path,
+		s.config.SubscriberQueueDepth,
+		s.config.SubscriberOverflow,
+		s.isCoalescible,
+		topics...,
+	)
+}
+
+// isCoalescible tells the events of which only the latest matters to a lagging client
+func (s *Server) isCoalescible(event Event) bool {
+	return event.Name == MachineDiagramEvent || s.machines.definition.isTickEvent(event.Name)
+}
+
+// pumpEvents streams the subscribed events until the client or the server goes away,
+// or all the streamed machines have been deleted.
+// Events that have been replayed after subscribing are skipped
+func (s *Server) pumpEvents(c *gin.Context, format eventStreamFormat, events chan Event, replayed map[uint64]bool, machines int) {
+	ctx := c.Request.Context()
+	closeNotify := c.Writer.CloseNotify()
+	heartbeat := time.NewTicker(s.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	// callback returns false on end of processing
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-s.serverContext.Done():
+			slog.Info("closing the connection: server shutting down")
+			writeLocalEvent(c, format, shuttingDownEvent())
+			return false
+
+		case <-ctx.Done():
+			slog.Info("client disconnected")
+			return false
+
+		case <-closeNotify:
+			slog.Info("client closed the connection")
+			return false
+
+		case <-heartbeat.C:
+			format.heartbeat(c)
+			return true
+
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			if replayed[event.Id] {
+				delete(replayed, event.Id)
+				return true
+			}
+			deliverEvent(c, format, event)
+
+			if event.Name == MachineDeletedEvent {
+				// nothing more to come from a deleted machine
+				machines--
+				return machines > 0
+			}
+			return true
+		}
+	})
+}
+
+func streamOneEvent(c *gin.Context, event any) {
+	c.JSON(http.StatusOK, event)
+	c.String(http.StatusOK, "\n")
+	c.Writer.(http.Flusher).Flush()
+}
@@ -0,0 +1,180 @@
+package mermaidlive
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cskr/pubsub/v2"
+)
+
+const SubscriberLaggedEvent = "SubscriberLagged"
+
+// OverflowPolicy decides what happens to the events of a subscriber whose queue is full
+type OverflowPolicy string
+
+const (
+	// drop the oldest queued event
+	DropOldest OverflowPolicy = "drop-oldest"
+	// drop the subscriber, which may reconnect and resume from its last event id
+	DropAndDisconnect OverflowPolicy = "disconnect"
+	// keep only the latest of the queued ticks and diagrams of each machine, else drop the oldest event
+	CoalesceTicks OverflowPolicy = "coalesce-ticks"
+)
+
+var lastSubscriptionId atomic.Uint64
+
+// the live subscriptions by id, for the metrics
+var activeSubscriptions sync.Map
+
+// Subscription drains the pubsub channel of one client into a bounded queue,
+// so that a stalled client cannot hold up the publishers and the other clients
+type Subscription struct {
+	id          uint64
+	name        string
+	events      *pubsub.PubSub[string, Event]
+	topics      []string
+	in          chan Event
+	out         chan Event
+	capacity    int
+	policy      OverflowPolicy
+	coalescible func(Event) bool
+	queue       []Event
+	lagging     bool
+	dropped     int
+	// the queue length readable from outside the run loop
+	queued atomic.Int64
+}
+
+// Subscribe starts a subscription to the topics, the name tells the operators who lags
+func Subscribe(events *pubsub.PubSub[string, Event],
+	name string,
+	capacity int,
+	policy OverflowPolicy,
+	coalescible func(Event) bool,
+	topics ...string) *Subscription {
+	s := &Subscription{
+		id:          lastSubscriptionId.Add(1),
+		name:        name,
+		events:      events,
+		topics:      topics,
+		in:          events.Sub(topics...),
+		out:         make(chan Event),
+		capacity:    max(capacity, 1),
+		policy:      policy,
+		coalescible: coalescible,
+		queue:       []Event{},
+	}
+	activeSubscriptions.Store(s.id, s)
+	go s.run()
+	return s
+}
+
+// Events delivers the queued events, and is closed if the subscriber has been disconnected
+func (s *Subscription) Events() chan Event {
+	return s.out
+}
+
+// Close must be called from the consuming goroutine once done
+func (s *Subscription) Close() {
+	// the pubsub closes the channel, ending the run loop, which keeps draining till then
+	s.events.Unsub(s.in, s.topics...)
+}
+
+func (s *Subscription) run() {
+	defer activeSubscriptions.Delete(s.id)
+	disconnected := false
+	for {
+		s.queued.Store(int64(len(s.queue) + len(s.in)))
+		var out chan Event
+		var next Event
+		if len(s.queue) > 0 && !disconnected {
+			out, next = s.out, s.queue[0]
+		}
+		select {
+		case event, ok := <-s.in:
+			if !ok {
+				if !disconnected {
+					close(s.out)
+				}
+				return
+			}
+			if disconnected {
+				continue
+			}
+			if !s.enqueue(event) {
+				disconnected = true
+				s.queue = nil
+				close(s.out)
+			}
+		case out <- next:
+			s.queue = s.queue[1:]
+			if len(s.queue) == 0 {
+				// caught up
+				s.lagging = false
+			}
+		}
+	}
+}
+
+// enqueue reports false if the subscriber is to be disconnected
+func (s *Subscription) enqueue(event Event) bool {
+	if len(s.queue) < s.capacity {
+		s.queue = append(s.queue, event)
+		return true
+	}
+	switch s.policy {
+	case DropAndDisconnect:
+		s.lagged(1)
+		return false
+	case CoalesceTicks:
+		if s.coalescible != nil && s.coalescible(event) {
+			before := len(s.queue)
+			s.queue = slices.DeleteFunc(s.queue, func(queued Event) bool {
+				return queued.Name == event.Name && queued.Machine == event.Machine
+			})
+			if dropped := before - len(s.queue); dropped > 0 {
+				s.lagged(dropped)
+				s.queue = append(s.queue, event)
+				return true
+			}
+		}
+	}
+	s.lagged(1)
+	s.queue = append(s.queue[1:], event)
+	return true
+}
+
+// lagged announces the start of each lagging episode
+func (s *Subscription) lagged(dropped int) {
+	s.dropped += dropped
+	droppedEventsTotal.WithLabelValues(string(s.policy)).Add(float64(dropped))
+	if s.lagging {
+		return
+	}
+	s.lagging = true
+	laggedSubscribersTotal.WithLabelValues(string(s.policy)).Inc()
+	slog.Warn("subscriber lagged", "subscriber", s.id, "client", s.name, "policy", s.policy, "dropped", s.dropped)
+	// the event is public, the address of the client is only logged
+	event := NewEventWithProperties(SubscriberLaggedEvent, map[string]any{
+		"subscriber": s.id,
+		"policy":     string(s.policy),
+		"dropped":    s.dropped,
+	})
+	// publishing waits for the pubsub, which might be delivering to this very subscription
+	go s.events.Pub(event, Topic)
+}
+
+// subscriptionQueueStats sums up and finds the longest of the queues of the live subscriptions,
+// including the events still waiting in the pubsub channels
+func subscriptionQueueStats() (count, queued, longest int) {
+	activeSubscriptions.Range(func(_, value any) bool {
+		depth := int(value.(*Subscription).queued.Load())
+		count++
+		queued += depth
+		longest = max(longest, depth)
+		return true
+	})
+	return
+}
@@ -0,0 +1,167 @@
+package mermaidlive
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// kept next to the counters, so that a browser exception for the certificate outlives a restart
+const devCertificateFile = "dev-cert.pem"
+const devKeyFile = "dev-key.pem"
+const devCertificateValidity = 90 * 24 * time.Hour
+
+// a dev certificate expiring sooner is replaced on start
+const devCertificateRenewal = 30 * 24 * time.Hour
+
+// configureTLS serves HTTP/2 and HTTP/1.1 over TLS with the certificate of the files or, for development,
+// a self-signed one. Many event streams of a browser then share a connection
+func (s *Server) configureTLS() error {
+	certFile, keyFile := s.config.TLSCertFile, s.config.TLSKeyFile
+	if s.config.TLSSelfSigned {
+		var err error
+		if certFile, keyFile, err = ensureDevCertificate(s.config.CounterDirectory); err != nil {
+			return err
+		}
+	}
+	certificate, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	// watched for as long as the server runs, see closeCertificateWatcher
+	if s.certificateWatcher, err = watchFiles([]string{certFile, keyFile}, certificate.reload); err != nil {
+		slog.Warn("not reloading the certificate on change", "error", err)
+	}
+	s.httpServer.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificate.get,
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	s.httpServer.Protocols = protocols
+	return nil
+}
+
+func (s *Server) closeCertificateWatcher() {
+	if s.certificateWatcher != nil {
+		s.certificateWatcher.Close()
+	}
+}
+
+// certificateReloader serves the certificate of the files, as last loaded
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	res := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := res.load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *certificateReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate.Store(&certificate)
+	slog.Info("certificate loaded", "file", r.certFile, "not_after", certificate.Leaf.NotAfter)
+	return nil
+}
+
+// reload keeps serving the previous certificate if the files are, perhaps only for now, unusable
+func (r *certificateReloader) reload() {
+	if err := r.load(); err != nil {
+		slog.Error("could not reload the certificate, keeping the previous one", "file", r.certFile, "error", err)
+	}
+}
+
+func (r *certificateReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate.Load(), nil
+}
+
+// ensureDevCertificate creates a self-signed certificate in the directory, unless there is one not about to expire
+func ensureDevCertificate(directory string) (string, string, error) {
+	certFile, keyFile := filepath.Join(directory, devCertificateFile), filepath.Join(directory, devKeyFile)
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if time.Until(pair.Leaf.NotAfter) > devCertificateRenewal {
+			return certFile, keyFile, nil
+		}
+		slog.Warn("replacing the expiring dev certificate", "file", certFile, "not_after", pair.Leaf.NotAfter)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("replacing the dev certificate", "file", certFile, "error", err)
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	if err := writeSelfSignedCertificate(certFile, keyFile, hosts, devCertificateValidity); err != nil {
+		return "", "", err
+	}
+	slog.Warn("serving a self-signed certificate, only fit for development", "file", certFile, "hosts", hosts)
+	return certFile, keyFile, nil
+}
+
+func writeSelfSignedCertificate(certFile, keyFile string, hosts []string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"mermaidlive development"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// the key first, so that the certificate is not reloaded with the previous key
+	if err := writePem(keyFile, "PRIVATE KEY", keyDer, 0o600); err != nil {
+		return err
+	}
+	return writePem(certFile, "CERTIFICATE", der, 0o644)
+}
+
+func writePem(filename, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
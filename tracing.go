@@ -0,0 +1,135 @@
+package mermaidlive
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/d-led/mermaidlive"
+
+// delegates to the global tracer provider, a no-op until ConfigureTracing replaces it
+var tracer = otel.Tracer(tracerName)
+
+// ConfigureTracing exports the spans as chosen by the traces exporter, OTEL_TRACES_EXPORTER:
+//   - none (default): no spans are recorded
+//   - otlp: OTLP over HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables,
+//     e.g. OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318 for a local collector
+//   - console or stdout: pretty-printed onto stdout
+//
+// The returned function flushes the pending spans
+func ConfigureTracing(ctx context.Context, config Config) func(context.Context) error {
+	// the trace context is propagated even if this replica does not export
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	exporter, err := newSpanExporter(ctx, config.TracesExporter)
+	if err != nil {
+		slog.Error("could not create the span exporter, not tracing", "error", err)
+		return noOpShutdown
+	}
+	if exporter == nil {
+		return noOpShutdown
+	}
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceName("mermaidlive"),
+			semconv.ServiceInstanceID(getPublicReplicaId()),
+			semconv.CloudRegion(getFlyRegion()),
+		),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		slog.Warn("incomplete tracing resource", "error", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("tracing", "exporter", config.TracesExporter)
+	return provider.Shutdown
+}
+
+func newSpanExporter(ctx context.Context, exporter string) (sdktrace.SpanExporter, error) {
+	switch exporter {
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	case "console", "stdout":
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, nil
+	}
+}
+
+func noOpShutdown(context.Context) error {
+	return nil
+}
+
+// traceRequests continues the trace of the caller, if any, with a span per request
+func traceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		propagator := otel.GetTextMapPropagator()
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		// lets the caller look the trace up
+		propagator.Inject(ctx, propagation.HeaderCarrier(c.Writer.Header()))
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, c.Errors.String())
+		}
+	}
+}
+
+// deliverEvent writes the event to one client in a span continuing the trace of its publication,
+// linked to the span of the streaming request
+func deliverEvent(c *gin.Context, format eventStreamFormat, event Event) {
+	if !event.spanContext.IsValid() {
+		format.write(c, event)
+		return
+	}
+	_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), event.spanContext),
+		"deliver "+event.Name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(trace.LinkFromContext(c.Request.Context())),
+		trace.WithAttributes(
+			attribute.Int64("event.id", int64(event.Id)),
+			attribute.String("machine", event.Machine),
+			attribute.String("command_id", event.CommandId),
+			semconv.ClientAddress(c.ClientIP()),
+			semconv.URLPath(c.Request.URL.Path),
+		),
+	)
+	defer span.End()
+	format.write(c, event)
+}
@@ -3,7 +3,7 @@ package mermaidlive
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -53,7 +53,7 @@ func (l *TraefikPeerLocator) GetPeers() ([]string, int, error) {
 	for server, status := range replicas.ServerStatus {
 		ip, err := getIPOf(server)
 		if err != nil {
-			log.Printf("Could not extract IP from '%s'", server)
+			slog.Warn("could not extract the IP", "peer", server)
 		}
 		if strings.ToLower(status) != "up" {
 			// no need to talk to replicas that are not up
@@ -70,7 +70,7 @@ func (l *TraefikPeerLocator) GetPeers() ([]string, int, error) {
 func (l *TraefikPeerLocator) GetMyIP() string {
 	myIP, err := getMyIPv4()
 	if err != nil {
-		log.Printf("Could not get my ip: %v", err)
+		slog.Error("could not get my IP", "error", err)
 		return ""
 	}
 	return myIP
@@ -1,7 +1,7 @@
 package mermaidlive
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 
@@ -9,7 +9,7 @@ import (
 )
 
 func Refresh() {
-	log.Printf("transpiling & copying: %v, %v", staticFilesToCopy(), esbuildEntrypoints())
+	slog.Info("transpiling & copying", "static", staticFilesToCopy(), "entrypoints", esbuildEntrypoints())
 	transpile()
 	copyStatic()
 }
@@ -47,9 +47,8 @@ func staticFilesToCopy() []string {
 	var res = []string{
 		"index.html",
 		"index.css",
-	}
-	if ClusterObservabilityEnabled {
-		res = append(res, "cluster.html")
+		// served once the cluster observability routes are enabled
+		"cluster.html",
 	}
 	return res
 }
@@ -57,9 +56,7 @@ func staticFilesToCopy() []string {
 func esbuildEntrypoints() []string {
 	var res = []string{
 		filepath.Join(uiSrc, "index.ts"),
-	}
-	if ClusterObservabilityEnabled {
-		res = append(res, filepath.Join(uiSrc, "cluster.ts"))
+		filepath.Join(uiSrc, "cluster.ts"),
 	}
 	return res
 }
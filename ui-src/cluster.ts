@@ -1,88 +1,52 @@
 console.log(`loaded cluster.js`);
 
+import { openEventStream } from "./common";
+
 var lastInput = "";
 var clusterEvents: { from: string; to: string; arrowText: string }[] = [];
 
 const doCorrectMissingIdentities = true;
 
+const reconnectDelaySeconds = 5; // seconds
+
+const clusterEventNames = [
+  "StartedListening",
+  "ConnectedToRegion",
+  "ResourcesRefreshed",
+  "VisitorsActive",
+  "TotalClusterVisitorsActive",
+  "ReplicasActive",
+  "ConnectedToReplica",
+  "TotalVisitors",
+  "ClusterMessage",
+];
+
 $(async function () {
   await reRenderGraph();
 
   console.log("done");
 
-  while (true) {
-    console.log("subscribing");
-    try {
-      await subscribeToEvents();
-    } catch (err) {
-      console.log("ERROR:", err?.message ?? err);
-    }
-    showDisconnectedAlert();
-    console.log("waiting before reconnecting...");
-    await sleep(5);
-  }
+  subscribeToEvents();
 });
 
-async function subscribeToEvents() {
-  await subscribe("/cluster/events", processEvent);
-}
-
-async function subscribe(
-  streamUrl: string,
-  processingFunc: (event: any) => Promise<void>,
-) {
-  let response = await fetch(streamUrl);
-
-  if (response.status == 502) {
-    // reconnect on timeout
-    showDisconnectedAlert();
-    await subscribe(streamUrl, processingFunc);
-  } else if (response.status != 200) {
-    // errored!
-    showDisconnectedAlert();
-    console.log("ERROR:", response.statusText);
-    // reconnect
-    await sleep(3);
-    await subscribe(streamUrl, processingFunc);
-  } else {
-    hideDisconnectedAlert();
-    flashConnectedAlert();
-    // Get and show the message
-    const reader = response?.body?.getReader();
-    if (!reader) {
-      console.log("ERROR: failed to read the messages");
-    } else {
-      // read all messages
-      let currentMessage = "";
-      while (true) {
-        let chunk = await reader.read();
-        if (chunk.done) {
-          break;
-        }
-        currentMessage += new TextDecoder("utf-8").decode(chunk.value);
-        let endlineAt = -1;
-        do {
-          endlineAt = currentMessage.indexOf("\n");
-          if (endlineAt === -1) {
-            break;
-          }
-          let messageToProcess = currentMessage.substring(0, endlineAt);
-          currentMessage = currentMessage.substring(endlineAt + 1);
-          try {
-            let message = JSON.parse(messageToProcess);
-
-            await processingFunc(message);
-          } catch (err) {
-            console.log("MESSAGE WAS:", messageToProcess);
-            console.log("ERROR:", err?.message ?? err);
-          }
-        } while (true);
+function subscribeToEvents() {
+  console.log("subscribing");
+  openEventStream("/cluster/events/sse", clusterEventNames, {
+    onEvent: processEvent,
+    onOpen: () => {
+      hideDisconnectedAlert();
+      flashConnectedAlert();
+    },
+    onError: (source) => {
+      showDisconnectedAlert();
+      if (source.readyState !== EventSource.CLOSED) {
+        // the browser is reconnecting by itself
+        return;
       }
-    }
-    // Call subscribe again to try to reconnect
-    await sleep(1);
-    await subscribe(streamUrl, processingFunc);
-  }
+      console.log("waiting before reconnecting...");
+      setTimeout(subscribeToEvents, reconnectDelaySeconds * 1000);
+    },
+  });
 }
 
 function replaceText(selector, text: string) {
@@ -121,10 +85,6 @@ function showTotalVisitors(count: number) {
   replaceText("#total-visitors", `${count}`);
 }
 
-async function sleep(seconds: number) {
-  await new Promise((resolve) => setTimeout(resolve, seconds * 1000 /*ms*/));
-}
-
 async function processEvent(event) {
   if (!event.name) {
     return;
@@ -1 +1,35 @@
 export const sourceReplicaIdKey = "Source-Replica-Id";
+
+export type EventStreamHandlers = {
+  onEvent: (event: any) => Promise<void>;
+  onOpen: () => void;
+  onError: (source: EventSource) => void;
+};
+
+// EventSource only dispatches named events to the listeners registered for them,
+// hence the names of the expected events. Each event carries the full JSON as data.
+// The browser reconnects by itself, sending the last seen id as Last-Event-ID
+export function openEventStream(
+  url: string,
+  eventNames: string[],
+  handlers: EventStreamHandlers,
+): EventSource {
+  const source = new EventSource(url);
+  // process the events one after another, as rendering is asynchronous
+  let processing = Promise.resolve();
+  const dispatch = (message: MessageEvent) => {
+    processing = processing.then(async () => {
+      try {
+        await handlers.onEvent(JSON.parse(message.data));
+      } catch (err) {
+        console.log("MESSAGE WAS:", message.data);
+        console.log("ERROR:", err?.message ?? err);
+      }
+    });
+  };
+  source.addEventListener("message", dispatch);
+  new Set(eventNames).forEach((name) => source.addEventListener(name, dispatch));
+  source.onopen = handlers.onOpen;
+  source.onerror = () => handlers.onError(source);
+  return source;
+}
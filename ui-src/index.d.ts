@@ -1,6 +1,7 @@
 declare global {
   interface Document {
     lastInput: any;
+    lastEventId: number | null;
   }
   const mermaid: any;
 }
@@ -2,12 +2,45 @@ console.log(`loaded index.js`);
 
 document.lastInput = "";
 document.myReplica = null;
+document.lastEventId = null;
 
-import { sourceReplicaIdKey } from "./common";
+import { openEventStream, sourceReplicaIdKey } from "./common";
 
 let isTabVisible = true;
+let eventStream: EventSource | null = null;
+let machineEventNames: string[] = [];
 
 const reconnectDelaySeconds = 5; // seconds
+// spreads the clients of a replica shutting down over the remaining ones
+const maxShutdownReconnectDelayMs = 1000;
+
+// events sent regardless of the machine definition
+const streamEventNames = [
+  "StartedListening",
+  "ConnectedToRegion",
+  "ConnectedToMachine",
+  "ConnectedToReplica",
+  "LastSeenState",
+  "MachineDiagram",
+  "MachineDeleted",
+  "WorkRecovered",
+  "WorkQueued",
+  "WorkDequeued",
+  "ScheduledCommandFired",
+  "ReplayIncomplete",
+  "ServerShuttingDown",
+  "SubscriberLagged",
+  "RequestIgnored",
+  "CommandRejected",
+  "RateLimited",
+  "ResourcesRefreshed",
+  "ConfigReloaded",
+  "VisitorsActive",
+  "TotalClusterVisitorsActive",
+  "ReplicasActive",
+  "TotalVisitors",
+  "Revision",
+];
 
 $(async function () {
   // listen to the user leaving the tab
@@ -16,90 +49,95 @@ $(async function () {
     console.log(
       `Tab visibility changed: ${isTabVisible ? "visible" : "hidden"}`,
     );
+    if (isTabVisible) {
+      subscribeToEvents();
+    } else {
+      unsubscribeFromEvents();
+    }
   });
 
-  await reRenderGraph("waiting", "");
+  await fetchAndRenderGraph();
+  machineEventNames = await fetchMachineEventNames();
 
   console.log("done");
 
-  while (true) {
-    if (!isTabVisible) {
-      console.log("Tab is not visible. Not reconnecting for now...");
-      await sleep(reconnectDelaySeconds); // Check periodically if the tab becomes visible
-      continue;
-    }
+  subscribeToEvents();
+});
 
-    console.log("subscribing");
-    try {
-      await subscribeToEvents();
-    } catch (err) {
-      console.log("ERROR:", err?.message ?? err);
-    }
-    showDisconnectedAlert();
-    console.log("waiting before reconnecting...");
-    await sleep(reconnectDelaySeconds);
+function subscribeToEvents() {
+  if (eventStream != null || !isTabVisible) {
+    return;
   }
-});
+  console.log("subscribing");
+  eventStream = openEventStream(
+    eventStreamUrl(),
+    streamEventNames.concat(machineEventNames),
+    {
+      onEvent: processEvent,
+      onOpen: () => {
+        hideDisconnectedAlert();
+        flashConnectedAlert();
+      },
+      onError: (source) => {
+        showDisconnectedAlert();
+        if (source.readyState !== EventSource.CLOSED) {
+          // the browser is reconnecting by itself
+          return;
+        }
+        // e.g. an error response: start over after a while
+        console.log("waiting before reconnecting...");
+        if (eventStream === source) {
+          eventStream = null;
+        }
+        setTimeout(subscribeToEvents, reconnectDelaySeconds * 1000);
+      },
+    },
+  );
+}
 
-async function subscribeToEvents() {
-  await subscribe("/events", processEvent);
+function reconnectElsewhere() {
+  console.log("the replica is shutting down, reconnecting...");
+  eventStream?.close();
+  eventStream = null;
+  setTimeout(subscribeToEvents, Math.random() * maxShutdownReconnectDelayMs);
 }
 
-async function subscribe(
-  streamUrl: string,
-  processingFunc: (event: any) => Promise<void>,
-) {
-  let response = await fetch(streamUrl);
-
-  if (response.status == 502) {
-    // reconnect on timeout
-    showDisconnectedAlert();
-    await subscribe(streamUrl, processingFunc);
-  } else if (response.status != 200) {
-    // errored!
-    showDisconnectedAlert();
-    console.log("ERROR:", response.statusText);
-    // reconnect
-    await sleep(3);
-    await subscribe(streamUrl, processingFunc);
-  } else {
-    hideDisconnectedAlert();
-    flashConnectedAlert();
-    // Get and show the message
-    const reader = response?.body?.getReader();
-    if (!reader) {
-      console.log("ERROR: failed to read the messages");
-    } else {
-      // read all messages
-      let currentMessage = "";
-      while (true) {
-        let chunk = await reader.read();
-        if (chunk.done) {
-          break;
-        }
-        currentMessage += new TextDecoder("utf-8").decode(chunk.value);
-        let endlineAt = -1;
-        do {
-          endlineAt = currentMessage.indexOf("\n");
-          if (endlineAt === -1) {
-            break;
-          }
-          let messageToProcess = currentMessage.substring(0, endlineAt);
-          currentMessage = currentMessage.substring(endlineAt + 1);
-          try {
-            let message = JSON.parse(messageToProcess);
-
-            await processingFunc(message);
-          } catch (err) {
-            console.log("MESSAGE WAS:", messageToProcess);
-            console.log("ERROR:", err?.message ?? err);
-          }
-        } while (true);
-      }
-    }
-    // Call subscribe again to try to reconnect
-    await sleep(1);
-    await subscribe(streamUrl, processingFunc);
+function unsubscribeFromEvents() {
+  console.log("Tab is not visible. Disconnecting for now...");
+  eventStream?.close();
+  eventStream = null;
+}
+
+// resume after the last event seen to not miss any while disconnected
+function eventStreamUrl(): string {
+  if (document.lastEventId == null) {
+    return "/events/sse";
+  }
+  return `/events/sse?lastEventId=${document.lastEventId}`;
+}
+
+// the events published by the machine depend on its definition
+async function fetchMachineEventNames(): Promise<string[]> {
+  try {
+    const response = await fetch("/machine/definition");
+    const definition = await response.json();
+    const names: string[] = [];
+    definition?.transitions?.forEach((t) => t.event && names.push(t.event));
+    definition?.states?.forEach(
+      (s) => s.countdown && names.push(s.tick_event || "Tick"),
+    );
+    return names;
+  } catch (err) {
+    console.log("ERROR: fetching the machine definition:", err?.message ?? err);
+    return [
+      "WorkStarted",
+      "WorkPaused",
+      "WorkResumed",
+      "WorkAbortRequested",
+      "WorkDone",
+      "WorkAborted",
+      "Tick",
+    ];
   }
 }
 
@@ -115,6 +153,22 @@ function showLastEvent(text: string) {
   replaceText("#last-event", text);
 }
 
+// the run in progress, as echoed by the event starting it
+let run: { ticks?: number; label?: string } = {};
+
+function showProgress(count?: number) {
+  if (count == null || !run.ticks) {
+    replaceText("#progress", "");
+    return;
+  }
+  const label = run.label ? ` (${run.label})` : "";
+  replaceText("#progress", `${count}/${run.ticks}${label}`);
+}
+
+function showQueued(count?: number) {
+  replaceText("#queued", count ? `${count}` : "");
+}
+
 function showVisitorsActive(count: number) {
   if (count == null) {
     return;
@@ -154,43 +208,77 @@ function bindGraphClicks() {
   });
 }
 
-async function sleep(seconds: number) {
-  await new Promise((resolve) => setTimeout(resolve, seconds * 1000 /*ms*/));
-}
-
 async function processEvent(event) {
   if (!event.name) {
     return;
   }
 
+  if (event.id) {
+    document.lastEventId = event.id;
+  }
+
   console.log("INCOMING_EVENT:", event);
 
   let eventLine = formatEventIntoOneLine(event);
 
   switch (event.name) {
-    case "WorkDone":
-    case "WorkAborted":
-      await reRenderGraph("waiting", "");
-      break;
+    case "MachineDiagram":
+      // the server owns the machine topology and highlights the current state
+      await reRenderGraph(`${event?.properties?.param}`);
+      // do not show this event in the log
+      return;
     case "WorkStarted":
-      await reRenderGraph("working", `...`);
+      run = { ticks: event?.properties?.ticks, label: event?.properties?.label };
+      showProgress(run.ticks);
       break;
     case "LastSeenState":
-      let state = `${event?.properties?.param}`;
-      console.log(`rendering last seen state: ${state}`);
-      await reRenderGraph(state, "");
+      run = { ticks: event?.properties?.ticks, label: event?.properties?.label };
+      // a paused run reports the remaining ticks
+      showProgress(event?.properties?.count ?? event?.properties?.remaining);
+      showQueued(event?.properties?.queued);
+      break;
+    case "WorkQueued":
+      showQueued(event?.properties?.position);
+      break;
+    case "WorkDequeued":
+      showQueued(event?.properties?.queued);
+      break;
+    case "WorkPaused":
+    case "WorkResumed":
+      showProgress(event?.properties?.remaining);
       break;
     case "Tick":
-      await reRenderGraph("working", ` ${event?.properties?.param}`);
+      showProgress(event?.properties?.param);
+      break;
+    case "WorkDone":
+    case "WorkAborted":
+      run = {};
+      showProgress();
       break;
     case "WorkAbortRequested":
-      await reRenderGraph("aborting", "");
+      break;
+    case "ScheduledCommandFired":
+      // the events of an accepted or queued command follow
+      if (!["accepted", "queued"].includes(event?.properties?.result)) {
+        showLastError(eventLine);
+      }
       break;
     case "RequestIgnored":
     case "CommandRejected":
+    case "RateLimited":
       showLastError(eventLine);
       // do nothing
       break;
+    case "SubscriberLagged":
+      // some events of a slow subscriber have been dropped
+      break;
+    case "ServerShuttingDown":
+      // the load balancer routes the new stream to another replica
+      reconnectElsewhere();
+      break;
+    case "ConfigReloaded":
+      // e.g. a changed countdown delay applies to the next run
+      break;
     case "ResourcesRefreshed":
       console.log("resources updated, reloading...");
       location.reload();
@@ -211,6 +299,9 @@ async function processEvent(event) {
       document.myReplica = event?.properties?.param;
       // do not show this event in the log
       return;
+    case "ConnectedToMachine":
+      // do not show this event in the log
+      return;
     case "TotalVisitors":
       showTotalVisitors(event?.properties?.param);
       // do not show this event in the log
@@ -220,7 +311,6 @@ async function processEvent(event) {
       return;
     default:
       console.log(`unhandled event: ${event.name}`);
-      // await reRenderGraph("", "");
       break;
   }
 
@@ -258,8 +348,16 @@ async function postCommand(command: string) {
   }
 }
 
-async function reRenderGraph(selectedState, progress) {
-  let input = updateGraphDefinition(selectedState, progress);
+async function fetchAndRenderGraph() {
+  try {
+    const response = await fetch("/machine/diagram");
+    await reRenderGraph(await response.text());
+  } catch (err) {
+    console.log("ERROR: fetching the diagram:", err?.message ?? err);
+  }
+}
+
+async function reRenderGraph(input: string) {
   if (input === document.lastInput) {
     console.log("nothing to re-render");
     return;
@@ -275,24 +373,6 @@ async function reRenderGraph(selectedState, progress) {
   }
 }
 
-function updateGraphDefinition(selectedState, progress) {
-  let res = `stateDiagram-v2
-  [*] --> waiting
-  waiting --> working : start
-  working --> aborting : abort
-  working --> waiting
-  aborting --> waiting
-  classDef inProgress font-style:italic, stroke-dasharray: 5 5, stroke-width:3px;
-  class ${selectedState} inProgress
-  `;
-  if (progress && progress.trim() !== "") {
-    res += `note right of working
-        ${progress}
-    end note`;
-  }
-  return res;
-}
-
 function formatEventIntoOneLine(event) {
   let res = `${event.timestamp}: ${event.name}`;
   if (Object.keys(event?.properties ?? {}).length !== 0) {
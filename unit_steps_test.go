@@ -4,16 +4,43 @@
 package mermaidlive
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Arceliar/phony"
 	"github.com/cskr/pubsub/v2"
 	"github.com/cucumber/godog"
 	"github.com/cucumber/godog/colors"
+	"github.com/d-led/zmqcluster"
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-yaml"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var opts = godog.Options{
@@ -23,11 +50,53 @@ var opts = godog.Options{
 }
 
 type sutKey struct{}
+type journalKey struct{}
 type observerKey struct{}
 type listenerKey struct{}
+type commandKey struct{}
+type filterKey struct{}
+type subscriptionKey struct{}
+type observerSubscriptionKey struct{}
+type publisherKey struct{}
+type environmentKey struct{}
+type configKey struct{}
+type configErrorKey struct{}
+type configFlagsKey struct{}
+type liveConfigKey struct{}
+type reloadErrorKey struct{}
+type configEventsKey struct{}
+type configUnderTestKey struct{}
+type authenticationOutcomeKey struct{}
+type responseKey struct{}
+type serverKey struct{}
+type tlsDirectoryKey struct{}
+type tlsServerKey struct{}
+type presentedCertificateKey struct{}
+type serverDirectoryKey struct{}
+type serverShutdownKey struct{}
+type machinesKey struct{}
+type diagramKey struct{}
+type replayBufferKey struct{}
+type replayKey struct{}
+type streamedKey struct{}
+type httpServerKey struct{}
+type sseStreamKey struct{}
+type websocketClientKey struct{}
+type logsKey struct{}
+type restoreLoggingKey struct{}
+type tracedClusterKey struct{}
+type definitionKey struct{}
+type definitionErrorKey struct{}
+type receivedMessagesKey struct{}
+type scheduleKey struct{}
+type scheduleErrorKey struct{}
+type pausedCountKey struct{}
+type queuedCommandKey struct{}
 
 var errSutNotFound = errors.New("SUT not found, check step definitions")
 var errListenerNotFound = errors.New("listener not found, check step definitions")
+var errCommandNotFound = errors.New("no command requested, check step definitions")
+var errWebsocketClosed = errors.New("the websocket has been closed")
 
 func startFromMachineInState(ctx context.Context, state string) (context.Context, error) {
 	const delay = 10 * time.Millisecond
@@ -37,56 +106,365 @@ func startFromMachineInState(ctx context.Context, state string) (context.Context
 	return ctx, theSystemIsFoundInState(ctx, state)
 }
 
-func theSystemIsFoundInState(ctx context.Context, state string) error {
+func startFromSlowMachineInState(ctx context.Context, delay, state string) (context.Context, error) {
+	duration, err := time.ParseDuration(delay)
+	if err != nil {
+		return ctx, err
+	}
+	const pubSubChannelCapacity = 10
+	ctx, _ = configureSUT(ctx, duration, pubSubChannelCapacity)
+	return ctx, theSystemIsFoundInState(ctx, state)
+}
+
+func startFromLoadedMachineInState(ctx context.Context, filename, state string) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
+	definition, err := LoadMachineDefinition(filename)
+	if err != nil {
+		return ctx, err
+	}
+	ctx, _ = configureSUTFromDefinition(ctx, definition, delay, pubSubChannelCapacity)
+	return ctx, theSystemIsFoundInState(ctx, state)
+}
+
+func theMachineDefinition(ctx context.Context, content *godog.DocString) context.Context {
+	definition, err := ParseMachineDefinition([]byte(content.Content))
+	ctx = context.WithValue(ctx, definitionKey{}, definition)
+	return context.WithValue(ctx, definitionErrorKey{}, err)
+}
+
+func aSystemOfThatDefinitionInState(ctx context.Context, state string) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
+	if err, _ := ctx.Value(definitionErrorKey{}).(error); err != nil {
+		return ctx, err
+	}
+	ctx, _ = configureSUTFromDefinition(ctx, ctx.Value(definitionKey{}).(*MachineDefinition), delay, pubSubChannelCapacity)
+	return ctx, theSystemIsFoundInState(ctx, state)
+}
+
+func theMachineDefinitionIsRejectedFor(ctx context.Context, reason string) error {
+	err, _ := ctx.Value(definitionErrorKey{}).(error)
+	if err == nil {
+		return errors.New("expected the machine definition to be rejected")
+	}
+	if !strings.Contains(err.Error(), reason) {
+		return fmt.Errorf("expected the rejection to mention '%s', got '%v'", reason, err)
+	}
+	return nil
+}
+
+func aSystemInterruptedInStateRecoveredBy(ctx context.Context, state string, count int, policy string) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
+	store := newMemoryStateStore()
+	err := store.Save(MachineSnapshot{Machine: DefaultMachineId, State: state, Count: uint8(count)})
+	if err != nil {
+		return ctx, err
+	}
+	ctx, sut := configureSUT(ctx, delay, pubSubChannelCapacity)
+	sut.UseStateStore(store)
+	sut.Recover(RecoveryPolicy(policy))
+	return ctx, nil
+}
+
+func aSystemInterruptedWithQueuedWorkRecoveredBy(ctx context.Context, state string, count int, command, policy string) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
+	queued := QueuedWork{Id: NewCommandId(), Command: command, QueuedAt: time.Now()}
+	store := newMemoryStateStore()
+	err := store.Save(MachineSnapshot{Machine: DefaultMachineId, State: state, Count: uint8(count), Queue: []QueuedWork{queued}})
+	if err != nil {
+		return ctx, err
+	}
+	ctx, sut := configureSUT(ctx, delay, pubSubChannelCapacity)
+	sut.UseStateStore(store)
+	sut.Recover(RecoveryPolicy(policy))
+	return context.WithValue(ctx, queuedCommandKey{}, queued.Id), nil
+}
+
+func aJournaledSystemInState(ctx context.Context, state string) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
+	dir, err := os.MkdirTemp("", "mermaidlive-journal")
+	if err != nil {
+		return ctx, err
+	}
+	journal := NewFileEventJournal(dir)
+	ctx = context.WithValue(ctx, journalKey{}, journal)
+	ctx, sut := configureSUT(ctx, delay, pubSubChannelCapacity)
+	sut.UseJournal(journal)
+	return ctx, theSystemIsFoundInState(ctx, state)
+}
+
+func aJournaledSystemWithAWorkQueueInState(ctx context.Context, depth int, state string) (context.Context, error) {
+	ctx, err := aJournaledSystemInState(ctx, state)
+	if err != nil {
+		return ctx, err
+	}
+	ctx.Value(machinesKey{}).(*MachineRegistry).SetWorkQueueDepth(depth)
+	return ctx, nil
+}
+
+func theSystemIsRestartedFromItsJournal(ctx context.Context) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
 	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
 	if !ok {
-		return errSutNotFound
+		return ctx, errSutNotFound
+	}
+	journal, ok := ctx.Value(journalKey{}).(*FileEventJournal)
+	if !ok {
+		return ctx, errors.New("journal not found, check step definitions")
+	}
+	sut.Stop()
+	// as opened by the restarted replica
+	if err := journal.Close(); err != nil {
+		return ctx, err
 	}
+	journal = NewFileEventJournal(journal.directory)
+	ctx = context.WithValue(ctx, journalKey{}, journal)
+	ctx = unsubscribeListener(ctx)
+	ctx, restarted := configureSUT(ctx, delay, pubSubChannelCapacity)
+	restarted.UseJournal(journal)
+	restarted.Recover(RecoverByResuming)
+	return ctx, nil
+}
 
-	var err error
+func aServerJournalingTheMachines(ctx context.Context) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
+	dir, err := os.MkdirTemp("", "mermaidlive-journal")
+	if err != nil {
+		return ctx, err
+	}
+	journal := NewFileEventJournal(dir)
+	ctx = context.WithValue(ctx, journalKey{}, journal)
+	observer := pubsub.New[string, Event](pubSubChannelCapacity)
+	ctx = context.WithValue(ctx, observerKey{}, observer)
+	ctx = context.WithValue(ctx, listenerKey{}, observer.Sub(Topic))
+	machines := NewMachineRegistry(observer, DefaultMachineDefinition(), delay, MachinePersistence{
+		Store:   NewFileStateStore(dir),
+		Journal: journal,
+		Policy:  RecoverByResuming,
+	})
+	ctx = context.WithValue(ctx, machinesKey{}, machines)
+	ctx = context.WithValue(ctx, sutKey{}, machines.Default())
+	ctx, _, err = newTestServer(ctx, testConfig())
+	return ctx, err
+}
+
+func theHistoryOfTheMachineLists(ctx context.Context, machine, verdict, event string) (context.Context, error) {
+	ctx, err := theRouteIsRequested(ctx, http.MethodGet, "/machines/"+machine+"/history")
+	if err != nil {
+		return ctx, err
+	}
+	if err := theRequestIsAnsweredWith(ctx, http.StatusOK); err != nil {
+		return ctx, err
+	}
+	var history struct {
+		Events []Event `json:"events"`
+	}
+	response := ctx.Value(responseKey{}).(*httptest.ResponseRecorder)
+	if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil {
+		return ctx, err
+	}
+	if listed := slices.ContainsFunc(history.Events, func(e Event) bool { return e.Name == event }); listed != (verdict == "lists") {
+		return ctx, fmt.Errorf("expected the history of '%s' %s %s, got %v", machine, verdict, event, history.Events)
+	}
+	return ctx, nil
+}
+
+func aJournalOfFilesOfAtMostBytes(ctx context.Context, files, maxBytes int) (context.Context, error) {
+	dir, err := os.MkdirTemp("", "mermaidlive-journal")
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, journalKey{}, NewCustomFileEventJournal(dir, int64(maxBytes), files)), nil
+}
 
-	switch state {
-	case "waiting":
-		if !sut.IsWaiting() {
-			err = errors.New("expected the machine to be in waiting state")
+func eventsAreJournaled(ctx context.Context, count int) error {
+	journal := ctx.Value(journalKey{}).(*FileEventJournal)
+	for i := 1; i <= count; i++ {
+		if err := journal.Append(DefaultMachineId, NewEventWithParam(DefaultTickEvent, i)); err != nil {
+			return err
 		}
-	default:
-		err = errors.New("unknown state: " + state)
 	}
+	return nil
+}
+
+func theJournalReadsTheEvents(ctx context.Context, expected string) error {
+	events, err := ctx.Value(journalKey{}).(*FileEventJournal).Read(DefaultMachineId, time.Time{})
+	if err != nil {
+		return err
+	}
+	read := []string{}
+	for _, event := range events {
+		read = append(read, fmt.Sprint(event.Properties["param"]))
+	}
+	if actual := strings.Join(read, ","); actual != expected {
+		return fmt.Errorf("expected to read the events %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+func theJournalIsDeleted(ctx context.Context) error {
+	return ctx.Value(journalKey{}).(*FileEventJournal).Delete(DefaultMachineId)
+}
+
+func noJournalFileIsLeft(ctx context.Context) error {
+	journal := ctx.Value(journalKey{}).(*FileEventJournal)
+	files, err := os.ReadDir(journal.directory)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("expected no journal files, got %v", files)
+	}
+	return nil
+}
 
+func workIsRecovered(ctx context.Context) error {
+	_, err := receiveEventsTill(ctx, "WorkRecovered", 1*time.Second)
 	return err
 }
 
+func theSystemIsFoundInState(ctx context.Context, state string) error {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return errSutNotFound
+	}
+
+	if currentState := sut.CurrentState(); currentState != state {
+		return errors.New("expected the machine to be in state " + state + " but was in " + currentState)
+	}
+
+	return nil
+}
+
 func configureSUT(ctx context.Context,
+	delay time.Duration,
+	pubSubChannelCapacity int) (context.Context, *AsyncFSM) {
+	return configureSUTFromDefinition(ctx, DefaultMachineDefinition(), delay, pubSubChannelCapacity)
+}
+
+func configureSUTFromDefinition(ctx context.Context,
+	definition *MachineDefinition,
 	delay time.Duration,
 	pubSubChannelCapacity int) (context.Context, *AsyncFSM) {
 	observer := pubsub.New[string, Event](pubSubChannelCapacity)
 	ctx = context.WithValue(ctx, observerKey{}, observer)
-	sut := NewCustomAsyncFSM(observer, delay)
+	// the default machine, as served
+	machines := NewMachineRegistry(observer, definition, delay, MachinePersistence{})
+	ctx = context.WithValue(ctx, machinesKey{}, machines)
+	sut := machines.Default()
 	ctx = context.WithValue(ctx, sutKey{}, sut)
 	listener := observer.Sub(Topic)
 	ctx = context.WithValue(ctx, listenerKey{}, listener)
 	return ctx, sut
 }
 
+// newTestServer sets a server up as a replica does, though without a cluster, persisting the machines or handling signals.
+// It serves the machines of the scenario, if any, and keeps its files in a temporary directory
+func newTestServer(ctx context.Context, config Config) (context.Context, *Server, error) {
+	const pubSubChannelCapacity = 10
+	directory, err := os.MkdirTemp("", "mermaidlive-server-")
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx = context.WithValue(ctx, serverDirectoryKey{}, directory)
+	config.CounterDirectory = directory
+	events, ok := ctx.Value(observerKey{}).(*pubsub.PubSub[string, Event])
+	if !ok {
+		events = pubsub.New[string, Event](pubSubChannelCapacity)
+		ctx = context.WithValue(ctx, observerKey{}, events)
+	}
+	machines, ok := ctx.Value(machinesKey{}).(*MachineRegistry)
+	if ok {
+		// the machines of the scenario keep their settings
+		phony.Block(machines, func() {
+			config.CountdownDelay = machines.delay
+			config.WorkQueueDepth = machines.queueDepth
+		})
+	} else {
+		machines = NewMachineRegistry(events, DefaultMachineDefinition(), config.CountdownDelay, MachinePersistence{})
+		ctx = context.WithValue(ctx, machinesKey{}, machines)
+	}
+	peerSource := newTestCluster(events, func() error { return nil })
+	serverContext, shutdown := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, serverShutdownKey{}, shutdown)
+	server := newServer(serverContext, config, events, http.Dir(directory), machines, peerSource)
+	return context.WithValue(ctx, serverKey{}, server), server, nil
+}
+
+// newTestCluster is a cluster of a single replica, having loaded its counters with the loader
+func newTestCluster(events *pubsub.PubSub[string, Event], load func() error) *Cluster {
+	cluster := &Cluster{events: events, peers: []string{}}
+	cluster.loadCounters(load)
+	cluster.peersAnswered.Store(true)
+	return cluster
+}
+
+// testServerOf is the server of the scenario, set up with the default config unless already there
+func testServerOf(ctx context.Context) (context.Context, *Server, error) {
+	if server, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return ctx, server, nil
+	}
+	return newTestServer(ctx, testConfig())
+}
+
+// testConfig lets the anonymous callers of the tests do anything
+func testConfig() Config {
+	config := DefaultConfig()
+	config.AuthAnonymousRole = RoleAdmin
+	return config
+}
+
 func theCommandIsCast(ctx context.Context, command string) (context.Context, error) {
 	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
 	if !ok {
 		return ctx, errSutNotFound
 	}
 
-	var err error
+	if !sut.Definition().HasCommand(command) {
+		return ctx, errors.New("unknown command: " + command)
+	}
 
-	switch command {
-	case "abort":
-		sut.AbortWork()
-	case "start":
-		sut.StartWork()
-	default:
-		err = errors.New("unknown command: " + command)
+	commandId := NewCommandId()
+	result, reason := sut.Submit(context.Background(), commandId, command, RunParameters{})
+
+	return context.WithValue(ctx, commandKey{}, commandOutcome{
+		CommandId: commandId,
+		Result:    result,
+		Command:   command,
+		Reason:    reason,
+	}), nil
+}
+
+func theCommandIsReportedAs(ctx context.Context, result string) error {
+	outcome, ok := ctx.Value(commandKey{}).(commandOutcome)
+	if !ok {
+		return errCommandNotFound
 	}
+	if outcome.Result != CommandResult(result) {
+		return fmt.Errorf("expected the command to be %s, but it was %s", result, outcome.Result)
+	}
+	return nil
+}
 
-	return ctx, err
+func eventCarriesTheIdOfTheCommand(ctx context.Context, eventName string) error {
+	outcome, ok := ctx.Value(commandKey{}).(commandOutcome)
+	if !ok {
+		return errCommandNotFound
+	}
+	events, err := receiveEventsTill(ctx, eventName, 1*time.Second)
+	if err != nil {
+		return err
+	}
+	if event := events[len(events)-1]; event.CommandId != outcome.CommandId {
+		return fmt.Errorf("expected %s to carry the command id %s, got '%s'", eventName, outcome.CommandId, event.CommandId)
+	}
+	return nil
 }
 
 func someWorkHasProgressed(ctx context.Context) error {
@@ -109,6 +487,144 @@ func workIsCompleted(ctx context.Context) error {
 	return err
 }
 
+func aStreamFilteredBy(ctx context.Context, query string) (context.Context, error) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/events?"+query, nil)
+	filter, err := ParseEventFilter(c)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, filterKey{}, filter), nil
+}
+
+func anEventOfMachineIs(ctx context.Context, name, machine, property, verdict string) error {
+	filter, ok := ctx.Value(filterKey{}).(EventFilter)
+	if !ok {
+		return errors.New("no filter configured, check step definitions")
+	}
+	event := NewSimpleEvent(name).OfMachine(machine)
+	if key, value, found := strings.Cut(property, ":"); found {
+		event.Properties[key] = value
+	}
+	if streamed := filter.Matches(event); streamed != (verdict == "streamed") {
+		return fmt.Errorf("expected %s of '%s' with '%s' to be %s", name, machine, property, verdict)
+	}
+	return nil
+}
+
+func aSubscriberWithAQueueOverflowingBy(ctx context.Context, depth int, policy string) (context.Context, error) {
+	// without capacity, the pubsub only takes the next command once the subscriptions have taken the event
+	events := pubsub.New[string, Event](0)
+	observer := Subscribe(events, "observer", 10, DropOldest, nil, Topic)
+	ctx = context.WithValue(ctx, observerSubscriptionKey{}, observer)
+	subscription := Subscribe(events, "test", depth, OverflowPolicy(policy), func(e Event) bool {
+		return e.Name == DefaultTickEvent
+	}, "test")
+	ctx = context.WithValue(ctx, subscriptionKey{}, subscription)
+	ctx = context.WithValue(ctx, publisherKey{}, events)
+	return context.WithValue(ctx, listenerKey{}, observer.Events()), nil
+}
+
+func ticksArePublishedWhileTheSubscriberStalls(ctx context.Context, count int) error {
+	events, ok := ctx.Value(publisherKey{}).(*pubsub.PubSub[string, Event])
+	if !ok {
+		return errors.New("no subscription, check step definitions")
+	}
+	for i := count; i > 0; i-- {
+		events.Pub(NewEventWithParam(DefaultTickEvent, i), "test")
+	}
+	// taken once the last tick has been handed over, which is queued or dropped before the subscription delivers
+	events.Pub(NewSimpleEvent("Published"), "unobserved")
+	return nil
+}
+
+func theSubscriberReceivesTheTicks(ctx context.Context, expected string) error {
+	subscription, ok := ctx.Value(subscriptionKey{}).(*Subscription)
+	if !ok {
+		return errors.New("no subscription, check step definitions")
+	}
+	received := []string{}
+	for done := false; !done; {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				received = append(received, "disconnected")
+				done = true
+				break
+			}
+			received = append(received, fmt.Sprint(event.Properties["param"]))
+		case <-time.After(50 * time.Millisecond):
+			done = true
+		}
+	}
+	if actual := strings.Join(received, ","); actual != expected {
+		return fmt.Errorf("expected to receive %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+// theLaggingSubscriberIsAnnounced expects the announcement not to reveal the client to the other subscribers
+func theLaggingSubscriberIsAnnounced(ctx context.Context) error {
+	events, err := receiveEventsTill(ctx, SubscriberLaggedEvent, 1*time.Second)
+	if err != nil {
+		return err
+	}
+	if client, ok := events[len(events)-1].Properties["client"]; ok {
+		return fmt.Errorf("expected the client not to be announced, got '%v'", client)
+	}
+	return nil
+}
+
+// scrapeMetrics is what the server exposes to Prometheus
+func scrapeMetrics(ctx context.Context) (context.Context, string, error) {
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, "", err
+	}
+	w := httptest.NewRecorder()
+	server.server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		return ctx, "", fmt.Errorf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		return ctx, "", fmt.Errorf("expected the Prometheus text format, got '%s'", contentType)
+	}
+	return ctx, w.Body.String(), nil
+}
+
+func theMetricsCountAtLeast(ctx context.Context, expected int, series string) (context.Context, error) {
+	ctx, metrics, err := scrapeMetrics(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	for _, line := range strings.Split(metrics, "\n") {
+		value, found := strings.CutPrefix(line, series+" ")
+		if !found {
+			continue
+		}
+		actual, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return ctx, err
+		}
+		if actual < float64(expected) {
+			return ctx, fmt.Errorf("expected at least %d of %s, got %v", expected, series, actual)
+		}
+		return ctx, nil
+	}
+	return ctx, fmt.Errorf("%s not found in:\n%s", series, metrics)
+}
+
+func theMetricsDoNotList(ctx context.Context, labels string) (context.Context, error) {
+	ctx, metrics, err := scrapeMetrics(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	if strings.Contains(metrics, labels) {
+		return ctx, fmt.Errorf("expected no series of %s in:\n%s", labels, metrics)
+	}
+	return ctx, nil
+}
+
 func receiveEventsTill(ctx context.Context, event string, timeout time.Duration) ([]Event, error) {
 	res := []Event{}
 	var err error
@@ -139,33 +655,2068 @@ func receiveEventsTill(ctx context.Context, event string, timeout time.Duration)
 	return res, err
 }
 
-func TestUnit(t *testing.T) {
-	suite := godog.TestSuite{
-		ScenarioInitializer: InitializeScenario,
-		Options:             &opts,
+func unsubscribeListener(ctx context.Context) context.Context {
+	listener, ok1 := ctx.Value(listenerKey{}).(chan Event)
+	observer, ok2 := ctx.Value(observerKey{}).(*pubsub.PubSub[string, Event])
+	if ok1 && listener != nil && ok2 && observer != nil {
+		log.Println("unsubscribing listener")
+		observer.Unsub(listener, Topic)
 	}
+	return context.WithValue(ctx, listenerKey{}, nil)
+}
 
-	if suite.Run() != 0 {
-		t.Fatal("non-zero status returned, failed to run feature tests")
+// withEnvironmentVariable remembers the previous value, to be restored after the scenario
+func withEnvironmentVariable(ctx context.Context, key, value string) context.Context {
+	previous, ok := ctx.Value(environmentKey{}).(map[string]*string)
+	if !ok {
+		previous = map[string]*string{}
+		ctx = context.WithValue(ctx, environmentKey{}, previous)
+	}
+	if _, seen := previous[key]; !seen {
+		if v, set := os.LookupEnv(key); set {
+			previous[key] = &v
+		} else {
+			previous[key] = nil
+		}
 	}
+	os.Setenv(key, value)
+	return ctx
 }
 
-func InitializeScenario(ctx *godog.ScenarioContext) {
-	ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
-		listener, ok1 := ctx.Value(listenerKey{}).(chan Event)
-		observer, ok2 := ctx.Value(observerKey{}).(*pubsub.PubSub[string, Event])
-		if ok1 && listener != nil && ok2 && observer != nil {
-			log.Println("unsubscribing listener")
-			observer.Unsub(listener, Topic)
+func restoreEnvironment(ctx context.Context) {
+	previous, _ := ctx.Value(environmentKey{}).(map[string]*string)
+	for key, value := range previous {
+		if value == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *value)
 		}
-		ctx = context.WithValue(ctx, listenerKey{}, nil)
-		return ctx, nil
-	})
-	ctx.Step(`^a system in state "(\S+)"$`, startFromMachineInState)
-	ctx.Step(`^the system is found in state "([^"]*)"$`, theSystemIsFoundInState)
-	ctx.Step(`^the system "([^"]*)" is requested$`, theCommandIsCast)
-	ctx.Step(`^the request is ignored$`, theRequestIsIgnored)
-	ctx.Step(`^some work has progressed$`, someWorkHasProgressed)
-	ctx.Step(`^work is completed$`, workIsCompleted)
-	ctx.Step(`^work is canceled$`, workIsCanceled)
+	}
+}
+
+func theConfigFile(ctx context.Context, content *godog.DocString) (context.Context, error) {
+	file, err := os.CreateTemp("", "mermaidlive-config-*.yaml")
+	if err != nil {
+		return ctx, err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content.Content); err != nil {
+		return ctx, err
+	}
+	return withEnvironmentVariable(ctx, "MML_CONFIG", file.Name()), nil
+}
+
+func theEnvironmentVariableIs(ctx context.Context, key, value string) context.Context {
+	return withEnvironmentVariable(ctx, key, value)
+}
+
+func theConfigIsLoadedWithTheFlags(ctx context.Context, args string) (context.Context, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlags := NewConfigFlags(flags)
+	if err := flags.Parse(strings.Fields(args)); err != nil {
+		return ctx, err
+	}
+	config, err := LoadConfig(configFlags)
+	ctx = context.WithValue(ctx, configFlagsKey{}, configFlags)
+	ctx = context.WithValue(ctx, configKey{}, config)
+	return context.WithValue(ctx, configErrorKey{}, err), nil
+}
+
+func theConfigFileIsChangedTo(content *godog.DocString) error {
+	return os.WriteFile(os.Getenv("MML_CONFIG"), []byte(content.Content), 0o644)
+}
+
+func theConfigIsReloaded(ctx context.Context) (context.Context, error) {
+	live, ok := ctx.Value(liveConfigKey{}).(*LiveConfig)
+	if !ok {
+		config, ok := ctx.Value(configKey{}).(Config)
+		if !ok {
+			return ctx, errors.New("no config loaded, check step definitions")
+		}
+		events := pubsub.New[string, Event](10)
+		live = NewLiveConfig(config, events)
+		ctx = context.WithValue(ctx, liveConfigKey{}, live)
+		ctx = context.WithValue(ctx, configEventsKey{}, events.Sub(Topic))
+	}
+	err := live.Reload(ctx.Value(configFlagsKey{}).(*ConfigFlags))
+	ctx = context.WithValue(ctx, configKey{}, live.Current())
+	return context.WithValue(ctx, reloadErrorKey{}, err), nil
+}
+
+func isPublishedWithTheChangesTo(ctx context.Context, eventName, keys string) error {
+	events, ok := ctx.Value(configEventsKey{}).(chan Event)
+	if !ok {
+		return errors.New("the config has not been reloaded, check step definitions")
+	}
+	select {
+	case event := <-events:
+		if event.Name != eventName {
+			return fmt.Errorf("expected %s, got %s", eventName, event.Name)
+		}
+		// only the names of the settings, as their values might be credentials
+		changed, _ := event.Properties["changed"].([]string)
+		if strings.Join(changed, ", ") != keys {
+			return fmt.Errorf("expected the changes to %s, got %v", keys, event.Properties["changed"])
+		}
+		return nil
+	case <-time.After(time.Second):
+		return fmt.Errorf("%s not published", eventName)
+	}
+}
+
+func noConfigChangeIsPublished(ctx context.Context) error {
+	events, _ := ctx.Value(configEventsKey{}).(chan Event)
+	select {
+	case event := <-events:
+		return fmt.Errorf("unexpected %s: %v", event.Name, event.Properties)
+	default:
+		return nil
+	}
+}
+
+func theConfigUpdateIsRejectedFor(ctx context.Context, keys string) error {
+	err, _ := ctx.Value(reloadErrorKey{}).(error)
+	if err == nil {
+		return errors.New("the config update was accepted")
+	}
+	return errorMentions(err, keys)
+}
+
+func theSettingIs(ctx context.Context, key, expected string) error {
+	if err, _ := ctx.Value(configErrorKey{}).(error); err != nil {
+		return fmt.Errorf("the config was rejected: %w", err)
+	}
+	config := ctx.Value(configKey{}).(Config)
+	for _, attr := range config.LogValue().Group() {
+		if attr.Key == key {
+			if actual := attr.Value.String(); actual != expected {
+				return fmt.Errorf("expected %s to be '%s', got '%s'", key, expected, actual)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown setting: %s", key)
+}
+
+func theConfigIsRejectedFor(ctx context.Context, keys string) error {
+	err, _ := ctx.Value(configErrorKey{}).(error)
+	if err == nil {
+		return errors.New("the config was accepted")
+	}
+	return errorMentions(err, keys)
+}
+
+func errorMentions(err error, keys string) error {
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); !strings.Contains(err.Error(), key) {
+			return fmt.Errorf("expected '%s' to be reported in: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// theConfigUnderTest is the configuration of the parts of the server under test
+func theConfigUnderTest(ctx context.Context, content *godog.DocString) (context.Context, error) {
+	config := DefaultConfig()
+	if err := yaml.UnmarshalWithOptions([]byte(content.Content), &config, yaml.Strict()); err != nil {
+		return ctx, err
+	}
+	if err := config.Validate(); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, configUnderTestKey{}, config), nil
+}
+
+// requestWithCredentials understands "none", "Bearer <token>", "Basic <name>:<password>",
+// and "signed [expired] <role>:<subject>" or "forged <role>:<subject>" for the HMAC-signed tokens
+func requestWithCredentials(ctx context.Context, credentials string) (*http.Request, error) {
+	config, ok := ctx.Value(configUnderTestKey{}).(Config)
+	if !ok {
+		return nil, errors.New("no config under test, check step definitions")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	kind, value, _ := strings.Cut(credentials, " ")
+	switch kind {
+	case "none":
+	case "Bearer":
+		r.Header.Set("Authorization", credentials)
+	case "Basic":
+		name, password, _ := strings.Cut(value, ":")
+		r.SetBasicAuth(name, password)
+	case "signed", "forged":
+		secret, ttl := config.AuthHmacSecret, time.Hour
+		if kind == "forged" {
+			secret = strings.Repeat("x", minHmacSecretLength)
+		}
+		if expired, ok := strings.CutPrefix(value, "expired "); ok {
+			value, ttl = expired, -time.Hour
+		}
+		role, subject, _ := strings.Cut(value, ":")
+		token, err := IssueToken([]byte(secret), subject, Role(role), ttl)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return nil, fmt.Errorf("unsupported credentials: %s", credentials)
+	}
+	return r, nil
+}
+
+func authenticationWith(ctx context.Context, credentials string) (authentication, error) {
+	r, err := requestWithCredentials(ctx, credentials)
+	if err != nil {
+		return authentication{}, err
+	}
+	identity, err := newAuthenticators(ctx.Value(configUnderTestKey{}).(Config)).authenticate(r)
+	return authentication{identity, err}, nil
+}
+
+func aRequestCarriesTheCredentials(ctx context.Context, credentials string) (context.Context, error) {
+	auth, err := authenticationWith(ctx, credentials)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, authenticationOutcomeKey{}, auth), nil
+}
+
+func theCallerIsIdentifiedAsInTheRole(ctx context.Context, name, role string) error {
+	auth := ctx.Value(authenticationOutcomeKey{}).(authentication)
+	if auth.err != nil {
+		return fmt.Errorf("the caller was rejected: %w", auth.err)
+	}
+	if auth.identity.Name != name || auth.identity.Role != Role(role) {
+		return fmt.Errorf("expected '%s' in the role %s, got %+v", name, role, auth.identity)
+	}
+	return nil
+}
+
+func theCallerIsRejectedBecauseOf(ctx context.Context, reason string) error {
+	auth := ctx.Value(authenticationOutcomeKey{}).(authentication)
+	if auth.err == nil {
+		return fmt.Errorf("the caller was identified as %+v", auth.identity)
+	}
+	return errorMentions(auth.err, reason)
+}
+
+func aRouteRequiringTheRoleIsRequestedWithTheCredentials(ctx context.Context, role, credentials string) (context.Context, error) {
+	r, err := requestWithCredentials(ctx, credentials)
+	if err != nil {
+		return ctx, err
+	}
+	ctx, server, err := serverUnderTest(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	route := "/requires/" + role
+	server.server.GET(route, server.requireRole(Role(role)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	r.URL.Path = route
+	response := httptest.NewRecorder()
+	server.server.ServeHTTP(response, r)
+	return context.WithValue(ctx, responseKey{}, response), nil
+}
+
+func aServer(ctx context.Context) (context.Context, error) {
+	ctx, _, err := newTestServer(ctx, testConfig())
+	return ctx, err
+}
+
+func aServerWhoseCountersFailToLoad(ctx context.Context) (context.Context, error) {
+	ctx, server, err := newTestServer(ctx, testConfig())
+	if err != nil {
+		return ctx, err
+	}
+	server.peerSource = newTestCluster(server.events, func() error {
+		return errors.New("corrupt counter file")
+	})
+	return ctx, nil
+}
+
+func theRouteIsRequested(ctx context.Context, method, route string) (context.Context, error) {
+	return theRouteIsRequestedWith(ctx, method, route, "")
+}
+
+func theRouteIsRequestedWith(ctx context.Context, method, route, body string) (context.Context, error) {
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	r := httptest.NewRequest(method, route, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	response := httptest.NewRecorder()
+	server.server.ServeHTTP(response, r)
+	return context.WithValue(ctx, responseKey{}, response), nil
+}
+
+func theMachineIsCreated(ctx context.Context, id string) (context.Context, error) {
+	ctx, err := theRouteIsRequestedWith(ctx, http.MethodPost, "/machines", fmt.Sprintf(`{"id": %q}`, id))
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, theRequestIsAnsweredWith(ctx, http.StatusCreated)
+}
+
+func theMachineIsDeleted(ctx context.Context, id string) (context.Context, error) {
+	ctx, err := theRouteIsRequested(ctx, http.MethodDelete, "/machines/"+id)
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, theRequestIsAnsweredWith(ctx, http.StatusNoContent)
+}
+
+func machinesAreCreated(ctx context.Context, count int) (context.Context, error) {
+	var err error
+	for i := 1; i <= count && err == nil; i++ {
+		ctx, err = theMachineIsCreated(ctx, fmt.Sprintf("machine-%d", i))
+	}
+	return ctx, err
+}
+
+func theMachinesAreListed(ctx context.Context, expected string) (context.Context, error) {
+	ctx, err := theRouteIsRequested(ctx, http.MethodGet, "/machines")
+	if err != nil {
+		return ctx, err
+	}
+	if err := theRequestIsAnsweredWith(ctx, http.StatusOK); err != nil {
+		return ctx, err
+	}
+	var listed struct {
+		Machines []string `json:"machines"`
+	}
+	response := ctx.Value(responseKey{}).(*httptest.ResponseRecorder)
+	if err := json.Unmarshal(response.Body.Bytes(), &listed); err != nil {
+		return ctx, err
+	}
+	if actual := strings.Join(listed.Machines, ", "); actual != expected {
+		return ctx, fmt.Errorf("expected the machines %s, got %s", expected, actual)
+	}
+	return ctx, nil
+}
+
+func theReasonGivenMentions(ctx context.Context, expected string) error {
+	response := ctx.Value(responseKey{}).(*httptest.ResponseRecorder)
+	var answer struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &answer); err != nil {
+		return err
+	}
+	return errorMentions(errors.New(answer.Reason), expected)
+}
+
+// theServerIsRestarted sets a server up anew, with the machines persisted by the previous one
+func theServerIsRestarted(ctx context.Context) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	server, ok := ctx.Value(serverKey{}).(*Server)
+	if !ok {
+		return ctx, errors.New("no server, check step definitions")
+	}
+	journal, ok := ctx.Value(journalKey{}).(*FileEventJournal)
+	if !ok {
+		return ctx, errors.New("journal not found, check step definitions")
+	}
+	for _, id := range server.machines.List() {
+		if fsm, ok := server.machines.Get(id); ok {
+			fsm.Stop()
+		}
+	}
+	server.schedules.Stop()
+	ctx.Value(serverShutdownKey{}).(context.CancelFunc)()
+	os.RemoveAll(ctx.Value(serverDirectoryKey{}).(string))
+	machines := NewMachineRegistry(server.events, DefaultMachineDefinition(), delay, MachinePersistence{
+		Store:   NewFileStateStore(journal.directory),
+		Journal: journal,
+		Policy:  RecoverByResuming,
+	})
+	ctx = context.WithValue(ctx, machinesKey{}, machines)
+	ctx = context.WithValue(ctx, sutKey{}, machines.Default())
+	ctx = context.WithValue(ctx, serverKey{}, nil)
+	ctx, _, err := newTestServer(ctx, testConfig())
+	return ctx, err
+}
+
+func theDiagramIsRequested(ctx context.Context) (context.Context, error) {
+	ctx, err := theRouteIsRequested(ctx, http.MethodGet, "/machine/diagram")
+	if err != nil {
+		return ctx, err
+	}
+	if err := theRequestIsAnsweredWith(ctx, http.StatusOK); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, diagramKey{}, ctx.Value(responseKey{}).(*httptest.ResponseRecorder).Body.String()), nil
+}
+
+func theDefaultMachineIsRenderedInStateWithTheProgress(ctx context.Context, state, progress string) context.Context {
+	return context.WithValue(ctx, diagramKey{}, DefaultMachineDefinition().RenderMermaid(state, progress))
+}
+
+func theDiagramIs(ctx context.Context, expected *godog.DocString) error {
+	if diagram := ctx.Value(diagramKey{}).(string); diagram != expected.Content+"\n" {
+		return fmt.Errorf("expected the diagram:\n%s\ngot:\n%s", expected.Content, diagram)
+	}
+	return nil
+}
+
+func theDiagramHighlights(ctx context.Context, state string) error {
+	diagram := ctx.Value(diagramKey{}).(string)
+	highlighted := []string{}
+	for _, line := range strings.Split(diagram, "\n") {
+		if class, found := strings.CutPrefix(strings.TrimSpace(line), "class "); found {
+			highlighted = append(highlighted, class)
+		}
+	}
+	expected := []string{}
+	if state != "no state" {
+		expected = append(expected, strings.Trim(state, `"`)+" "+activeStateClass)
+	}
+	if !slices.Equal(highlighted, expected) {
+		return fmt.Errorf("expected %v to be highlighted, got %v in:\n%s", expected, highlighted, diagram)
+	}
+	return nil
+}
+
+func theDiagramNotes(ctx context.Context, state, note string) error {
+	diagram := ctx.Value(diagramKey{}).(string)
+	expected := fmt.Sprintf("  note right of %s\n    %s\n  end note\n", state, note)
+	if !strings.Contains(diagram, expected) {
+		return fmt.Errorf("expected the note '%s' on %s in:\n%s", note, state, diagram)
+	}
+	return nil
+}
+
+func theDiagramHasNoNote(ctx context.Context) error {
+	if diagram := ctx.Value(diagramKey{}).(string); strings.Contains(diagram, "note right of") {
+		return fmt.Errorf("expected no note in:\n%s", diagram)
+	}
+	return nil
+}
+
+func aReplayBufferOfEvents(ctx context.Context, capacity int) context.Context {
+	// without capacity, the pubsub only takes the next command once the buffer has taken the event
+	events := pubsub.New[string, Event](0)
+	buffer := NewReplayBuffer(events, "test", capacity)
+	ctx = context.WithValue(ctx, publisherKey{}, events)
+	return context.WithValue(ctx, replayBufferKey{}, buffer)
+}
+
+// ticksArePublished publishes the ticks 1, 2, etc., noting their ids
+func ticksArePublished(ctx context.Context, count int) context.Context {
+	events := ctx.Value(publisherKey{}).(*pubsub.PubSub[string, Event])
+	published := []Event{}
+	for i := 1; i <= count; i++ {
+		tick := NewEventWithParam(DefaultTickEvent, i)
+		events.Pub(tick, "test")
+		published = append(published, tick)
+	}
+	// not buffered: the first is taken by the buffer once done with the last tick, and the second only after that
+	for range 2 {
+		events.Pub(NewEventWithParam(MachineDiagramEvent, "stateDiagram-v2"), "test")
+	}
+	return context.WithValue(ctx, streamedKey{}, published)
+}
+
+// theReplayIsResumedAfter resumes after the tick, "the last event" or an unknown id
+func theReplayIsResumedAfter(ctx context.Context, after string) (context.Context, error) {
+	buffer := ctx.Value(replayBufferKey{}).(*ReplayBuffer)
+	var id uint64
+	switch after {
+	case "an id from before the buffer":
+		id = buffer.lastEvicted - 1
+	case "an id unknown to the replica":
+		id = lastEventId.Load() + 1000
+	default:
+		published := ctx.Value(streamedKey{}).([]Event)
+		for _, event := range published {
+			if after == "the last event" || fmt.Sprintf("tick %v", event.Properties["param"]) == after {
+				id = event.Id
+			}
+		}
+		if id == 0 {
+			return ctx, fmt.Errorf("%s has not been published in %v", after, published)
+		}
+	}
+	replayed, complete := buffer.Since(id)
+	return context.WithValue(ctx, replayKey{}, replay{replayed, complete}), nil
+}
+
+type replay struct {
+	events   []Event
+	complete bool
+}
+
+func theTicksAreReplayed(ctx context.Context, expected, completeness string) error {
+	replayed := ctx.Value(replayKey{}).(replay)
+	ticks := []string{}
+	for _, event := range replayed.events {
+		ticks = append(ticks, fmt.Sprint(event.Properties["param"]))
+	}
+	if actual := strings.Join(ticks, ","); actual != expected {
+		return fmt.Errorf("expected the ticks %s to be replayed, got %s", expected, actual)
+	}
+	if replayed.complete != (completeness == "completely") {
+		return fmt.Errorf("expected the ticks to be replayed %s", completeness)
+	}
+	return nil
+}
+
+// theEventsOfTheSystemAreBuffered waits for the events to make it into the replay buffer of the machine
+func theEventsOfTheSystemAreBuffered(ctx context.Context, name string) error {
+	sut := ctx.Value(sutKey{}).(*AsyncFSM)
+	buffer, ok := ctx.Value(machinesKey{}).(*MachineRegistry).ReplayBuffer(sut.Id())
+	if !ok {
+		return errors.New("no replay buffer, check step definitions")
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		buffered, _ := buffer.Since(0)
+		if slices.ContainsFunc(buffered, func(e Event) bool { return e.Name == name }) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has not been buffered", name)
+}
+
+// theStreamIsResumedAfter resumes the stream after the named event of the system, or the given id
+func theStreamIsResumedAfter(ctx context.Context, after string) (context.Context, error) {
+	lastEventId := after
+	if name, found := strings.CutPrefix(after, "the event "); found {
+		sut := ctx.Value(sutKey{}).(*AsyncFSM)
+		buffer, _ := ctx.Value(machinesKey{}).(*MachineRegistry).ReplayBuffer(sut.Id())
+		buffered, _ := buffer.Since(0)
+		i := slices.IndexFunc(buffered, func(e Event) bool { return e.Name == strings.Trim(name, `"`) })
+		if i < 0 {
+			return ctx, fmt.Errorf("%s is not buffered in %v", name, buffered)
+		}
+		lastEventId = strconv.FormatUint(buffered[i].Id, 10)
+	}
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	r.Header.Set("Last-Event-ID", lastEventId)
+	response := newClosedStreamRecorder()
+	server.server.ServeHTTP(response, r)
+	streamed := []Event{}
+	for _, line := range strings.Split(strings.TrimSpace(response.Body.String()), "\n") {
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return ctx, fmt.Errorf("could not read the streamed line '%s': %w", line, err)
+		}
+		streamed = append(streamed, event)
+	}
+	return context.WithValue(ctx, streamedKey{}, streamed), nil
+}
+
+func theStreamReplays(ctx context.Context, verdict, names string) error {
+	streamed := ctx.Value(streamedKey{}).([]Event)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if slices.ContainsFunc(streamed, func(e Event) bool { return e.Name == name }) != (verdict == "replays") {
+			return fmt.Errorf("expected the stream %s %s, got %v", verdict, name, streamed)
+		}
+	}
+	return nil
+}
+
+// sseFrame is what is sent between two blank lines of a Server-Sent Events stream
+type sseFrame struct {
+	fields  map[string]string
+	comment string
+}
+
+// sseStream reads the frames of a stream as they arrive, the channel is closed once the stream ends
+type sseStream struct {
+	response *http.Response
+	frames   chan sseFrame
+	event    Event
+}
+
+// httpServerOf serves the server under test over HTTP, for as long as the scenario runs
+func httpServerOf(ctx context.Context) (context.Context, *httptest.Server, error) {
+	if server, ok := ctx.Value(httpServerKey{}).(*httptest.Server); ok {
+		return ctx, server, nil
+	}
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, nil, err
+	}
+	httpServer := httptest.NewServer(server.server)
+	return context.WithValue(ctx, httpServerKey{}, httpServer), httpServer, nil
+}
+
+func theServerSendsHeartbeatsEvery(ctx context.Context, interval string) (context.Context, error) {
+	duration, err := time.ParseDuration(interval)
+	if err != nil {
+		return ctx, err
+	}
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	server.heartbeatInterval = duration
+	return ctx, nil
+}
+
+func anSSEClientConnectsTo(ctx context.Context, route string) (context.Context, error) {
+	ctx, httpServer, err := httpServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	response, err := httpServer.Client().Get(httpServer.URL + route)
+	if err != nil {
+		return ctx, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return ctx, fmt.Errorf("expected %d, got %d", http.StatusOK, response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		response.Body.Close()
+		return ctx, fmt.Errorf("expected an event stream, got '%s'", contentType)
+	}
+	stream := &sseStream{response: response, frames: make(chan sseFrame, 100)}
+	go func() {
+		defer close(stream.frames)
+		scanner := bufio.NewScanner(response.Body)
+		frame := sseFrame{fields: map[string]string{}}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				stream.frames <- frame
+				frame = sseFrame{fields: map[string]string{}}
+			case strings.HasPrefix(line, ":"):
+				frame.comment = strings.TrimSpace(line[1:])
+			default:
+				field, value, _ := strings.Cut(line, ":")
+				if _, repeated := frame.fields[field]; repeated {
+					value = "repeated field " + field
+				}
+				frame.fields[field] = strings.TrimPrefix(value, " ")
+			}
+		}
+	}()
+	return context.WithValue(ctx, sseStreamKey{}, stream), nil
+}
+
+func nextSSEFrame(ctx context.Context) (sseFrame, error) {
+	stream := ctx.Value(sseStreamKey{}).(*sseStream)
+	select {
+	case frame, ok := <-stream.frames:
+		if !ok {
+			return frame, errors.New("the stream has ended")
+		}
+		return frame, nil
+	case <-time.After(2 * time.Second):
+		return sseFrame{}, errors.New("timed out waiting for the stream")
+	}
+}
+
+func theStreamStartsWithARetryOf(ctx context.Context, millis int) error {
+	frame, err := nextSSEFrame(ctx)
+	if err != nil {
+		return err
+	}
+	if retry := frame.fields["retry"]; retry != strconv.Itoa(millis) || len(frame.fields) != 1 {
+		return fmt.Errorf("expected a retry of %dms first, got %v", millis, frame)
+	}
+	return nil
+}
+
+func theSSEEventIsReceived(ctx context.Context, name string) error {
+	stream := ctx.Value(sseStreamKey{}).(*sseStream)
+	for {
+		frame, err := nextSSEFrame(ctx)
+		if err != nil {
+			return fmt.Errorf("%s not received: %w", name, err)
+		}
+		data, ok := frame.fields["data"]
+		if !ok {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("could not read the data '%s': %w", data, err)
+		}
+		if frame.fields["event"] != event.Name {
+			return fmt.Errorf("expected the SSE event to be named '%s', got '%s'", event.Name, frame.fields["event"])
+		}
+		if event.Name == name {
+			stream.event = event
+			stream.event.Id, _ = strconv.ParseUint(frame.fields["id"], 10, 64)
+			if frame.fields["id"] != "" && event.Id != stream.event.Id {
+				return fmt.Errorf("expected the SSE id %s to be the id of the event, got %v", frame.fields["id"], event)
+			}
+			return nil
+		}
+	}
+}
+
+func theSSEEventCarriesAnId(ctx context.Context, verdict string) error {
+	event := ctx.Value(sseStreamKey{}).(*sseStream).event
+	if (event.Id != 0) != (verdict == "with") {
+		return fmt.Errorf("expected %s to be sent %s an id, got %v", event.Name, verdict, event.Id)
+	}
+	return nil
+}
+
+func aHeartbeatIsReceived(ctx context.Context) error {
+	for {
+		frame, err := nextSSEFrame(ctx)
+		if err != nil {
+			return fmt.Errorf("no heartbeat received: %w", err)
+		}
+		if frame.comment == "heartbeat" && len(frame.fields) == 0 {
+			return nil
+		}
+	}
+}
+
+func theSSEStreamEnds(ctx context.Context) error {
+	for {
+		if _, err := nextSSEFrame(ctx); err != nil {
+			if strings.Contains(err.Error(), "ended") {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func theServerShutsDown(ctx context.Context) (context.Context, error) {
+	ctx, _, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	ctx.Value(serverShutdownKey{}).(context.CancelFunc)()
+	return ctx, nil
+}
+
+// websocketClient reads the messages of a websocket as they arrive, the channel is closed once the connection fails
+type websocketClient struct {
+	conn     *websocket.Conn
+	messages chan websocketMessage
+	pings    atomic.Int32
+	err      error
+}
+
+func aWebsocketClientConnectsTo(ctx context.Context, answering, route string) (context.Context, error) {
+	ctx, httpServer, err := httpServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+route, nil)
+	if err != nil {
+		return ctx, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return ctx, fmt.Errorf("expected the connection to be upgraded, got %d", response.StatusCode)
+	}
+	client := &websocketClient{conn: conn, messages: make(chan websocketMessage, 100)}
+	conn.SetPingHandler(func(data string) error {
+		client.pings.Add(1)
+		if answering == "not answering" {
+			return nil
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		defer close(client.messages)
+		for {
+			var message websocketMessage
+			if client.err = conn.ReadJSON(&message); client.err != nil {
+				return
+			}
+			client.messages <- message
+		}
+	}()
+	return context.WithValue(ctx, websocketClientKey{}, client), nil
+}
+
+func theWebsocketClientSendsTheCommand(ctx context.Context, command, correlationId string) error {
+	client := ctx.Value(websocketClientKey{}).(*websocketClient)
+	return client.conn.WriteJSON(websocketMessage{Type: "command", Command: command, CorrelationId: correlationId})
+}
+
+func theWebsocketClientSends(ctx context.Context, message string) error {
+	client := ctx.Value(websocketClientKey{}).(*websocketClient)
+	return client.conn.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+func nextWebsocketMessage(ctx context.Context) (websocketMessage, error) {
+	client := ctx.Value(websocketClientKey{}).(*websocketClient)
+	select {
+	case message, ok := <-client.messages:
+		if !ok {
+			return message, fmt.Errorf("%w: %w", errWebsocketClosed, client.err)
+		}
+		return message, nil
+	case <-time.After(2 * time.Second):
+		return websocketMessage{}, errors.New("timed out waiting for the websocket")
+	}
+}
+
+func theWebsocketEventIsReceived(ctx context.Context, name string) error {
+	for {
+		message, err := nextWebsocketMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("%s not received: %w", name, err)
+		}
+		if message.Type == "event" && message.Event.Name == name {
+			return nil
+		}
+	}
+}
+
+// theResultIsReceivedBefore expects the result of the command ahead of any event it leads to
+func theResultIsReceivedBefore(ctx context.Context, result, correlationId, eventName string) error {
+	var commandId string
+	for {
+		message, err := nextWebsocketMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch {
+		case message.Type == "result" && message.CorrelationId == correlationId:
+			if message.Result != result || message.CommandId == "" {
+				return fmt.Errorf("expected the command %s to be %s, got %v", correlationId, result, message)
+			}
+			commandId = message.CommandId
+		case message.Type == "event" && message.Event.Name == eventName:
+			if commandId == "" {
+				return fmt.Errorf("%s received before the result of the command %s", eventName, correlationId)
+			}
+			if message.Event.CommandId != commandId {
+				return fmt.Errorf("expected %s to carry the command id %s, got '%s'", eventName, commandId, message.Event.CommandId)
+			}
+			return nil
+		}
+	}
+}
+
+func theResultIsReceived(ctx context.Context, result, correlationId string) error {
+	for {
+		message, err := nextWebsocketMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if message.Type == "result" && message.CorrelationId == correlationId {
+			if message.Result != result {
+				return fmt.Errorf("expected the command %s to be %s, got %v", correlationId, result, message)
+			}
+			return nil
+		}
+	}
+}
+
+func theWebsocketErrorIsReceived(ctx context.Context, reason string) error {
+	for {
+		message, err := nextWebsocketMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if message.Type == "event" {
+			continue
+		}
+		if message.Type != "error" || !strings.Contains(message.Reason, reason) {
+			return fmt.Errorf("expected an error mentioning '%s', got %v", reason, message)
+		}
+		return nil
+	}
+}
+
+func theWebsocketStaysOpenFor(ctx context.Context, duration string) error {
+	wait, err := time.ParseDuration(duration)
+	if err != nil {
+		return err
+	}
+	client := ctx.Value(websocketClientKey{}).(*websocketClient)
+	deadline := time.After(wait)
+	for {
+		select {
+		case _, ok := <-client.messages:
+			if !ok {
+				return fmt.Errorf("%w: %w", errWebsocketClosed, client.err)
+			}
+		case <-deadline:
+			if client.pings.Load() == 0 {
+				return errors.New("expected the server to have pinged the client")
+			}
+			return nil
+		}
+	}
+}
+
+func theWebsocketIsClosed(ctx context.Context, how string) error {
+	client := ctx.Value(websocketClientKey{}).(*websocketClient)
+	for {
+		if _, err := nextWebsocketMessage(ctx); err != nil {
+			if !errors.Is(err, errWebsocketClosed) {
+				return err
+			}
+			break
+		}
+	}
+	goingAway := websocket.IsCloseError(client.err, websocket.CloseGoingAway)
+	if goingAway != (how == " as going away") {
+		return fmt.Errorf("expected the websocket to be closed%s, got %v", how, client.err)
+	}
+	if client.pings.Load() == 0 && how == " for not answering the pings" {
+		return errors.New("expected the server to have pinged the client")
+	}
+	return nil
+}
+
+// logBuffer takes the records of the loggers of all goroutines
+type logBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *logBuffer) lines() []string {
+	b.Lock()
+	defer b.Unlock()
+	return strings.Split(strings.TrimSpace(b.String()), "\n")
+}
+
+func theLogsAreWrittenAs(ctx context.Context, format, level string) context.Context {
+	previous, previousLevel := slog.Default(), logLevel.Level()
+	output, flags := log.Writer(), log.Flags()
+	ginWriter, ginErrorWriter := gin.DefaultWriter, gin.DefaultErrorWriter
+	config := DefaultConfig()
+	config.LogFormat = format
+	config.LogLevel = level
+	logs := &logBuffer{}
+	configureLogging(config, logs)
+	ctx = context.WithValue(ctx, logsKey{}, logs)
+	return context.WithValue(ctx, restoreLoggingKey{}, func() {
+		slog.SetDefault(previous)
+		// the log package had been redirected to the replaced logger
+		log.SetOutput(output)
+		log.SetFlags(flags)
+		logLevel.Set(previousLevel)
+		gin.DefaultWriter, gin.DefaultErrorWriter = ginWriter, ginErrorWriter
+	})
+}
+
+// requestRecordOf is the JSON record logged for the request, if any
+func requestRecordOf(ctx context.Context, method, route string) (map[string]any, error) {
+	for _, line := range ctx.Value(logsKey{}).(*logBuffer).lines() {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) != nil {
+			continue
+		}
+		if record["msg"] == "request" && record["method"] == method && record["path"] == route {
+			if record["replica"] == nil || record["region"] == nil {
+				return record, fmt.Errorf("expected the record to carry the replica and region, got %v", record)
+			}
+			return record, nil
+		}
+	}
+	return nil, nil
+}
+
+func theRequestIsLoggedAtLevel(ctx context.Context, method, route, level string) error {
+	record, err := requestRecordOf(ctx, method, route)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("%s %s not logged", method, route)
+	}
+	if record["level"] != level {
+		return fmt.Errorf("expected %s %s to be logged at %s, got %v", method, route, level, record)
+	}
+	return nil
+}
+
+func theRequestIsNotLogged(ctx context.Context, method, route string) error {
+	record, err := requestRecordOf(ctx, method, route)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		return fmt.Errorf("expected %s %s not to be logged, got %v", method, route, record)
+	}
+	return nil
+}
+
+func theRequestIsLoggedWithTheMachine(ctx context.Context, method, route, machine string) error {
+	record, err := requestRecordOf(ctx, method, route)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("%s %s not logged", method, route)
+	}
+	commandId := ctx.Value(responseKey{}).(*httptest.ResponseRecorder).Header().Get(CommandIdKey)
+	if record["machine"] != machine || commandId == "" || record["command_id"] != commandId {
+		return fmt.Errorf("expected %s %s to be logged with the machine %s and the command %s, got %v", method, route, machine, commandId, record)
+	}
+	return nil
+}
+
+func theRequestIsLoggedAsText(ctx context.Context, method, route string) error {
+	logs := ctx.Value(logsKey{}).(*logBuffer)
+	for _, line := range logs.lines() {
+		if strings.Contains(line, "msg=request ") && strings.Contains(line, fmt.Sprintf(" method=%s path=%s ", method, route)) {
+			if !strings.Contains(line, "replica=") || !strings.Contains(line, "region=") {
+				return fmt.Errorf("expected the record to carry the replica and region, got %s", line)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s not logged in:\n%s", method, route, strings.Join(logs.lines(), "\n"))
+}
+
+// the spans of the process, recorded once a scenario has traced the cluster,
+// as the tracer of the package is bound to the first provider set
+var (
+	recordedSpans   = tracetest.NewSpanRecorder()
+	recordSpansOnce sync.Once
+)
+
+// loopbackCluster delivers whatever is sent to its own listeners, as a peer would receive it
+type loopbackCluster struct {
+	listeners []zmqcluster.ClusterListener
+}
+
+func (c *loopbackCluster) UpdatePeers([]string) {}
+
+func (c *loopbackCluster) SendMessageToPeer(peer string, message []byte) {
+	c.BroadcastMessage(message)
+}
+
+func (c *loopbackCluster) BroadcastMessage(message []byte) {
+	for _, listener := range c.listeners {
+		listener.OnMessage([]byte("peer"), message)
+	}
+}
+
+func (c *loopbackCluster) Start() error { return nil }
+func (c *loopbackCluster) Stop()        {}
+
+func (c *loopbackCluster) AddListenerSync(listener zmqcluster.ClusterListener) {
+	c.listeners = append(c.listeners, listener)
+}
+
+func (c *loopbackCluster) AddListener(listener zmqcluster.ClusterListener) {
+	c.AddListenerSync(listener)
+}
+
+func (c *loopbackCluster) SetMyIP(string)    {}
+func (c *loopbackCluster) MyIP() string      { return "127.0.0.1" }
+func (c *loopbackCluster) MyTcpPort() string { return "5000" }
+
+// receivedMessages is a cluster listener keeping the messages received
+type receivedMessages struct {
+	messages [][]byte
+}
+
+func (r *receivedMessages) OnMessage(_ []byte, message []byte) {
+	r.messages = append(r.messages, message)
+}
+
+func (r *receivedMessages) OnMessageSent(string, []byte)                  {}
+func (r *receivedMessages) OnNewPeerConnected(zmqcluster.Cluster, string) {}
+
+func aTracedCluster(ctx context.Context) context.Context {
+	recordSpansOnce.Do(func() {
+		ConfigureTracing(context.Background(), DefaultConfig())
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recordedSpans)))
+	})
+	cluster := newTracedCluster(&loopbackCluster{})
+	received := &receivedMessages{}
+	cluster.AddListenerSync(received)
+	ctx = context.WithValue(ctx, tracedClusterKey{}, cluster)
+	return context.WithValue(ctx, receivedMessagesKey{}, received)
+}
+
+func theMessageIsSentToAPeer(ctx context.Context, message string) {
+	ctx.Value(tracedClusterKey{}).(zmqcluster.Cluster).SendMessageToPeer("peer", []byte(message))
+}
+
+func theMessageIsBroadcast(ctx context.Context, message string) {
+	ctx.Value(tracedClusterKey{}).(zmqcluster.Cluster).BroadcastMessage([]byte(message))
+}
+
+// lastMessageReceived is the message received, without the trace context
+func lastMessageReceived(ctx context.Context) (map[string]any, error) {
+	received := ctx.Value(receivedMessagesKey{}).(*receivedMessages)
+	if len(received.messages) == 0 {
+		return nil, errors.New("no message received")
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(received.messages[len(received.messages)-1], &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields[traceContextKey]; !ok {
+		return nil, fmt.Errorf("expected the %s in %v", traceContextKey, fields)
+	}
+	delete(fields, traceContextKey)
+	return fields, nil
+}
+
+func theMessageReceivedCarriesTheTraceContext(ctx context.Context, expected string) error {
+	fields, err := lastMessageReceived(ctx)
+	if err != nil {
+		return err
+	}
+	var expectedFields map[string]any
+	if err := json.Unmarshal([]byte(expected), &expectedFields); err != nil {
+		return err
+	}
+	if fmt.Sprint(fields) != fmt.Sprint(expectedFields) {
+		return fmt.Errorf("expected %v to be received, got %v", expectedFields, fields)
+	}
+	return nil
+}
+
+func theMessageIsReceivedUnchanged(ctx context.Context, message string) error {
+	received := ctx.Value(receivedMessagesKey{}).(*receivedMessages)
+	if len(received.messages) == 0 {
+		return errors.New("no message received")
+	}
+	if actual := string(received.messages[len(received.messages)-1]); actual != message {
+		return fmt.Errorf("expected '%s' to be received, got '%s'", message, actual)
+	}
+	return nil
+}
+
+// lastSpan is the span last ended by that name
+func lastSpan(name string) (sdktrace.ReadOnlySpan, error) {
+	spans := recordedSpans.Ended()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name() == name {
+			return spans[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no span '%s' recorded", name)
+}
+
+func theReceivingSpanContinuesTheTraceOf(ctx context.Context, verdict, sending string) error {
+	sent, err := lastSpan(sending)
+	if err != nil {
+		return err
+	}
+	received, err := lastSpan("cluster receive")
+	if err != nil {
+		return err
+	}
+	continued := received.Parent().SpanID() == sent.SpanContext().SpanID() &&
+		received.SpanContext().TraceID() == sent.SpanContext().TraceID()
+	if continued != (verdict == "continues") {
+		return fmt.Errorf("expected the receiving span to be a child of '%s': %v, got the parent %v", sending, verdict == "continues", received.Parent())
+	}
+	return nil
+}
+
+func theCommandIsSubmittedToTheServer(ctx context.Context, command string) (context.Context, error) {
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	outcome := server.submitCommand(context.Background(), server.machines.Default(), command, RunParameters{})
+	return context.WithValue(ctx, commandKey{}, outcome), nil
+}
+
+func theMachineIsDeletedLeavingItsSchedules(ctx context.Context, id string) error {
+	return ctx.Value(serverKey{}).(*Server).machines.Delete(id)
+}
+
+func theReadinessCheckIs(ctx context.Context, check, verdict string) error {
+	response := ctx.Value(responseKey{}).(*httptest.ResponseRecorder)
+	var readiness struct {
+		Checks map[string]bool `json:"checks"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &readiness); err != nil {
+		return err
+	}
+	passed, found := readiness.Checks[check]
+	if !found {
+		return fmt.Errorf("no readiness check '%s' in %s", check, response.Body.String())
+	}
+	if passed != (verdict == "passed") {
+		return fmt.Errorf("expected the readiness check '%s' to be %s: %s", check, verdict, response.Body.String())
+	}
+	return nil
+}
+
+func theRequestIsAnsweredWith(ctx context.Context, status int) error {
+	response := ctx.Value(responseKey{}).(*httptest.ResponseRecorder)
+	if response.Code != status {
+		return fmt.Errorf("expected %d, got %d: %s", status, response.Code, response.Body.String())
+	}
+	if status == http.StatusUnauthorized && response.Header().Get("WWW-Authenticate") == "" {
+		return errors.New("expected a challenge to authenticate")
+	}
+	return nil
+}
+
+func theSystemIsRequestedWithTheCredentials(ctx context.Context, command, credentials string) (context.Context, error) {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return ctx, errSutNotFound
+	}
+	auth, err := authenticationWith(ctx, credentials)
+	if err != nil {
+		return ctx, err
+	}
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	outcome := server.submitCommand(withAuthentication(context.Background(), auth), sut, command, RunParameters{})
+	return context.WithValue(ctx, commandKey{}, outcome), nil
+}
+
+func theRejectionReasonMentions(ctx context.Context, reason string) error {
+	outcome, ok := ctx.Value(commandKey{}).(commandOutcome)
+	if !ok {
+		return errCommandNotFound
+	}
+	if !strings.Contains(outcome.Reason, reason) {
+		return fmt.Errorf("expected the reason to mention '%s', got '%s'", reason, outcome.Reason)
+	}
+	return nil
+}
+
+// serverUnderTest serves the routes with the config under test
+func serverUnderTest(ctx context.Context) (context.Context, *Server, error) {
+	if server, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return ctx, server, nil
+	}
+	config, ok := ctx.Value(configUnderTestKey{}).(Config)
+	if !ok {
+		return ctx, nil, errors.New("no config under test, check step definitions")
+	}
+	return newTestServer(ctx, config)
+}
+
+// closedStreamRecorder records the responses of streams closed right after their first events
+type closedStreamRecorder struct {
+	*httptest.ResponseRecorder
+	closed chan bool
+}
+
+func newClosedStreamRecorder() closedStreamRecorder {
+	closed := make(chan bool)
+	close(closed)
+	return closedStreamRecorder{httptest.NewRecorder(), closed}
+}
+
+func (r closedStreamRecorder) CloseNotify() <-chan bool {
+	return r.closed
+}
+
+// callerAddress tells the named callers apart by their forwarded address
+func callerAddress(caller string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(caller))
+	sum := hash.Sum32()
+	return fmt.Sprintf("10.%d.%d.%d", byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+func requestsTheSystemTimes(ctx context.Context, caller, command string, times int) (context.Context, error) {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return ctx, errSutNotFound
+	}
+	ctx, server, err := serverUnderTest(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	callerContext := context.WithValue(context.Background(), rateLimitKey{}, "identity:"+caller)
+	var outcome commandOutcome
+	for i := 0; i < times; i++ {
+		outcome = server.submitCommand(callerContext, sut, command, RunParameters{})
+	}
+	return context.WithValue(ctx, commandKey{}, outcome), nil
+}
+
+func requestsTimes(ctx context.Context, caller, route string, times int) (context.Context, error) {
+	ctx, server, err := serverUnderTest(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	var response closedStreamRecorder
+	for i := 0; i < times; i++ {
+		r := httptest.NewRequest(http.MethodGet, route, nil)
+		r.Header.Set("X-Forwarded-For", callerAddress(caller))
+		response = newClosedStreamRecorder()
+		server.server.ServeHTTP(response, r)
+	}
+	return context.WithValue(ctx, responseKey{}, response.ResponseRecorder), nil
+}
+
+func theResponseHeaderIs(ctx context.Context, header, expected string) error {
+	response := ctx.Value(responseKey{}).(*httptest.ResponseRecorder)
+	if actual := response.Header().Get(header); actual != expected {
+		return fmt.Errorf("expected %s to be '%s', got '%s'", header, expected, actual)
+	}
+	return nil
+}
+
+func aDirectoryForTheCertificates(ctx context.Context) (context.Context, error) {
+	directory, err := os.MkdirTemp("", "mermaidlive-tls-")
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, tlsDirectoryKey{}, directory), nil
+}
+
+func certificateFiles(ctx context.Context) (string, string) {
+	directory := ctx.Value(tlsDirectoryKey{}).(string)
+	return filepath.Join(directory, "cert.pem"), filepath.Join(directory, "key.pem")
+}
+
+func aCertificateForInTheDirectory(ctx context.Context, host string) (context.Context, error) {
+	ctx, err := aDirectoryForTheCertificates(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	certFile, keyFile := certificateFiles(ctx)
+	return ctx, writeSelfSignedCertificate(certFile, keyFile, []string{host}, time.Hour)
+}
+
+func aDevelopmentCertificateValidForInTheDirectory(ctx context.Context, validity string) (context.Context, error) {
+	duration, err := time.ParseDuration(validity)
+	if err != nil {
+		return ctx, err
+	}
+	directory := ctx.Value(tlsDirectoryKey{}).(string)
+	certFile, keyFile := filepath.Join(directory, devCertificateFile), filepath.Join(directory, devKeyFile)
+	return ctx, writeSelfSignedCertificate(certFile, keyFile, []string{"localhost"}, duration)
+}
+
+func thePresentedCertificateIsValidForAtLeast(ctx context.Context, validity string) error {
+	duration, err := time.ParseDuration(validity)
+	if err != nil {
+		return err
+	}
+	certificate := ctx.Value(presentedCertificateKey{}).(*x509.Certificate)
+	if time.Until(certificate.NotAfter) < duration {
+		return fmt.Errorf("expected the certificate to be valid for at least %s, it expires at %v", duration, certificate.NotAfter)
+	}
+	return nil
+}
+
+func thePresentedCertificateIsNotACA(ctx context.Context) error {
+	certificate := ctx.Value(presentedCertificateKey{}).(*x509.Certificate)
+	if certificate.IsCA || certificate.KeyUsage&x509.KeyUsageCertSign != 0 {
+		return errors.New("expected a serving certificate, not a CA")
+	}
+	return nil
+}
+
+// startTLSServer serves TLS on a random local port, replacing the server of the scenario, if any
+func startTLSServer(ctx context.Context, config Config) (context.Context, error) {
+	stopTLSServer(ctx)
+	server := &Server{
+		config: config,
+		httpServer: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+		},
+	}
+	if err := server.configureTLS(); err != nil {
+		return ctx, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return ctx, err
+	}
+	server.httpServer.Addr = listener.Addr().String()
+	go server.httpServer.ServeTLS(listener, "", "")
+	return context.WithValue(ctx, tlsServerKey{}, server), nil
+}
+
+func stopTLSServer(ctx context.Context) {
+	if server, ok := ctx.Value(tlsServerKey{}).(*Server); ok {
+		server.httpServer.Close()
+		server.closeCertificateWatcher()
+	}
+}
+
+func theServerIsStopped(ctx context.Context) {
+	stopTLSServer(ctx)
+}
+
+func theCertificateFilesAreNoLongerWatched(ctx context.Context) error {
+	server, ok := ctx.Value(tlsServerKey{}).(*Server)
+	if !ok {
+		return errors.New("no server started, check step definitions")
+	}
+	if err := server.certificateWatcher.Add(ctx.Value(tlsDirectoryKey{}).(string)); !errors.Is(err, fsnotify.ErrClosed) {
+		return fmt.Errorf("expected the certificate watcher to be closed, got %v", err)
+	}
+	return nil
+}
+
+func theServerIsStartedWithASelfSignedCertificate(ctx context.Context) (context.Context, error) {
+	return startTLSServer(ctx, Config{
+		TLSSelfSigned:    true,
+		CounterDirectory: ctx.Value(tlsDirectoryKey{}).(string),
+	})
+}
+
+func theServerIsStartedWithTheCertificate(ctx context.Context) (context.Context, error) {
+	certFile, keyFile := certificateFiles(ctx)
+	return startTLSServer(ctx, Config{TLSCertFile: certFile, TLSKeyFile: keyFile})
+}
+
+func presentedCertificate(ctx context.Context) (*x509.Certificate, error) {
+	server, ok := ctx.Value(tlsServerKey{}).(*Server)
+	if !ok {
+		return nil, errors.New("no server started, check step definitions")
+	}
+	connection, err := tls.Dial("tcp", server.httpServer.Addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+	return connection.ConnectionState().PeerCertificates[0], nil
+}
+
+func theServerPresentsACertificateFor(ctx context.Context, host string) (context.Context, error) {
+	var certificate *x509.Certificate
+	var err error
+	// the files are reloaded once they settle
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if certificate, err = presentedCertificate(ctx); err == nil && certificate.VerifyHostname(host) == nil {
+			return context.WithValue(ctx, presentedCertificateKey{}, certificate), nil
+		}
+	}
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, fmt.Errorf("expected a certificate for %s, got one for %v", host, certificate.DNSNames)
+}
+
+func theServerStillPresentsACertificateFor(ctx context.Context, host string) error {
+	time.Sleep(3 * fileSettleDelay)
+	certificate, err := presentedCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	return certificate.VerifyHostname(host)
+}
+
+func theSameCertificateIsPresented(ctx context.Context) error {
+	previous := ctx.Value(presentedCertificateKey{}).(*x509.Certificate)
+	certificate, err := presentedCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certificate.Raw, previous.Raw) {
+		return errors.New("expected the certificate to be reused")
+	}
+	return nil
+}
+
+func http2IsNegotiated(ctx context.Context) error {
+	server := ctx.Value(tlsServerKey{}).(*Server)
+	client := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	}}
+	defer client.CloseIdleConnections()
+	response, err := client.Get("https://" + server.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.ProtoMajor != 2 {
+		return fmt.Errorf("expected HTTP/2, got %s", response.Proto)
+	}
+	return nil
+}
+
+func theCertificateIsReplacedByOneFor(ctx context.Context, host string) error {
+	certFile, keyFile := certificateFiles(ctx)
+	return writeSelfSignedCertificate(certFile, keyFile, []string{host}, time.Hour)
+}
+
+func theCertificateFileIsOverwrittenWith(ctx context.Context, content string) error {
+	certFile, _ := certificateFiles(ctx)
+	return os.WriteFile(certFile, []byte(content), 0o644)
+}
+
+// aSchedulingSystemInState serves the default machine of a registry, scheduling into a temporary directory
+func aSchedulingSystemInState(ctx context.Context, state string) (context.Context, error) {
+	const delay = 10 * time.Millisecond
+	const pubSubChannelCapacity = 10
+	ctx, _ = configureSUT(ctx, delay, pubSubChannelCapacity)
+	ctx, _, err := newTestServer(ctx, testConfig())
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, theSystemIsFoundInState(ctx, state)
+}
+
+func isScheduled(ctx context.Context, command, when, value string) (context.Context, error) {
+	return isScheduledFor(ctx, command, "", when, value)
+}
+
+func isScheduledFor(ctx context.Context, command, machine, when, value string) (context.Context, error) {
+	server := ctx.Value(serverKey{}).(*Server)
+	request := ScheduleRequest{Command: command, Machine: machine}
+	switch when {
+	case "after":
+		request.After = value
+	case "at":
+		request.At = value
+	case "by cron":
+		request.Cron = value
+	}
+	schedule, err := server.createSchedule(context.Background(), request)
+	if err != nil {
+		return context.WithValue(ctx, scheduleErrorKey{}, err), nil
+	}
+	return context.WithValue(ctx, scheduleKey{}, schedule), nil
+}
+
+func scheduleOf(ctx context.Context) (Schedule, error) {
+	schedule, ok := ctx.Value(scheduleKey{}).(Schedule)
+	if !ok {
+		if err, rejected := ctx.Value(scheduleErrorKey{}).(error); rejected {
+			return schedule, fmt.Errorf("the schedule was rejected: %w", err)
+		}
+		return schedule, errors.New("nothing scheduled, check step definitions")
+	}
+	return schedule, nil
+}
+
+func theScheduleFiresWithTheResult(ctx context.Context, result string) error {
+	schedule, err := scheduleOf(ctx)
+	if err != nil {
+		return err
+	}
+	events, err := receiveEventsTill(ctx, ScheduledCommandFiredEvent, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	fired := events[len(events)-1]
+	if fired.Properties["schedule_id"] != schedule.Id || fmt.Sprint(fired.Properties["result"]) != result {
+		return fmt.Errorf("expected schedule %s to fire with the result %s, got %v", schedule.Id, result, fired.Properties)
+	}
+	if fired.CommandId == "" {
+		return errors.New("expected the fired command to carry its id")
+	}
+	return nil
+}
+
+func theScheduleDoesNotFireWithin(ctx context.Context, timeout string) error {
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return err
+	}
+	if _, err := receiveEventsTill(ctx, ScheduledCommandFiredEvent, duration); err == nil {
+		return errors.New("expected the schedule not to fire")
+	}
+	return nil
+}
+
+func schedulesArePending(ctx context.Context, count int) error {
+	if pending := ctx.Value(serverKey{}).(*Server).schedules.List(); len(pending) != count {
+		return fmt.Errorf("expected %d pending schedules, got %v", count, pending)
+	}
+	return nil
+}
+
+func noScheduleIsPending(ctx context.Context) error {
+	return schedulesArePending(ctx, 0)
+}
+
+func theScheduleIsCanceled(ctx context.Context) error {
+	schedule, err := scheduleOf(ctx)
+	if err != nil {
+		return err
+	}
+	return ctx.Value(serverKey{}).(*Server).schedules.Cancel(schedule.Id)
+}
+
+func theSchedulerIsRestarted(ctx context.Context) {
+	server := ctx.Value(serverKey{}).(*Server)
+	server.schedules.Stop()
+	server.schedules = NewScheduler(NewFileScheduleStore(server.config.CounterDirectory), server.fireSchedule)
+}
+
+func theScheduleIsStillPending(ctx context.Context) error {
+	schedule, err := scheduleOf(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pending := range ctx.Value(serverKey{}).(*Server).schedules.List() {
+		if pending.Id == schedule.Id && pending.NextRun.Equal(schedule.NextRun) && pending.Command == schedule.Command {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected schedule %s to be pending", schedule.Id)
+}
+
+func theScheduleIsRejectedFor(ctx context.Context, reason string) error {
+	err, ok := ctx.Value(scheduleErrorKey{}).(error)
+	if !ok {
+		return errors.New("expected the schedule to be rejected")
+	}
+	return errorMentions(err, reason)
+}
+
+// theSystemIsRequestedWithTheParameters posts the command with the parameters as its body
+func theSystemIsRequestedWithTheParameters(ctx context.Context, command, parameters string) (context.Context, error) {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return ctx, errSutNotFound
+	}
+	ctx, server, err := testServerOf(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	if server.machines.Default() != sut {
+		return ctx, errors.New("the server does not serve the system, check step definitions")
+	}
+	response := httptest.NewRecorder()
+	server.server.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/commands/"+command, strings.NewReader(parameters)))
+	var outcome commandOutcome
+	if err := json.Unmarshal(response.Body.Bytes(), &outcome); err != nil {
+		return ctx, fmt.Errorf("unexpected response %d: %s", response.Code, response.Body.String())
+	}
+	return context.WithValue(ctx, commandKey{}, outcome), nil
+}
+
+// hasProperties checks the properties listed as "key: value, ..."
+func hasProperties(event Event, expected string) error {
+	for _, property := range strings.Split(expected, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(property), ":")
+		if actual := fmt.Sprint(event.Properties[key]); actual != strings.TrimSpace(value) {
+			return fmt.Errorf("expected %s of %s to be '%s', got '%s'", key, event.Name, strings.TrimSpace(value), actual)
+		}
+	}
+	return nil
+}
+
+func echoesTheParameters(ctx context.Context, eventName, expected string) error {
+	events, err := receiveEventsTill(ctx, eventName, 1*time.Second)
+	if err != nil {
+		return err
+	}
+	return hasProperties(events[len(events)-1], expected)
+}
+
+func theTicksArePublishedBeforeTheWorkIsCompleted(ctx context.Context, expected string) error {
+	events, err := receiveEventsTill(ctx, "WorkDone", 2*time.Second)
+	if err != nil {
+		return err
+	}
+	ticks := []string{}
+	for _, event := range events {
+		if event.Name == DefaultTickEvent {
+			ticks = append(ticks, fmt.Sprint(event.Properties["param"]))
+		}
+	}
+	if actual := strings.Join(ticks, ", "); actual != expected {
+		return fmt.Errorf("expected the ticks %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+func theLastSeenStateIs(ctx context.Context, expected string) error {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return errSutNotFound
+	}
+	return hasProperties(sut.LastSeenState(), expected)
+}
+
+// theWorkIsPaused notes the count the paused run holds
+func theWorkIsPaused(ctx context.Context) (context.Context, error) {
+	events, err := receiveEventsTill(ctx, "WorkPaused", 1*time.Second)
+	if err != nil {
+		return ctx, err
+	}
+	remaining, ok := events[len(events)-1].Properties["remaining"]
+	if !ok {
+		return ctx, errors.New("expected WorkPaused to carry the remaining count")
+	}
+	return context.WithValue(ctx, pausedCountKey{}, countOf(remaining)), nil
+}
+
+func noTickIsPublishedWithin(ctx context.Context, timeout string) error {
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return err
+	}
+	if _, err := receiveEventsTill(ctx, DefaultTickEvent, duration); err == nil {
+		return errors.New("expected no tick to be published")
+	}
+	return nil
+}
+
+func thePausedCountIsKept(ctx context.Context) error {
+	paused, ok := ctx.Value(pausedCountKey{}).(uint8)
+	if !ok {
+		return errors.New("no paused count, check step definitions")
+	}
+	return theLastSeenStateIs(ctx, fmt.Sprintf("param: paused, remaining: %d", paused))
+}
+
+func theTicksContinueFromThePausedCountBeforeTheWorkIsCompleted(ctx context.Context) error {
+	paused, ok := ctx.Value(pausedCountKey{}).(uint8)
+	if !ok {
+		return errors.New("no paused count, check step definitions")
+	}
+	ticks := []string{}
+	for count := paused; count > 0; count-- {
+		ticks = append(ticks, fmt.Sprint(count))
+	}
+	return theTicksArePublishedBeforeTheWorkIsCompleted(ctx, strings.Join(ticks, ", "))
+}
+
+func aSystemWithAWorkQueueInState(ctx context.Context, depth int, state string) (context.Context, error) {
+	ctx, err := startFromMachineInState(ctx, state)
+	if err != nil {
+		return ctx, err
+	}
+	ctx.Value(machinesKey{}).(*MachineRegistry).SetWorkQueueDepth(depth)
+	return ctx, nil
+}
+
+// theCommandIsQueued notes the id of the queued command, as the command outcome is replaced by the next one
+func theCommandIsQueued(ctx context.Context) (context.Context, error) {
+	if err := theCommandIsReportedAs(ctx, string(CommandQueued)); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, queuedCommandKey{}, ctx.Value(commandKey{}).(commandOutcome).CommandId), nil
+}
+
+func commandsAreQueued(ctx context.Context, count int) error {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return errSutNotFound
+	}
+	if queue := sut.Queue(); len(queue) != count {
+		return fmt.Errorf("expected %d queued commands, got %v", count, queue)
+	}
+	return nil
+}
+
+func theQueueIsListedWithCommands(ctx context.Context, machine string, count int) error {
+	if err := theRequestIsAnsweredWith(ctx, http.StatusOK); err != nil {
+		return err
+	}
+	var listed struct {
+		Machine string       `json:"machine"`
+		Queue   []QueuedWork `json:"queue"`
+	}
+	response := ctx.Value(responseKey{}).(*httptest.ResponseRecorder)
+	if err := json.Unmarshal(response.Body.Bytes(), &listed); err != nil {
+		return err
+	}
+	if listed.Machine != machine || len(listed.Queue) != count {
+		return fmt.Errorf("expected %d queued commands of '%s', got %s", count, machine, response.Body.String())
+	}
+	return nil
+}
+
+func noCommandIsQueued(ctx context.Context) error {
+	return commandsAreQueued(ctx, 0)
+}
+
+func theQueuedCommandIsCanceled(ctx context.Context) error {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return errSutNotFound
+	}
+	return sut.CancelQueued(ctx.Value(queuedCommandKey{}).(string))
+}
+
+func anUnknownQueuedCommandCannotBeCanceled(ctx context.Context) error {
+	sut, ok := ctx.Value(sutKey{}).(*AsyncFSM)
+	if !ok {
+		return errSutNotFound
+	}
+	if err := sut.CancelQueued(NewCommandId()); !errors.Is(err, errQueuedWorkNotFound) {
+		return fmt.Errorf("expected %v, got %v", errQueuedWorkNotFound, err)
+	}
+	return nil
+}
+
+// theQueuedCommandIsDequeued checks the WorkDequeued event of the queued command, and the events following it
+func theQueuedCommandIsDequeued(ctx context.Context, reason string) (context.Context, error) {
+	queued, _ := ctx.Value(queuedCommandKey{}).(string)
+	events, err := receiveEventsTill(ctx, "WorkDequeued", 2*time.Second)
+	if err != nil {
+		return ctx, err
+	}
+	if err := hasProperties(events[len(events)-1], "id: "+queued+", reason: "+reason); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, commandKey{}, commandOutcome{CommandId: queued}), nil
+}
+
+func TestUnit(t *testing.T) {
+	suite := godog.TestSuite{
+		ScenarioInitializer: InitializeScenario,
+		Options:             &opts,
+	}
+
+	if suite.Run() != 0 {
+		t.Fatal("non-zero status returned, failed to run feature tests")
+	}
+}
+
+func InitializeScenario(ctx *godog.ScenarioContext) {
+	ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		if journal, ok := ctx.Value(journalKey{}).(*FileEventJournal); ok {
+			journal.Close()
+			os.RemoveAll(journal.directory)
+		}
+		if subscription, ok := ctx.Value(subscriptionKey{}).(*Subscription); ok {
+			subscription.Close()
+		}
+		if observer, ok := ctx.Value(observerSubscriptionKey{}).(*Subscription); ok {
+			observer.Close()
+		}
+		if buffer, ok := ctx.Value(replayBufferKey{}).(*ReplayBuffer); ok {
+			buffer.Close()
+		}
+		if file, ok := os.LookupEnv("MML_CONFIG"); ok && strings.Contains(file, "mermaidlive-config-") {
+			os.Remove(file)
+		}
+		stopTLSServer(ctx)
+		if server, ok := ctx.Value(serverKey{}).(*Server); ok && server.schedules != nil {
+			server.schedules.Stop()
+		}
+		if restoreLogging, ok := ctx.Value(restoreLoggingKey{}).(func()); ok {
+			restoreLogging()
+		}
+		if client, ok := ctx.Value(websocketClientKey{}).(*websocketClient); ok {
+			client.conn.Close()
+		}
+		if stream, ok := ctx.Value(sseStreamKey{}).(*sseStream); ok {
+			stream.response.Body.Close()
+		}
+		if httpServer, ok := ctx.Value(httpServerKey{}).(*httptest.Server); ok {
+			httpServer.CloseClientConnections()
+			httpServer.Close()
+		}
+		if shutdown, ok := ctx.Value(serverShutdownKey{}).(context.CancelFunc); ok {
+			shutdown()
+		}
+		if directory, ok := ctx.Value(serverDirectoryKey{}).(string); ok {
+			os.RemoveAll(directory)
+		}
+		if directory, ok := ctx.Value(tlsDirectoryKey{}).(string); ok {
+			os.RemoveAll(directory)
+		}
+		restoreEnvironment(ctx)
+		return unsubscribeListener(ctx), nil
+	})
+	ctx.Step(`^a system in state "(\S+)"$`, startFromMachineInState)
+	ctx.Step(`^a system with a delay of "(\S+)" in state "(\S+)"$`, startFromSlowMachineInState)
+	ctx.Step(`^the config file$`, theConfigFile)
+	ctx.Step(`^the environment variable "(\S+)" is "([^"]*)"$`, theEnvironmentVariableIs)
+	ctx.Step(`^the config is loaded with the flags "([^"]*)"$`, theConfigIsLoadedWithTheFlags)
+	ctx.Step(`^the setting "(\S+)" is "([^"]*)"$`, theSettingIs)
+	ctx.Step(`^the config is rejected for "([^"]*)"$`, theConfigIsRejectedFor)
+	ctx.Step(`^the config file is changed to$`, theConfigFileIsChangedTo)
+	ctx.Step(`^the config is reloaded$`, theConfigIsReloaded)
+	ctx.Step(`^"(\S+)" is published with the changes to "([^"]*)"$`, isPublishedWithTheChangesTo)
+	ctx.Step(`^no config change is published$`, noConfigChangeIsPublished)
+	ctx.Step(`^the config update is rejected for "([^"]*)"$`, theConfigUpdateIsRejectedFor)
+	ctx.Step(`^the auth config$`, theConfigUnderTest)
+	ctx.Step(`^the rate limits$`, theConfigUnderTest)
+	ctx.Step(`^"(\S+)" requests the system "(\S+)" (\d+) times?$`, requestsTheSystemTimes)
+	ctx.Step(`^"(\S+)" requests "(\S+)" (\d+) times?$`, requestsTimes)
+	ctx.Step(`^the response header "(\S+)" is "([^"]*)"$`, theResponseHeaderIs)
+	ctx.Step(`^a request carries the credentials "([^"]*)"$`, aRequestCarriesTheCredentials)
+	ctx.Step(`^the caller is identified as "([^"]*)" in the role "(\S+)"$`, theCallerIsIdentifiedAsInTheRole)
+	ctx.Step(`^the caller is rejected because of "([^"]*)"$`, theCallerIsRejectedBecauseOf)
+	ctx.Step(`^a route requiring the role "(\S+)" is requested with the credentials "([^"]*)"$`, aRouteRequiringTheRoleIsRequestedWithTheCredentials)
+	ctx.Step(`^the request is answered with (\d+)$`, theRequestIsAnsweredWith)
+	ctx.Step(`^a server$`, aServer)
+	ctx.Step(`^a server whose counters fail to load$`, aServerWhoseCountersFailToLoad)
+	ctx.Step(`^"(\S+) (\S+)" is requested$`, theRouteIsRequested)
+	ctx.Step(`^"(\S+) (\S+)" is requested with '([^']*)'$`, theRouteIsRequestedWith)
+	ctx.Step(`^the machine "(\S+)" is created$`, theMachineIsCreated)
+	ctx.Step(`^the machine "(\S+)" is deleted$`, theMachineIsDeleted)
+	ctx.Step(`^the machine "(\S+)" is deleted leaving its schedules$`, theMachineIsDeletedLeavingItsSchedules)
+	ctx.Step(`^(\d+) machines are created$`, machinesAreCreated)
+	ctx.Step(`^the server sends heartbeats every "(\S+)"$`, theServerSendsHeartbeatsEvery)
+	ctx.Step(`^an SSE client connects to "(\S+)"$`, anSSEClientConnectsTo)
+	ctx.Step(`^the stream starts with a retry of (\d+)ms$`, theStreamStartsWithARetryOf)
+	ctx.Step(`^the SSE event "(\S+)" is received$`, theSSEEventIsReceived)
+	ctx.Step(`^it is sent (with|without) an id$`, theSSEEventCarriesAnId)
+	ctx.Step(`^a heartbeat is received$`, aHeartbeatIsReceived)
+	ctx.Step(`^the SSE stream ends$`, theSSEStreamEnds)
+	ctx.Step(`^the server shuts down$`, theServerShutsDown)
+	ctx.Step(`^the command "(\S+)" is submitted to the server$`, theCommandIsSubmittedToTheServer)
+	ctx.Step(`^the machine definition$`, theMachineDefinition)
+	ctx.Step(`^a system of that definition in state "(\S+)"$`, aSystemOfThatDefinitionInState)
+	ctx.Step(`^the machine definition is rejected for "([^"]*)"$`, theMachineDefinitionIsRejectedFor)
+	ctx.Step(`^a traced cluster$`, aTracedCluster)
+	ctx.Step(`^'([^']*)' is sent to a peer$`, theMessageIsSentToAPeer)
+	ctx.Step(`^'([^']*)' is broadcast$`, theMessageIsBroadcast)
+	ctx.Step(`^'([^']*)' is received with the trace context$`, theMessageReceivedCarriesTheTraceContext)
+	ctx.Step(`^'([^']*)' is received unchanged$`, theMessageIsReceivedUnchanged)
+	ctx.Step(`^the receiving span (continues|does not continue) the trace of "([^"]*)"$`, theReceivingSpanContinuesTheTraceOf)
+	ctx.Step(`^the logs are written as "(text|json)" at level "(\S+)"$`, theLogsAreWrittenAs)
+	ctx.Step(`^the request "(\S+) (\S+)" is logged at level "(\S+)"$`, theRequestIsLoggedAtLevel)
+	ctx.Step(`^the request "(\S+) (\S+)" is not logged$`, theRequestIsNotLogged)
+	ctx.Step(`^the request "(\S+) (\S+)" is logged with the machine "(\S+)" and the id of the command$`, theRequestIsLoggedWithTheMachine)
+	ctx.Step(`^the request "(\S+) (\S+)" is logged as text$`, theRequestIsLoggedAsText)
+	ctx.Step(`^a websocket client (answering|not answering) the pings connects to "(\S+)"$`, aWebsocketClientConnectsTo)
+	ctx.Step(`^the websocket client sends the command "(\S+)" as "(\S+)"$`, theWebsocketClientSendsTheCommand)
+	ctx.Step(`^the websocket client sends '([^']*)'$`, theWebsocketClientSends)
+	ctx.Step(`^the websocket event "(\S+)" is received$`, theWebsocketEventIsReceived)
+	ctx.Step(`^the result "(\S+)" of "(\S+)" is received before "(\S+)"$`, theResultIsReceivedBefore)
+	ctx.Step(`^the result "(\S+)" of "(\S+)" is received$`, theResultIsReceived)
+	ctx.Step(`^the websocket error mentioning "([^"]*)" is received$`, theWebsocketErrorIsReceived)
+	ctx.Step(`^the websocket stays open for "(\S+)"$`, theWebsocketStaysOpenFor)
+	ctx.Step(`^the websocket is closed( as going away| for not answering the pings)$`, theWebsocketIsClosed)
+	ctx.Step(`^a replay buffer of (\d+) events$`, aReplayBufferOfEvents)
+	ctx.Step(`^(\d+) ticks are published$`, ticksArePublished)
+	ctx.Step(`^the replay is resumed after (.+)$`, theReplayIsResumedAfter)
+	ctx.Step(`^the ticks "([^"]*)" are replayed (completely|incompletely)$`, theTicksAreReplayed)
+	ctx.Step(`^"(\S+)" has been buffered$`, theEventsOfTheSystemAreBuffered)
+	ctx.Step(`^the stream is resumed after (.+)$`, theStreamIsResumedAfter)
+	ctx.Step(`^the stream (replays|does not replay) "([^"]*)"$`, theStreamReplays)
+	ctx.Step(`^the diagram is requested$`, theDiagramIsRequested)
+	ctx.Step(`^the default machine is rendered in state "(\S*)" with the progress "([^"]*)"$`, theDefaultMachineIsRenderedInStateWithTheProgress)
+	ctx.Step(`^the diagram is$`, theDiagramIs)
+	ctx.Step(`^the diagram highlights ("\S+"|no state)$`, theDiagramHighlights)
+	ctx.Step(`^the diagram notes "([^"]*)" on "(\S+)"$`, func(ctx context.Context, note, state string) error {
+		return theDiagramNotes(ctx, state, note)
+	})
+	ctx.Step(`^the diagram has no note$`, theDiagramHasNoNote)
+	ctx.Step(`^the machines "([^"]*)" are listed$`, theMachinesAreListed)
+	ctx.Step(`^the reason given mentions "([^"]*)"$`, theReasonGivenMentions)
+	ctx.Step(`^the server is restarted$`, theServerIsRestarted)
+	ctx.Step(`^the readiness check "(\S+)" has (passed|failed)$`, theReadinessCheckIs)
+	ctx.Step(`^the system "([^"]*)" is requested with the credentials "([^"]*)"$`, theSystemIsRequestedWithTheCredentials)
+	ctx.Step(`^the rejection reason mentions "([^"]*)"$`, theRejectionReasonMentions)
+	ctx.Step(`^a system loaded from "([^"]*)" in state "(\S+)"$`, startFromLoadedMachineInState)
+	ctx.Step(`^the system is found in state "([^"]*)"$`, theSystemIsFoundInState)
+	ctx.Step(`^the system "([^"]*)" is requested$`, theCommandIsCast)
+	ctx.Step(`^the request is ignored$`, theRequestIsIgnored)
+	ctx.Step(`^the command is reported as "(\S+)"$`, theCommandIsReportedAs)
+	ctx.Step(`^"(\S+)" carries the id of the command$`, eventCarriesTheIdOfTheCommand)
+	ctx.Step(`^a stream filtered by "([^"]*)"$`, aStreamFilteredBy)
+	ctx.Step(`^a subscriber with a queue of (\d+) events overflowing by "(\S+)"$`, aSubscriberWithAQueueOverflowingBy)
+	ctx.Step(`^(\d+) ticks are published while the subscriber stalls$`, ticksArePublishedWhileTheSubscriberStalls)
+	ctx.Step(`^the subscriber receives the ticks "([^"]*)"$`, theSubscriberReceivesTheTicks)
+	ctx.Step(`^the lagging subscriber is announced$`, theLaggingSubscriberIsAnnounced)
+	ctx.Step(`^the metrics count at least (\d+) of '([^']*)'$`, theMetricsCountAtLeast)
+	ctx.Step(`^the metrics do not list '([^']*)'$`, theMetricsDoNotList)
+	ctx.Step(`^a "(\S+)" event of machine "(\S*)" with "([^"]*)" is (streamed|dropped)$`, anEventOfMachineIs)
+	ctx.Step(`^some work has progressed$`, someWorkHasProgressed)
+	ctx.Step(`^work is completed$`, workIsCompleted)
+	ctx.Step(`^work is canceled$`, workIsCanceled)
+	ctx.Step(`^a system interrupted in state "(\S+)" at (\d+) recovered by "(\S+)"$`, aSystemInterruptedInStateRecoveredBy)
+	ctx.Step(`^a system interrupted in state "(\S+)" at (\d+) with "(\S+)" queued recovered by "(\S+)"$`, aSystemInterruptedWithQueuedWorkRecoveredBy)
+	ctx.Step(`^work is recovered$`, workIsRecovered)
+	ctx.Step(`^a server journaling the machines$`, aServerJournalingTheMachines)
+	ctx.Step(`^a journal of (\d+) files of at most (\d+) bytes$`, aJournalOfFilesOfAtMostBytes)
+	ctx.Step(`^(\d+) events are journaled$`, eventsAreJournaled)
+	ctx.Step(`^the journal reads the events "([^"]*)"$`, theJournalReadsTheEvents)
+	ctx.Step(`^the journal is deleted$`, theJournalIsDeleted)
+	ctx.Step(`^no journal file is left$`, noJournalFileIsLeft)
+	ctx.Step(`^the history of "(\S+)" (lists|does not list) "(\S+)"$`, theHistoryOfTheMachineLists)
+	ctx.Step(`^a directory for the certificates$`, aDirectoryForTheCertificates)
+	ctx.Step(`^a certificate for "(\S+)" in the directory$`, aCertificateForInTheDirectory)
+	ctx.Step(`^the server is started with a self-signed certificate$`, theServerIsStartedWithASelfSignedCertificate)
+	ctx.Step(`^the server is started with the certificate$`, theServerIsStartedWithTheCertificate)
+	ctx.Step(`^the server presents a certificate for "(\S+)"$`, theServerPresentsACertificateFor)
+	ctx.Step(`^the server still presents a certificate for "(\S+)"$`, theServerStillPresentsACertificateFor)
+	ctx.Step(`^the same certificate is presented$`, theSameCertificateIsPresented)
+	ctx.Step(`^a development certificate valid for "(\S+)" in the directory$`, aDevelopmentCertificateValidForInTheDirectory)
+	ctx.Step(`^the certificate is valid for at least "(\S+)"$`, thePresentedCertificateIsValidForAtLeast)
+	ctx.Step(`^the certificate may not sign other certificates$`, thePresentedCertificateIsNotACA)
+	ctx.Step(`^HTTP/2 is negotiated$`, http2IsNegotiated)
+	ctx.Step(`^the certificate is replaced by one for "(\S+)"$`, theCertificateIsReplacedByOneFor)
+	ctx.Step(`^the certificate file is overwritten with "([^"]*)"$`, theCertificateFileIsOverwrittenWith)
+	ctx.Step(`^the server is stopped$`, theServerIsStopped)
+	ctx.Step(`^the certificate files are no longer watched$`, theCertificateFilesAreNoLongerWatched)
+	ctx.Step(`^a scheduling system in state "(\S+)"$`, aSchedulingSystemInState)
+	ctx.Step(`^"(\S+)" is scheduled (after|at|by cron) "([^"]*)"$`, isScheduled)
+	ctx.Step(`^"(\S+)" is scheduled for "(\S+)" (after|at|by cron) "([^"]*)"$`, isScheduledFor)
+	ctx.Step(`^the schedule fires with the result "(\S+)"$`, theScheduleFiresWithTheResult)
+	ctx.Step(`^the schedule does not fire within "(\S+)"$`, theScheduleDoesNotFireWithin)
+	ctx.Step(`^(\d+) schedules? (?:is|are) pending$`, schedulesArePending)
+	ctx.Step(`^no schedule is pending$`, noScheduleIsPending)
+	ctx.Step(`^the schedule is canceled$`, theScheduleIsCanceled)
+	ctx.Step(`^the scheduler is restarted$`, theSchedulerIsRestarted)
+	ctx.Step(`^the schedule is still pending$`, theScheduleIsStillPending)
+	ctx.Step(`^the schedule is rejected for "([^"]*)"$`, theScheduleIsRejectedFor)
+	ctx.Step(`^the system "(\S+)" is requested with the parameters '([^']*)'$`, theSystemIsRequestedWithTheParameters)
+	ctx.Step(`^"(\S+)" echoes the parameters "([^"]*)"$`, echoesTheParameters)
+	ctx.Step(`^the ticks "([^"]*)" are published before the work is completed$`, theTicksArePublishedBeforeTheWorkIsCompleted)
+	ctx.Step(`^the last seen state is "([^"]*)"$`, theLastSeenStateIs)
+	ctx.Step(`^a journaled system in state "(\S+)"$`, aJournaledSystemInState)
+	ctx.Step(`^a journaled system with a work queue of (\d+) in state "(\S+)"$`, aJournaledSystemWithAWorkQueueInState)
+	ctx.Step(`^the work is paused$`, theWorkIsPaused)
+	ctx.Step(`^no tick is published within "(\S+)"$`, noTickIsPublishedWithin)
+	ctx.Step(`^the paused count is kept$`, thePausedCountIsKept)
+	ctx.Step(`^the ticks continue from the paused count before the work is completed$`, theTicksContinueFromThePausedCountBeforeTheWorkIsCompleted)
+	ctx.Step(`^a system with a work queue of (\d+) in state "(\S+)"$`, aSystemWithAWorkQueueInState)
+	ctx.Step(`^the command is queued$`, theCommandIsQueued)
+	ctx.Step(`^(\d+) commands? (?:is|are) queued$`, commandsAreQueued)
+	ctx.Step(`^no command is queued$`, noCommandIsQueued)
+	ctx.Step(`^the queue of "(\S+)" is listed with (\d+) commands?$`, theQueueIsListedWithCommands)
+	ctx.Step(`^the queued command is canceled$`, theQueuedCommandIsCanceled)
+	ctx.Step(`^an unknown queued command cannot be canceled$`, anUnknownQueuedCommandCannotBeCanceled)
+	ctx.Step(`^the queued command is dequeued as "(\S+)"$`, theQueuedCommandIsDequeued)
+	ctx.Step(`^the system is restarted from its journal$`, theSystemIsRestartedFromItsJournal)
+}
+
+type memoryStateStore struct {
+	sync.Mutex
+	snapshots map[string]MachineSnapshot
+}
+
+func newMemoryStateStore() *memoryStateStore {
+	return &memoryStateStore{snapshots: map[string]MachineSnapshot{}}
+}
+
+func (s *memoryStateStore) Save(snapshot MachineSnapshot) error {
+	s.Lock()
+	defer s.Unlock()
+	s.snapshots[snapshot.Machine] = snapshot
+	return nil
+}
+
+func (s *memoryStateStore) Load(machine string) (MachineSnapshot, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	snapshot, ok := s.snapshots[machine]
+	return snapshot, ok, nil
+}
+
+func (s *memoryStateStore) Delete(machine string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.snapshots, machine)
+	return nil
+}
+
+func (s *memoryStateStore) List() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	res := []string{}
+	for machine := range s.snapshots {
+		res = append(res, machine)
+	}
+	return res, nil
 }
@@ -0,0 +1,199 @@
+package mermaidlive
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const websocketWriteTimeout = 10 * time.Second
+const websocketMaxMessageBytes = 4096
+
+// stands in for a message that could not be parsed
+const malformedWebsocketMessage = "-"
+
+// the default origin check only accepts same-origin browser clients
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// websocketMessage is the envelope of everything sent over /ws in either direction:
+//   - client: {"type": "command", "command": "start", "correlation_id": "1", "parameters": {"ticks": 5}}
+//   - server: {"type": "result", "correlation_id": "1", "command_id": "…", "result": "accepted", "command": "start"}
+//   - server: {"type": "event", "event": {...}}
+type websocketMessage struct {
+	Type          string `json:"type"`
+	CorrelationId string `json:"correlation_id,omitempty"`
+	CommandId     string `json:"command_id,omitempty"`
+	Command       string `json:"command,omitempty"`
+	// of the run the command starts, optional
+	Parameters *RunParameters `json:"parameters,omitempty"`
+	Result     string         `json:"result,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Event      *Event         `json:"event,omitempty"`
+}
+
+// websocketFormat writes the events as messages onto an upgraded connection.
+// Only the writing loop may use it, as the connection supports one concurrent writer
+type websocketFormat struct {
+	conn *websocket.Conn
+	err  error
+}
+
+func (f *websocketFormat) begin(_ *gin.Context) {}
+
+func (f *websocketFormat) write(_ *gin.Context, event Event) {
+	f.send(websocketMessage{Type: "event", Event: &event})
+}
+
+func (f *websocketFormat) heartbeat(_ *gin.Context) {
+	if f.err != nil {
+		return
+	}
+	f.err = f.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout))
+}
+
+func (f *websocketFormat) send(message websocketMessage) {
+	if f.err != nil {
+		return
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	f.err = f.conn.WriteJSON(message)
+}
+
+// serveWebsocket multiplexes the commands of the client and the events of the machine over one connection.
+// The outcome of a command is sent before the events it leads to
+func (s *Server) serveWebsocket(c *gin.Context, fsm *AsyncFSM, initialEvents ...Event) {
+	filter, ok := eventFilterOf(c)
+	if !ok {
+		return
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has already responded
+		slog.Warn("could not upgrade to a websocket", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(websocketMaxMessageBytes)
+
+	s.visitorTracker.Joined()
+	s.activeConnections.Add(1)
+	defer s.visitorTracker.Left()
+	defer s.activeConnections.Done()
+
+	subscription := s.subscribe(c, fsm.Topic())
+	defer subscription.Close()
+	myEvents := subscription.Events()
+
+	format := &websocketFormat{conn: conn}
+	events := filteredFormat{format, filter}
+	replayed := s.greetMachineSubscriber(c, events, []*AsyncFSM{fsm}, initialEvents...)
+
+	incoming := make(chan websocketMessage)
+	closed := make(chan struct{})
+	go readWebsocket(conn, 2*s.heartbeatInterval, incoming, closed)
+
+	heartbeat := time.NewTicker(s.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for format.err == nil {
+		select {
+		case <-s.serverContext.Done():
+			slog.Info("closing the websocket: server shutting down", "machine", fsm.Id())
+			writeLocalEvent(c, format, shuttingDownEvent())
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(websocketWriteTimeout))
+			return
+
+		case <-closed:
+			slog.Info("websocket client disconnected", "machine", fsm.Id())
+			return
+
+		case <-heartbeat.C:
+			format.heartbeat(c)
+
+		case message := <-incoming:
+			format.send(s.handleWebsocketMessage(c.Request.Context(), fsm, message))
+
+		case event, ok := <-myEvents:
+			if !ok {
+				return
+			}
+			if replayed[event.Id] {
+				delete(replayed, event.Id)
+				continue
+			}
+			deliverEvent(c, events, event)
+			if event.Name == MachineDeletedEvent {
+				// nothing more to come from a deleted machine
+				return
+			}
+		}
+	}
+	slog.Warn("could not write to the websocket", "machine", fsm.Id(), "error", format.err)
+}
+
+func (s *Server) handleWebsocketMessage(ctx context.Context, fsm *AsyncFSM, message websocketMessage) websocketMessage {
+	switch message.Type {
+	case "command":
+	case malformedWebsocketMessage:
+		return websocketMessage{Type: "error", Reason: "malformed message"}
+	default:
+		return websocketMessage{
+			Type:          "error",
+			CorrelationId: message.CorrelationId,
+			Reason:        "unsupported message type: '" + message.Type + "'",
+		}
+	}
+	slog.Info("command called over a websocket", "machine", fsm.Id(), "command", message.Command)
+	var params RunParameters
+	if message.Parameters != nil {
+		params = *message.Parameters
+	}
+	outcome := s.submitCommand(ctx, fsm, message.Command, params)
+	return websocketMessage{
+		Type:          "result",
+		CorrelationId: message.CorrelationId,
+		CommandId:     outcome.CommandId,
+		Command:       outcome.Command,
+		Result:        string(outcome.Result),
+		Reason:        outcome.Reason,
+	}
+}
+
+// readWebsocket forwards the client messages until the connection fails,
+// keeping the connection alive as long as the client answers the pings within the read timeout
+func readWebsocket(conn *websocket.Conn, readTimeout time.Duration, incoming chan<- websocketMessage, closed chan<- struct{}) {
+	defer close(closed)
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Warn("websocket read error", "error", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		var message websocketMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			message = websocketMessage{Type: malformedWebsocketMessage}
+		}
+		select {
+		case incoming <- message:
+		case <-time.After(websocketWriteTimeout):
+			slog.Warn("dropping a websocket message: the connection is not being served")
+			return
+		}
+	}
+}